@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sbipc/pkg/announce"
+	"sbipc/pkg/tplink"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dialTimeout bounds connecting and logging in to the camera.
+const dialTimeout = 10 * time.Second
+
+func main() {
+	address := flag.String("address", "", "camera address as host:port")
+	username := flag.String("username", "admin", "camera username")
+	password := flag.String("password", os.Getenv("IPC_PASSWORD"), "camera password, defaults to $IPC_PASSWORD")
+	format := flag.String("format", "", "input format: wav, pcm (signed 16 bits little endian), alaw or ulaw, defaults to the file extension or wav")
+	rate := flag.Int("rate", 8000, "sample rate of raw input")
+	channels := flag.Int("channels", 1, "channels of raw input")
+	ulaw := flag.Bool("ulaw", false, "feed the camera µ-law instead of A-law")
+
+	flag.Usage = func() {
+		log.Printf("usage: %s [flags] file, or - for stdin", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *address == "" || flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	if *format == "" {
+		*format = formatOf(name)
+	}
+
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			log.Fatalf("failed to open input: %s", err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, err := dial(ctx, *address, *username, *password)
+	if err != nil {
+		log.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+
+	raw := announce.Format{SampleRate: *rate, Channels: *channels}
+	switch *format {
+	case "wav":
+		err = announce.PlayWAV(ctx, conn, input, *ulaw)
+	case "pcm":
+		raw.Encoding = announce.EncodingPCM16
+		err = announce.Play(ctx, conn, input, raw, *ulaw)
+	case "alaw":
+		raw.Encoding = announce.EncodingALaw
+		err = announce.Play(ctx, conn, input, raw, *ulaw)
+	case "ulaw":
+		raw.Encoding = announce.EncodingULaw
+		err = announce.Play(ctx, conn, input, raw, *ulaw)
+	default:
+		log.Fatalf("unknown format: %s", *format)
+	}
+
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("failed to play: %s", err)
+	}
+}
+
+func dial(ctx context.Context, address, username, password string) (*tplink.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := tplink.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.HandshakeContext(ctx, username, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// formatOf guesses the format of a file from its extension.
+func formatOf(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pcm", ".raw", ".s16":
+		return "pcm"
+	case ".alaw", ".al":
+		return "alaw"
+	case ".ulaw", ".ul", ".mulaw":
+		return "ulaw"
+	}
+	return "wav"
+}
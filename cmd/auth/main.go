@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sbipc/pkg/auth"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s hash                 read a password from stdin and print its bcrypt hash\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s link [flags] url     print url signed for a camera\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "hash":
+		hash()
+	case "link":
+		link(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func hash() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("failed to read password: %s", err)
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(password, "\r\n")), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("failed to hash password: %s", err)
+	}
+	fmt.Println(string(hashed))
+}
+
+func link(args []string) {
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	authFile := flags.String("auth", "", "auth file with the link secret")
+	camera := flags.String("camera", "", "camera id")
+	permissions := flags.String("permissions", string(auth.View), "comma separated permissions among view, talk and ptz")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the link is valid")
+	flags.Parse(args)
+
+	if *authFile == "" || *camera == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	a, err := auth.Load(*authFile)
+	if err != nil {
+		log.Fatalf("failed to load auth: %s", err)
+	}
+
+	var granted []auth.Permission
+	for _, p := range strings.Split(*permissions, ",") {
+		granted = append(granted, auth.Permission(p))
+	}
+
+	query, err := a.SignLink(*camera, granted, time.Now().Add(*ttl))
+	if err != nil {
+		log.Fatalf("failed to sign link: %s", err)
+	}
+
+	url := flags.Arg(0)
+	separator := "?"
+	if strings.Contains(url, "?") {
+		separator = "&"
+	}
+	fmt.Println(url + separator + query.Encode())
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mic"
+	"syscall"
+	"time"
+)
+
+func main() {
+	var camera hub.Camera
+
+	flag.StringVar(&camera.Address, "address", "", "camera address as host:port")
+	flag.StringVar(&camera.Username, "username", "admin", "camera username")
+	flag.StringVar(&camera.Password, "password", os.Getenv("IPC_PASSWORD"), "camera password, defaults to $IPC_PASSWORD")
+	out := flag.String("out", "-", "output file, - for stdout")
+	format := flag.String("format", "", "output format: wav, or pcm for raw signed 16 bits little endian, defaults to pcm on stdout and wav otherwise")
+	duration := flag.Duration("duration", 0, "stop after this long, 0 to listen until interrupted")
+
+	flag.Parse()
+
+	if camera.Address == "" {
+		log.Fatalf("no camera address given")
+	}
+	if *format == "" {
+		*format = "wav"
+		if *out == "-" {
+			*format = "pcm"
+		}
+	}
+	if *format != "wav" && *format != "pcm" {
+		log.Fatalf("unknown format: %s", *format)
+	}
+
+	output := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("failed to create output: %s", err)
+		}
+		defer f.Close()
+		output = f
+	}
+
+	h := hub.New()
+	defer h.Close()
+
+	listener, err := mic.Listen(h, camera)
+	if err != nil {
+		log.Fatalf("failed to listen: %s", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+	if *duration > 0 {
+		time.AfterFunc(*duration, listener.Close)
+	}
+
+	log.Printf("listening at %d Hz", listener.SampleRate)
+
+	if *format == "pcm" {
+		if _, err := io.Copy(output, listener); err != nil {
+			log.Printf("failed to write: %s", err)
+		}
+		return
+	}
+
+	wav, err := mic.NewWAVWriter(output, listener.SampleRate)
+	if err != nil {
+		log.Fatalf("failed to write: %s", err)
+	}
+
+	for {
+		samples, err := listener.ReadSamples()
+		if err != nil {
+			break
+		}
+		if err := wav.WriteSamples(samples); err != nil {
+			log.Printf("failed to write: %s", err)
+			break
+		}
+	}
+
+	if err := wav.Close(); err != nil {
+		log.Printf("failed to write: %s", err)
+	}
+}
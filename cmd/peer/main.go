@@ -1,16 +1,126 @@
 package main
 
 import (
+	"flag"
+	"log"
 	"net/http"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/certs"
+	"sbipc/pkg/hls"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/metrics"
 	"sbipc/pkg/peer"
+	"sbipc/pkg/ptz"
+	"sbipc/pkg/registry"
+	"sbipc/pkg/turnserver"
 )
 
 func main() {
-	peerServer := peer.NewServer()
+	var listen string
+	var camerasFile string
+	var allowDirect bool
+	var authFile string
+	var iceFile string
+	var turnPortMin, turnPortMax uint
+	turnConfig := turnserver.Config{}
+	cameras := hub.CameraFlags{}
+	tlsConfig := certs.Config{}
+
+	flag.StringVar(&listen, "listen", ":8957", "http listen address")
+	flag.Var(cameras, "camera", "camera to publish over whep at /whep/name, whip talk at /whip/name, hls at /hls/name/index.m3u8 and ptz control at /ptz/name as name=username:password@host:port, can be repeated")
+	flag.StringVar(&camerasFile, "cameras", "", "yaml or json file of the cameras to publish like -camera, by id")
+	flag.BoolVar(&allowDirect, "allow-direct", false, "let websocket clients open cameras by address and credentials, always allowed without any camera")
+	flag.StringVar(&authFile, "auth", "", "yaml or json file of the users and their permissions, everyone may do anything without it")
+	flag.StringVar(&iceFile, "ice", "", "yaml or json file of the stun and turn servers, nat 1:1 ips, udp port range and muxes of webrtc, google stun without it")
+	flag.StringVar(&turnConfig.PublicIP, "turn-public-ip", "", "public ip of this host, starts an embedded turn server relaying websocket clients through it")
+	flag.StringVar(&turnConfig.Listen, "turn-listen", ":3478", "udp and tcp listen address of the turn server")
+	flag.StringVar(&turnConfig.Host, "turn-host", "", "host name of the turn server handed to clients, defaults to the public ip")
+	flag.UintVar(&turnPortMin, "turn-port-min", 0, "first port relayed by the turn server")
+	flag.UintVar(&turnPortMax, "turn-port-max", 0, "last port relayed by the turn server")
+
+	tlsConfig.AddFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	if iceFile != "" {
+		config, err := peer.LoadICEConfig(iceFile)
+		if err != nil {
+			log.Fatalf("failed to load ice config: %s", err)
+		}
+		if err := peer.ConfigureICE(config); err != nil {
+			log.Fatalf("failed to configure ice: %s", err)
+		}
+	}
+
+	cameraRegistry := registry.New()
+	if camerasFile != "" {
+		if err := cameraRegistry.Load(camerasFile); err != nil {
+			log.Fatalf("failed to load cameras: %s", err)
+		}
+	}
+	for name, camera := range cameras {
+		cameraRegistry.Add(name, camera)
+	}
+
+	var a *auth.Auth
+	if authFile != "" {
+		var err error
+		if a, err = auth.Load(authFile); err != nil {
+			log.Fatalf("failed to load auth: %s", err)
+		}
+	}
+
+	var turnServer *turnserver.Server
+	if turnConfig.PublicIP != "" {
+		turnConfig.RelayPortMin = uint16(turnPortMin)
+		turnConfig.RelayPortMax = uint16(turnPortMax)
+
+		var err error
+		if turnServer, err = turnserver.Start(&turnConfig); err != nil {
+			log.Fatalf("failed to start turn server: %s", err)
+		}
+		defer turnServer.Close()
+	}
+
+	h := hub.New()
+	peerServer := peer.NewServer(h, cameraRegistry)
+	peerServer.AllowDirect = allowDirect || len(cameraRegistry.IDs()) == 0
+	peerServer.Auth = a
+	peerServer.TURN = turnServer
+
+	whepServer := peer.NewWHEPServer(h)
+	whipServer := peer.NewWHIPServer()
+	hlsServer := hls.New(h)
+	ptzServer := ptz.NewServer()
+	for name, camera := range cameraRegistry.Cameras() {
+		whepServer.AddCamera(name, camera)
+		whipServer.AddCamera(name, camera)
+		hlsServer.AddCamera(name, camera)
+		ptzServer.AddCamera(name, camera)
+	}
 
 	http.HandleFunc("/ipc", func(w http.ResponseWriter, r *http.Request) {
 		peerServer.HandleRequest(w, r)
 	})
+	http.Handle("/cameras", a.Authenticated(cameraRegistry))
+	http.Handle("/whep/", http.StripPrefix("/whep", a.Require(auth.View, whepServer)))
+	http.Handle("/whip/", http.StripPrefix("/whip", a.Require(auth.Talk, whipServer)))
+	http.Handle("/hls/", http.StripPrefix("/hls", a.Require(auth.View, hlsServer)))
+	http.Handle("/ptz/", http.StripPrefix("/ptz", a.Require(auth.PTZ, ptzServer)))
+	http.Handle("/metrics", a.Authenticated(metrics.Handler()))
+
+	if tlsConfig.Enabled() {
+		m, err := certs.New(&tlsConfig)
+		if err != nil {
+			log.Fatalf("failed to load certificate: %s", err)
+		}
+		if m.CA() != nil {
+			http.HandleFunc("/ca.pem", m.ServeCA)
+		}
+
+		server := &http.Server{Addr: listen, TLSConfig: m.TLSConfig()}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 
-	http.ListenAndServe(":8957", nil)
+	http.ListenAndServe(listen, nil)
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/recorder"
+	"syscall"
+)
+
+func main() {
+	var camera hub.Camera
+	config := recorder.Config{}
+
+	flag.StringVar(&camera.Address, "address", "", "camera address as host:port")
+	flag.StringVar(&camera.Username, "username", "admin", "camera username")
+	flag.StringVar(&camera.Password, "password", os.Getenv("IPC_PASSWORD"), "camera password, defaults to $IPC_PASSWORD")
+	flag.StringVar(&config.Dir, "dir", "recordings", "recordings directory")
+	flag.StringVar(&config.Name, "name", "", "camera name used in file names, defaults to the address")
+	flag.DurationVar(&config.SegmentDuration, "segment", recorder.DefaultSegmentDuration, "duration of each file")
+	flag.DurationVar(&config.MaxAge, "max-age", 0, "remove files older than this, 0 to keep them")
+	flag.Int64Var(&config.MaxTotalSize, "max-size", 0, "remove the oldest files above this total size in bytes, 0 for no limit")
+	flag.BoolVar(&config.NoAudio, "no-audio", false, "record the video only")
+
+	flag.Parse()
+
+	if camera.Address == "" {
+		log.Fatalf("no camera address given")
+	}
+
+	h := hub.New()
+	r := recorder.New(h, camera, config)
+	if err := r.Start(); err != nil {
+		log.Fatalf("failed to start recording: %s", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	r.Close()
+	h.Close()
+}
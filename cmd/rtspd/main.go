@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/rtspserver"
+)
+
+func main() {
+	var listen string
+	var udpPort int
+	cameras := hub.CameraFlags{}
+
+	flag.StringVar(&listen, "listen", ":8554", "rtsp listen address")
+	flag.IntVar(&udpPort, "udp-port", 8000, "first of the two udp ports for rtp/rtcp, 0 to disable udp")
+	flag.Var(cameras, "camera", "camera to publish as name=username:password@host:port, can be repeated")
+
+	flag.Parse()
+
+	if len(cameras) == 0 {
+		log.Fatalf("no camera given")
+	}
+
+	server := rtspserver.New(hub.New())
+	for name, camera := range cameras {
+		server.AddCamera(name, camera)
+		log.Printf("publishing %s at rtsp://%s/%s", camera.Address, listen, name)
+	}
+	log.Printf("recordings play at rtsp://%s/{name}?start={unix or RFC 3339 time}", listen)
+
+	if udpPort != 0 {
+		if err := server.ListenUDP(udpPort); err != nil {
+			log.Fatalf("failed to listen udp: %s", err)
+		}
+	}
+
+	log.Fatal(server.ListenAndServe(listen))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/certs"
+	"sbipc/pkg/peer"
+	"sbipc/pkg/registry"
+	"sbipc/pkg/turnserver"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPath is read when no -config is given, if it exists.
+const defaultConfigPath = "sbipc.yaml"
+
+// The endpoints which can be served, every HTTP one by default.
+const (
+	endpointIPC     = "ipc"
+	endpointTalk    = "talk"
+	endpointCameras = "cameras"
+	endpointWHEP    = "whep"
+	endpointWHIP    = "whip"
+	endpointHLS     = "hls"
+	endpointPTZ     = "ptz"
+	endpointUI      = "ui"
+	endpointMetrics = "metrics"
+	endpointRTSP    = "rtsp"
+)
+
+var defaultEndpoints = []string{endpointIPC, endpointTalk, endpointCameras, endpointWHEP, endpointWHIP, endpointHLS, endpointPTZ, endpointUI, endpointMetrics}
+
+// Config is the configuration file of sbipc, in YAML or JSON:
+//
+//	listen: :8957
+//	tls:
+//	  selfSigned: true
+//	endpoints: [ipc, talk, hls, ui, rtsp]
+//	cameras:
+//	  door:
+//	    address: 192.168.1.10
+//	    username: admin
+//	    password: secret
+//	record:
+//	  dir: /var/lib/sbipc
+//	  cameras: [door]
+type Config struct {
+	// Listen is the HTTP address, :8957 by default.
+	Listen string `yaml:"listen" json:"listen"`
+	// Endpoints are served among ipc, talk, cameras, whep, whip, hls, ptz,
+	// ui, metrics and rtsp, every one but rtsp by default.
+	Endpoints []string `yaml:"endpoints" json:"endpoints"`
+	// UI is the directory served at /ui/, ./ui by default.
+	UI string `yaml:"ui" json:"ui"`
+	// TLS serves HTTPS when it has a certificate or is self-signed.
+	TLS  certs.Config `yaml:"tls" json:"tls"`
+	Log  LogConfig    `yaml:"log" json:"log"`
+	RTSP struct {
+		// Listen is :8554 by default.
+		Listen string `yaml:"listen" json:"listen"`
+		// UDPPort is the first of the RTP and RTCP ports, UDP is disabled
+		// when zero.
+		UDPPort int `yaml:"udpPort" json:"udpPort"`
+	} `yaml:"rtsp" json:"rtsp"`
+
+	Cameras map[string]registry.CameraConfig `yaml:"cameras" json:"cameras"`
+	// AllowDirect lets clients open cameras by address and credentials,
+	// always allowed without any camera.
+	AllowDirect bool `yaml:"allowDirect" json:"allowDirect"`
+
+	// Auth enables authentication, everyone may do anything without it.
+	Auth *auth.File         `yaml:"auth" json:"auth"`
+	ICE  *peer.ICEConfig    `yaml:"ice" json:"ice"`
+	TURN *turnserver.Config `yaml:"turn" json:"turn"`
+
+	Record RecordConfig `yaml:"record" json:"record"`
+}
+
+type LogConfig struct {
+	// File is appended to instead of writing to stderr.
+	File         string `yaml:"file" json:"file"`
+	UTC          bool   `yaml:"utc" json:"utc"`
+	Microseconds bool   `yaml:"microseconds" json:"microseconds"`
+}
+
+type RecordConfig struct {
+	// Dir is ./recordings by default.
+	Dir string `yaml:"dir" json:"dir"`
+	// Cameras are recorded while serving, and by record without arguments.
+	Cameras []string `yaml:"cameras" json:"cameras"`
+	// Segment and MaxAge are durations like "10m" or "720h".
+	Segment      Duration `yaml:"segment" json:"segment"`
+	MaxAge       Duration `yaml:"maxAge" json:"maxAge"`
+	MaxTotalSize int64    `yaml:"maxTotalSize" json:"maxTotalSize"`
+	NoAudio      bool     `yaml:"noAudio" json:"noAudio"`
+}
+
+// Duration is a time.Duration written as a string in configurations, the
+// same in JSON as in YAML.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10m\": %w", err)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10m\": %w", err)
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// loadConfig reads a configuration file, JSON when its extension is .json
+// and YAML otherwise. Without a path, defaultConfigPath is read if it
+// exists.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath
+	}
+
+	data, err := os.ReadFile(path)
+	if !explicit && errors.Is(err, fs.ErrNotExist) {
+		data, err = nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") && len(data) > 0 {
+		err = json.Unmarshal(data, config)
+	} else {
+		err = yaml.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	if config.Listen == "" {
+		config.Listen = ":8957"
+	}
+	if len(config.Endpoints) == 0 {
+		config.Endpoints = defaultEndpoints
+	}
+	if config.UI == "" {
+		config.UI = "./ui"
+	}
+	if config.RTSP.Listen == "" {
+		config.RTSP.Listen = ":8554"
+	}
+	if config.Record.Dir == "" {
+		config.Record.Dir = "recordings"
+	}
+
+	for _, endpoint := range config.Endpoints {
+		switch endpoint {
+		case endpointIPC, endpointTalk, endpointCameras, endpointWHEP, endpointWHIP, endpointHLS, endpointPTZ, endpointUI, endpointMetrics, endpointRTSP:
+		default:
+			return nil, fmt.Errorf("unknown endpoint %q", endpoint)
+		}
+	}
+
+	return config, nil
+}
+
+func (c *Config) enabled(endpoint string) bool {
+	for _, e := range c.Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// registry returns the cameras of the configuration.
+func (c *Config) registry() (*registry.Registry, error) {
+	r := registry.New()
+	if err := r.AddConfig(c.Cameras); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// setupLog applies the log configuration, and returns the log file to
+// close, if any.
+func (c *LogConfig) setupLog() (*os.File, error) {
+	flags := log.LstdFlags
+	if c.UTC {
+		flags |= log.LUTC
+	}
+	if c.Microseconds {
+		flags |= log.Lmicroseconds
+	}
+	log.SetFlags(flags)
+
+	if c.File == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open log: %w", err)
+	}
+	log.SetOutput(f)
+	return f, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	// no sbipc.yaml in the working directory
+	t.Chdir(t.TempDir())
+
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Listen != ":8957" || config.UI != "./ui" || config.RTSP.Listen != ":8554" || config.Record.Dir != "recordings" {
+		t.Errorf("got defaults %+v", config)
+	}
+	if !config.enabled(endpointHLS) || config.enabled(endpointRTSP) {
+		t.Errorf("got endpoints %v, want every one but rtsp", config.Endpoints)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	yamlPath := writeConfig(t, "sbipc.yaml", `listen: :9000
+endpoints: [hls, rtsp]
+cameras:
+  door:
+    address: 192.168.1.10
+record:
+  segment: 2m
+`)
+	jsonPath := writeConfig(t, "sbipc.json", `{"listen": ":9000", "endpoints": ["hls", "rtsp"], "cameras": {"door": {"address": "192.168.1.10"}}, "record": {"segment": "2m"}}`)
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		config, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.Listen != ":9000" || !config.enabled(endpointRTSP) || config.enabled(endpointWHEP) {
+			t.Errorf("%s: got %+v", path, config)
+		}
+		if time.Duration(config.Record.Segment) != 2*time.Minute {
+			t.Errorf("%s: got segment %s", path, config.Record.Segment)
+		}
+
+		r, err := config.registry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if camera, ok := r.Camera("door"); !ok || camera.Address != "192.168.1.10:554" {
+			t.Errorf("%s: got door %+v", path, camera)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loaded a missing explicit config")
+	}
+	if _, err := loadConfig(writeConfig(t, "sbipc.yaml", "endpoints: [ipc, ftp]\n")); err == nil {
+		t.Error("accepted an unknown endpoint")
+	}
+	if _, err := loadConfig(writeConfig(t, "sbipc.json", "{")); err == nil {
+		t.Error("accepted invalid json")
+	}
+	if _, err := loadConfig(writeConfig(t, "sbipc.yaml", "record:\n  segment: 2 minutes\n")); err == nil {
+		t.Error("accepted an invalid duration")
+	}
+	if _, err := loadConfig(writeConfig(t, "sbipc.json", `{"record": {"maxAge": 3600}}`)); err == nil {
+		t.Error("accepted a duration in nanoseconds")
+	}
+}
@@ -0,0 +1,84 @@
+// Command sbipc serves, records, talks to and probes the cameras of a
+// configuration file:
+//
+//	sbipc serve [-config sbipc.yaml]
+//	sbipc record [-config sbipc.yaml] [camera...]
+//	sbipc talk [-config sbipc.yaml] [-ulaw] camera file
+//	sbipc probe [-config sbipc.yaml] [camera...]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+type command struct {
+	run   func(args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"serve":  {serve, "serve the endpoints of the configuration until SIGTERM"},
+	"record": {record, "record cameras until SIGTERM, the record cameras or all of them by default"},
+	"talk":   {talk, "play a WAV file, or - for stdin, through the speaker of a camera"},
+	"probe":  {probe, "print the streams and capabilities of cameras, all of them by default"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s command [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, name := range []string{"serve", "record", "talk", "probe"} {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %s", os.Args[1], err)
+	}
+}
+
+// flagSet returns the flags of a command, with the -config flag every
+// command shares.
+func flagSet(name, args string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := flags.String("config", "", "yaml or json configuration file, defaults to "+defaultConfigPath+" when it exists")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s %s [flags] %s\n", os.Args[0], name, args)
+		flags.PrintDefaults()
+	}
+	return flags, configPath
+}
+
+// setup loads the configuration and applies its logging, the returned
+// function closes the log file.
+func setup(configPath string) (*Config, func(), error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logFile, err := config.Log.setupLog()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return config, func() {
+		if logFile != nil {
+			log.SetOutput(os.Stderr)
+			logFile.Close()
+		}
+	}, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+)
+
+func probe(args []string) error {
+	flags, configPath := flagSet("probe", "[camera...]")
+	flags.Parse(args)
+
+	config, closeLog, err := setup(*configPath)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	cameras, err := config.registry()
+	if err != nil {
+		return err
+	}
+
+	ids := flags.Args()
+	if len(ids) == 0 {
+		ids = cameras.IDs()
+	}
+	if len(ids) == 0 {
+		return errors.New("no camera to probe")
+	}
+
+	failed := 0
+	for _, id := range ids {
+		camera, ok := cameras.Camera(id)
+		if !ok {
+			fmt.Printf("%s: camera not found\n", id)
+			failed++
+			continue
+		}
+
+		if err := probeCamera(id, camera); err != nil {
+			fmt.Printf("%s: %s\n", id, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cameras failed", failed, len(ids))
+	}
+	return nil
+}
+
+// probeCamera prints the preview streams of a camera and whether it pans
+// and tilts.
+func probeCamera(id string, camera hub.Camera) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	conn, err := dial(ctx, camera)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Printf("%s: %s\n", id, camera.Address)
+
+	params, err := conn.StartPreviewWithOptionsContext(ctx, camera.PreviewOptions())
+	if err != nil {
+		return fmt.Errorf("start preview: %w", err)
+	}
+	for _, av := range params.AvConfig {
+		fmt.Printf("  channel %d: video %s %s", av.Channel, av.VideoCodec, av.ExtraData.VideoFmtp)
+		if av.AudioCodec != "" {
+			fmt.Printf(", audio %s %d Hz", av.AudioCodec, params.AudioClockRate())
+		}
+		fmt.Println()
+	}
+	if err := conn.StopPreviewContext(ctx, params.SessionID); err != nil {
+		return fmt.Errorf("stop preview: %w", err)
+	}
+
+	presets, err := conn.PresetsContext(ctx)
+	switch {
+	case errors.Is(err, tplink.ErrUnsupported):
+		fmt.Printf("  ptz: unsupported\n")
+	case err != nil:
+		fmt.Printf("  ptz: %s\n", err)
+	default:
+		fmt.Printf("  ptz: %d presets\n", len(presets))
+	}
+
+	return nil
+}
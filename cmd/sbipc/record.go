@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sbipc/pkg/hub"
+	"syscall"
+)
+
+func record(args []string) error {
+	flags, configPath := flagSet("record", "[camera...]")
+	flags.Parse(args)
+
+	config, closeLog, err := setup(*configPath)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	cameras, err := config.registry()
+	if err != nil {
+		return err
+	}
+
+	ids := flags.Args()
+	if len(ids) == 0 {
+		ids = config.Record.Cameras
+	}
+	if len(ids) == 0 {
+		ids = cameras.IDs()
+	}
+	if len(ids) == 0 {
+		return errors.New("no camera to record")
+	}
+
+	h := hub.New()
+	defer h.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for _, id := range ids {
+		r, err := startRecorder(h, cameras, id, &config.Record)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+
+	<-ctx.Done()
+	log.Printf("stopping recordings")
+
+	return nil
+}
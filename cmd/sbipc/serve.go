@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/certs"
+	"sbipc/pkg/hls"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/metrics"
+	"sbipc/pkg/peer"
+	"sbipc/pkg/ptz"
+	"sbipc/pkg/recorder"
+	"sbipc/pkg/registry"
+	"sbipc/pkg/rtspserver"
+	"sbipc/pkg/talkserver"
+	"sbipc/pkg/turnserver"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds waiting for HTTP requests in flight on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+func serve(args []string) error {
+	flags, configPath := flagSet("serve", "")
+	flags.Parse(args)
+
+	config, closeLog, err := setup(*configPath)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	if config.ICE != nil {
+		if err := peer.ConfigureICE(config.ICE); err != nil {
+			return fmt.Errorf("configure ice: %w", err)
+		}
+	}
+
+	cameras, err := config.registry()
+	if err != nil {
+		return err
+	}
+	allowDirect := config.AllowDirect || len(cameras.IDs()) == 0
+
+	var a *auth.Auth
+	if config.Auth != nil {
+		if a, err = auth.New(config.Auth); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	var turnServer *turnserver.Server
+	if config.TURN != nil {
+		if turnServer, err = turnserver.Start(config.TURN); err != nil {
+			return fmt.Errorf("start turn server: %w", err)
+		}
+		defer turnServer.Close()
+	}
+
+	h := hub.New()
+	defer h.Close()
+
+	// closers stop the services in the reverse order they were started
+	var closers []func()
+	defer func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	route(mux, config, h, cameras, allowDirect, a, turnServer, &closers)
+
+	server := &http.Server{Addr: config.Listen, Handler: mux}
+	if config.TLS.Enabled() {
+		m, err := certs.New(&config.TLS)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		server.TLSConfig = m.TLSConfig()
+		if m.CA() != nil {
+			mux.HandleFunc("/ca.pem", m.ServeCA)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 2)
+
+	if config.enabled(endpointRTSP) {
+		rtspServer := rtspserver.New(h)
+		rtspServer.Auth = a
+		for id, camera := range cameras.Cameras() {
+			rtspServer.AddCamera(id, camera)
+		}
+		if config.RTSP.UDPPort != 0 {
+			if err := rtspServer.ListenUDP(config.RTSP.UDPPort); err != nil {
+				return fmt.Errorf("rtsp udp: %w", err)
+			}
+		}
+		closers = append(closers, rtspServer.Close)
+
+		log.Printf("serving rtsp at %s", config.RTSP.Listen)
+		go func() {
+			if err := rtspServer.ListenAndServe(config.RTSP.Listen); !errors.Is(err, rtspserver.ErrServerClosed) {
+				errs <- fmt.Errorf("rtsp: %w", err)
+			}
+		}()
+	}
+
+	for _, id := range config.Record.Cameras {
+		r, err := startRecorder(h, cameras, id, &config.Record)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, r.Close)
+	}
+
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("serving https at %s", config.Listen)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("serving http at %s", config.Listen)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			errs <- fmt.Errorf("http: %w", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	case err = <-errs:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %s", err)
+	}
+
+	return err
+}
+
+// route mounts the enabled HTTP endpoints on mux, and appends how to stop
+// their sessions to closers.
+func route(mux *http.ServeMux, config *Config, h *hub.Hub, cameras *registry.Registry, allowDirect bool, a *auth.Auth, turnServer *turnserver.Server, closers *[]func()) {
+	if config.enabled(endpointIPC) {
+		peerServer := peer.NewServer(h, cameras)
+		peerServer.AllowDirect = allowDirect
+		peerServer.Auth = a
+		peerServer.TURN = turnServer
+		mux.HandleFunc("/ipc", peerServer.HandleRequest)
+		*closers = append(*closers, peerServer.Close)
+	}
+
+	if config.enabled(endpointTalk) {
+		talkServer := talkserver.New(cameras)
+		talkServer.AllowDirect = allowDirect
+		talkServer.Auth = a
+		mux.HandleFunc("/talk", talkServer.HandleRequest)
+		*closers = append(*closers, talkServer.Close)
+	}
+
+	if config.enabled(endpointCameras) {
+		mux.Handle("/cameras", a.Authenticated(cameras))
+	}
+
+	if config.enabled(endpointWHEP) {
+		whepServer := peer.NewWHEPServer(h)
+		for id, camera := range cameras.Cameras() {
+			whepServer.AddCamera(id, camera)
+		}
+		mux.Handle("/whep/", http.StripPrefix("/whep", a.Require(auth.View, whepServer)))
+		*closers = append(*closers, whepServer.Close)
+	}
+
+	if config.enabled(endpointWHIP) {
+		whipServer := peer.NewWHIPServer()
+		for id, camera := range cameras.Cameras() {
+			whipServer.AddCamera(id, camera)
+		}
+		mux.Handle("/whip/", http.StripPrefix("/whip", a.Require(auth.Talk, whipServer)))
+		*closers = append(*closers, whipServer.Close)
+	}
+
+	if config.enabled(endpointHLS) {
+		hlsServer := hls.New(h)
+		for id, camera := range cameras.Cameras() {
+			hlsServer.AddCamera(id, camera)
+		}
+		mux.Handle("/hls/", http.StripPrefix("/hls", a.Require(auth.View, hlsServer)))
+		*closers = append(*closers, hlsServer.Close)
+	}
+
+	if config.enabled(endpointPTZ) {
+		ptzServer := ptz.NewServer()
+		for id, camera := range cameras.Cameras() {
+			ptzServer.AddCamera(id, camera)
+		}
+		mux.Handle("/ptz/", http.StripPrefix("/ptz", a.Require(auth.PTZ, ptzServer)))
+		*closers = append(*closers, ptzServer.Close)
+	}
+
+	if config.enabled(endpointMetrics) {
+		mux.Handle("/metrics", a.Authenticated(metrics.Handler()))
+	}
+
+	if config.enabled(endpointUI) {
+		mux.Handle("/", http.RedirectHandler("/ui", 302))
+		mux.Handle("/ui/", http.StripPrefix("/ui", http.FileServer(http.Dir(config.UI))))
+	}
+}
+
+// startRecorder starts recording a camera of the registry.
+func startRecorder(h *hub.Hub, cameras *registry.Registry, id string, config *RecordConfig) (*recorder.Recorder, error) {
+	camera, ok := cameras.Camera(id)
+	if !ok {
+		return nil, fmt.Errorf("record %s: camera not found", id)
+	}
+
+	r := recorder.New(h, camera, recorder.Config{
+		Dir:             config.Dir,
+		Name:            id,
+		SegmentDuration: time.Duration(config.Segment),
+		MaxAge:          time.Duration(config.MaxAge),
+		MaxTotalSize:    config.MaxTotalSize,
+		NoAudio:         config.NoAudio,
+	})
+	if err := r.Start(); err != nil {
+		return nil, fmt.Errorf("record %s: %w", id, err)
+	}
+
+	log.Printf("recording %s to %s", id, r.Dir())
+	return r, nil
+}
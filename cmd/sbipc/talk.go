@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sbipc/pkg/announce"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+	"syscall"
+	"time"
+)
+
+// dialTimeout bounds connecting and logging in to a camera.
+const dialTimeout = 10 * time.Second
+
+func talk(args []string) error {
+	flags, configPath := flagSet("talk", "camera file, or - for stdin")
+	ulaw := flags.Bool("ulaw", false, "feed the camera µ-law instead of A-law")
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, closeLog, err := setup(*configPath)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	cameras, err := config.registry()
+	if err != nil {
+		return err
+	}
+
+	id, name := flags.Arg(0), flags.Arg(1)
+	camera, ok := cameras.Camera(id)
+	if !ok {
+		return fmt.Errorf("camera %s not found", id)
+	}
+
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("open input: %w", err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn, err := dial(ctx, camera)
+	if err != nil {
+		return fmt.Errorf("connect %s: %w", id, err)
+	}
+	defer conn.Close()
+
+	if err := announce.PlayWAV(ctx, conn, input, *ulaw); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("play: %w", err)
+	}
+
+	return nil
+}
+
+func dial(ctx context.Context, camera hub.Camera) (*tplink.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	conn, err := tplink.DialContext(ctx, camera.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.HandshakeContext(ctx, camera.Username, camera.Password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -1,19 +1,76 @@
 package main
 
 import (
+	"flag"
+	"log"
 	"net/http"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/certs"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/metrics"
+	"sbipc/pkg/registry"
 	"sbipc/pkg/talkserver"
 )
 
 func main() {
-	talkServer := talkserver.New()
+	var listen string
+	var camerasFile string
+	var allowDirect bool
+	var authFile string
+	cameras := hub.CameraFlags{}
+	tlsConfig := certs.Config{}
+
+	flag.StringVar(&listen, "listen", ":8957", "http listen address")
+	flag.Var(cameras, "camera", "camera to talk to at /talk?camera=name as name=username:password@host:port, can be repeated")
+	flag.StringVar(&camerasFile, "cameras", "", "yaml or json file of the cameras to talk to like -camera, by id")
+	flag.BoolVar(&allowDirect, "allow-direct", false, "let clients talk to cameras by address and credentials, always allowed without any camera")
+
+	flag.StringVar(&authFile, "auth", "", "yaml or json file of the users and their permissions, everyone may talk without it")
+
+	tlsConfig.AddFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	cameraRegistry := registry.New()
+	if camerasFile != "" {
+		if err := cameraRegistry.Load(camerasFile); err != nil {
+			log.Fatalf("failed to load cameras: %s", err)
+		}
+	}
+	for name, camera := range cameras {
+		cameraRegistry.Add(name, camera)
+	}
+
+	talkServer := talkserver.New(cameraRegistry)
+	talkServer.AllowDirect = allowDirect || len(cameraRegistry.IDs()) == 0
+	if authFile != "" {
+		a, err := auth.Load(authFile)
+		if err != nil {
+			log.Fatalf("failed to load auth: %s", err)
+		}
+		talkServer.Auth = a
+	}
 
 	http.HandleFunc("/talk", func(w http.ResponseWriter, r *http.Request) {
 		talkServer.HandleRequest(w, r)
 	})
+	http.Handle("/metrics", talkServer.Auth.Authenticated(metrics.Handler()))
 
 	http.Handle("/", http.RedirectHandler("/ui", 302))
 	http.Handle("/ui/", http.StripPrefix("/ui", http.FileServer(http.Dir("./ui"))))
 
-	http.ListenAndServe(":8957", nil)
+	if tlsConfig.Enabled() {
+		m, err := certs.New(&tlsConfig)
+		if err != nil {
+			log.Fatalf("failed to load certificate: %s", err)
+		}
+		if m.CA() != nil {
+			http.HandleFunc("/ca.pem", m.ServeCA)
+		}
+
+		server := &http.Server{Addr: listen, TLSConfig: m.TLSConfig()}
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+
+	http.ListenAndServe(listen, nil)
 }
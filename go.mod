@@ -1,40 +1,42 @@
 module sbipc
 
-go 1.21.3
+go 1.24.0
 
-require github.com/olahol/melody v1.1.4
+require (
+	github.com/hymkor/go-lazy v0.4.0
+	github.com/olahol/melody v1.1.4
+	github.com/pion/interceptor v0.1.22
+	github.com/pion/opus v0.1.0
+	github.com/pion/rtp/v2 v2.0.0
+	github.com/pion/turn/v3 v3.0.1
+	github.com/pion/webrtc/v4 v4.0.0-beta.5
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.3.1 // indirect
-	github.com/hymkor/go-lazy v0.4.0 // indirect
 	github.com/pion/datachannel v1.5.5 // indirect
 	github.com/pion/dtls/v2 v2.2.7 // indirect
 	github.com/pion/ice/v3 v3.0.1 // indirect
-	github.com/pion/interceptor v0.1.22 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.8 // indirect
 	github.com/pion/rtcp v1.2.10 // indirect
-	github.com/pion/rtp/v2 v2.0.0 // indirect
 	github.com/pion/sctp v1.8.9 // indirect
 	github.com/pion/sdp/v3 v3.0.6 // indirect
 	github.com/pion/srtp/v3 v3.0.0 // indirect
 	github.com/pion/stun/v2 v2.0.0 // indirect
 	github.com/pion/transport/v2 v2.2.4 // indirect
 	github.com/pion/transport/v3 v3.0.1 // indirect
-	github.com/pion/turn/v3 v3.0.1 // indirect
-	github.com/pion/webrtc/v4 v4.0.0-beta.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
+	github.com/stretchr/testify v1.11.1 // indirect
 	golang.org/x/net v0.16.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/gorilla/websocket v1.5.0
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtp v1.8.2 // indirect
-	github.com/pion/webrtc/v3 v3.2.21
+	github.com/pion/rtp v1.8.2
 )
@@ -0,0 +1,204 @@
+// Package announce plays audio files and streams through the speaker of a
+// camera, like door chimes or recorded announcements.
+package announce
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sbipc/pkg/g711"
+	"sbipc/pkg/tplink"
+	"time"
+)
+
+const (
+	// frameSamples is how many samples are sent per talk packet, 20 ms like
+	// the official clients.
+	frameSamples = 160
+	// stopTimeout bounds stopping the talk session once playing is done.
+	stopTimeout = 10 * time.Second
+	// drainDelay leaves the camera time to play the last packets before the
+	// talk session stops.
+	drainDelay = 200 * time.Millisecond
+)
+
+// Encoding is how samples are stored.
+type Encoding int
+
+const (
+	// EncodingPCM8 is unsigned 8 bits linear PCM.
+	EncodingPCM8 Encoding = iota
+	// EncodingPCM16, EncodingPCM24 and EncodingPCM32 are signed little
+	// endian linear PCM.
+	EncodingPCM16
+	EncodingPCM24
+	EncodingPCM32
+	// EncodingFloat32 is little endian IEEE 754 floats between -1 and 1.
+	EncodingFloat32
+	EncodingALaw
+	EncodingULaw
+)
+
+// size returns the bytes of one sample.
+func (e Encoding) size() int {
+	switch e {
+	case EncodingPCM16:
+		return 2
+	case EncodingPCM24:
+		return 3
+	case EncodingPCM32, EncodingFloat32:
+		return 4
+	}
+	return 1
+}
+
+// Format describes raw audio. Multiple channels are interleaved.
+type Format struct {
+	Encoding   Encoding
+	SampleRate int
+	Channels   int
+}
+
+// decode returns the samples of whole frames of b, downmixed to mono.
+func (f Format) decode(b []byte) []int16 {
+	size := f.Encoding.size()
+	frames := len(b) / (size * f.Channels)
+	out := make([]int16, frames)
+
+	for i := range out {
+		sum := 0
+		for c := 0; c < f.Channels; c++ {
+			offset := (i*f.Channels + c) * size
+			sum += int(f.Encoding.decodeSample(b[offset : offset+size]))
+		}
+		out[i] = int16(sum / f.Channels)
+	}
+
+	return out
+}
+
+func (e Encoding) decodeSample(b []byte) int16 {
+	switch e {
+	case EncodingPCM8:
+		return (int16(b[0]) - 128) << 8
+	case EncodingPCM16:
+		return int16(binary.LittleEndian.Uint16(b))
+	case EncodingPCM24:
+		return int16(uint16(b[1]) | uint16(b[2])<<8)
+	case EncodingPCM32:
+		return int16(uint16(b[2]) | uint16(b[3])<<8)
+	case EncodingFloat32:
+		f := math.Float32frombits(binary.LittleEndian.Uint32(b))
+		return int16(max(-1, min(1, f)) * math.MaxInt16)
+	case EncodingALaw:
+		return g711.DecodeALawSample(b[0])
+	case EncodingULaw:
+		return g711.DecodeULawSample(b[0])
+	}
+	return 0
+}
+
+// Play streams audio of the given format from r to the camera speaker in
+// real time, until r ends or ctx is done. The camera is fed µ-law when ulaw
+// is set, A-law otherwise. conn must be handshaken, and not talking already.
+func Play(ctx context.Context, conn *tplink.Conn, r io.Reader, format Format, ulaw bool) error {
+	if format.Channels < 1 || format.SampleRate < 1 {
+		return fmt.Errorf("invalid format: %d channels at %d Hz", format.Channels, format.SampleRate)
+	}
+
+	sessionId, err := conn.StartTalkContext(ctx)
+	if err != nil {
+		return fmt.Errorf("start talk: %w", err)
+	}
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+
+		if err := conn.StopTalkContext(ctx, sessionId); err != nil {
+			log.Printf("stop talk: %s", err)
+		}
+	}()
+
+	writer := conn.NewTalkWriter()
+	writer.Pace = true
+
+	if err := stream(ctx, writer, r, format, ulaw); err != nil {
+		return err
+	}
+
+	select {
+	case <-time.After(drainDelay):
+	case <-ctx.Done():
+	}
+
+	return nil
+}
+
+// PlayWAV plays a WAV file through the camera speaker, see Play.
+func PlayWAV(ctx context.Context, conn *tplink.Conn, r io.Reader, ulaw bool) error {
+	format, data, err := ReadWAV(r)
+	if err != nil {
+		return err
+	}
+
+	return Play(ctx, conn, data, format, ulaw)
+}
+
+// stream reads, converts and writes audio in talk frames.
+func stream(ctx context.Context, writer *tplink.TalkWriter, r io.Reader, format Format, ulaw bool) error {
+	frameSize := format.Encoding.size() * format.Channels
+	// read 20 ms at a time so live streams are not held back
+	buffer := make([]byte, frameSize*max(1, format.SampleRate/50))
+	resampler := newResampler(format.SampleRate, writer.ClockRate)
+	encode := g711.EncodeALaw
+	if ulaw {
+		encode = g711.EncodeULaw
+	}
+
+	var pending []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(r, buffer)
+		// a truncated last frame is dropped
+		n -= n % frameSize
+
+		if n > 0 {
+			pending = append(pending, encode(resampler.resample(format.decode(buffer[:n])))...)
+
+			for len(pending) >= frameSamples {
+				if _, err := writer.Write(pending[:frameSamples]); err != nil {
+					return fmt.Errorf("write talk: %w", err)
+				}
+				pending = pending[frameSamples:]
+			}
+
+			// keep the leftover from pinning the whole buffer
+			pending = append([]byte{}, pending...)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read audio: %w", err)
+		}
+	}
+
+	if len(pending) > 0 {
+		// pad the last frame with silence
+		pending = append(pending, encode(make([]int16, frameSamples-len(pending)))...)
+		if _, err := writer.Write(pending); err != nil {
+			return fmt.Errorf("write talk: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package announce
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+)
+
+func TestPlayWAV(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	c, err := tplink.Dial(camera.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Handshake(camera.Username, camera.Password); err != nil {
+		t.Fatal(err)
+	}
+
+	// 90 ms of 16 kHz stereo silence, 720 samples at 8 kHz
+	samples := make([]byte, 2*2*1440)
+	file := wav(fmtChunk(wavFormatPCM, 2, 16000, 16), chunk("data", samples))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := PlayWAV(ctx, c, bytes.NewReader(file), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last frame is padded with silence
+	frames := camera.TalkFrames()
+	if len(frames) != 5 {
+		t.Fatalf("camera got %d talk frames, want 5", len(frames))
+	}
+	for i, frame := range frames {
+		if seq := binary.BigEndian.Uint16(frame[2:]); seq != uint16(i) {
+			t.Errorf("frame %d has sequence %d", i, seq)
+		}
+		if payload := frame[12:]; !bytes.Equal(payload, bytes.Repeat([]byte{0xd5}, frameSamples)) {
+			t.Errorf("frame %d has %d bytes %x, want A-law silence", i, len(payload), payload[:min(len(payload), 4)])
+		}
+	}
+	if n := camera.Talks(); n != 1 {
+		t.Errorf("%d talks started, want 1", n)
+	}
+}
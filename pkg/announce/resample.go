@@ -0,0 +1,67 @@
+package announce
+
+// resampler converts a stream of mono samples between rates by linear
+// interpolation. When downsampling, samples are first averaged over the
+// ratio, a crude low-pass which keeps most of the aliasing out.
+type resampler struct {
+	// step is how many input samples each output sample advances
+	step float64
+	// pos is where the next output sample falls after prev, in input samples
+	pos     float64
+	prev    float64
+	started bool
+
+	// window holds the last input samples for the average
+	window []float64
+	next   int
+	sum    float64
+}
+
+func newResampler(from, to int) *resampler {
+	r := &resampler{step: float64(from) / float64(to)}
+
+	if n := from / to; n > 1 {
+		r.window = make([]float64, n)
+	}
+
+	return r
+}
+
+func (r *resampler) resample(in []int16) []int16 {
+	if r.step == 1 {
+		return in
+	}
+
+	out := make([]int16, 0, int(float64(len(in))/r.step)+1)
+
+	for _, s := range in {
+		sample := r.filter(float64(s))
+
+		if !r.started {
+			r.prev = sample
+			r.started = true
+			continue
+		}
+
+		for r.pos < 1 {
+			out = append(out, int16(r.prev+(sample-r.prev)*r.pos))
+			r.pos += r.step
+		}
+		r.pos -= 1
+		r.prev = sample
+	}
+
+	return out
+}
+
+func (r *resampler) filter(sample float64) float64 {
+	if r.window == nil {
+		return sample
+	}
+
+	r.sum += sample - r.window[r.next]
+	r.window[r.next] = sample
+	r.next = (r.next + 1) % len(r.window)
+
+	return r.sum / float64(len(r.window))
+}
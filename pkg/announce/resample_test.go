@@ -0,0 +1,48 @@
+package announce
+
+import "testing"
+
+func constant(n int, value int16) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = value
+	}
+	return samples
+}
+
+func TestResampleLength(t *testing.T) {
+	for _, test := range []struct {
+		from, to int
+	}{{48000, 8000}, {44100, 8000}, {16000, 8000}, {8000, 16000}} {
+		r := newResampler(test.from, test.to)
+
+		// one second fed by 20 ms chunks
+		total := 0
+		for i := 0; i < 50; i++ {
+			total += len(r.resample(constant(test.from/50, 1000)))
+		}
+
+		if total < test.to-2 || total > test.to+2 {
+			t.Errorf("%d Hz to %d Hz: got %d samples for a second", test.from, test.to, total)
+		}
+	}
+}
+
+func TestResampleKeepsLevel(t *testing.T) {
+	r := newResampler(48000, 8000)
+
+	out := r.resample(constant(4800, 1000))
+	// past the averaging window, a constant stays the same
+	for i, s := range out[1:] {
+		if s < 999 || s > 1000 {
+			t.Fatalf("sample %d is %d, want 1000", i+1, s)
+		}
+	}
+}
+
+func TestResampleSameRate(t *testing.T) {
+	in := []int16{1, 2, 3}
+	if out := newResampler(8000, 8000).resample(in); len(out) != 3 || out[2] != 3 {
+		t.Errorf("got %v, want the input", out)
+	}
+}
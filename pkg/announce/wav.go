@@ -0,0 +1,126 @@
+package announce
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatALaw       = 6
+	wavFormatULaw       = 7
+	wavFormatExtensible = 0xfffe
+)
+
+// wavFormatSize is the size of the largest fmt chunk, the extensible one.
+// Bytes past it are skipped rather than read.
+const wavFormatSize = 40
+
+// ReadWAV reads the header of a WAV file, and returns the format of its
+// samples and a reader of them.
+func ReadWAV(r io.Reader) (Format, io.Reader, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return Format{}, nil, fmt.Errorf("read riff header: %w", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return Format{}, nil, errors.New("not a wav file")
+	}
+
+	var format Format
+	hasFormat := false
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return Format{}, nil, fmt.Errorf("read chunk header: %w", err)
+		}
+		id := string(header[0:4])
+		size := binary.LittleEndian.Uint32(header[4:8])
+
+		switch id {
+		case "fmt ":
+			chunk := make([]byte, min(size, wavFormatSize))
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return Format{}, nil, fmt.Errorf("read fmt chunk: %w", err)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(size)-int64(len(chunk))); err != nil {
+				return Format{}, nil, fmt.Errorf("skip fmt chunk: %w", err)
+			}
+			var err error
+			if format, err = parseWAVFormat(chunk); err != nil {
+				return Format{}, nil, err
+			}
+			hasFormat = true
+		case "data":
+			if !hasFormat {
+				return Format{}, nil, errors.New("wav data before format")
+			}
+			if size == 0 || size == 0xffffffff {
+				// streamed files do not know their size
+				return format, r, nil
+			}
+			return format, io.LimitReader(r, int64(size)), nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+				return Format{}, nil, fmt.Errorf("skip %q chunk: %w", id, err)
+			}
+		}
+
+		if size%2 == 1 {
+			// chunks are word aligned
+			if _, err := io.CopyN(io.Discard, r, 1); err != nil {
+				return Format{}, nil, fmt.Errorf("skip padding: %w", err)
+			}
+		}
+	}
+}
+
+func parseWAVFormat(chunk []byte) (Format, error) {
+	if len(chunk) < 16 {
+		return Format{}, errors.New("wav format chunk too short")
+	}
+
+	tag := binary.LittleEndian.Uint16(chunk[0:2])
+	format := Format{
+		Channels:   int(binary.LittleEndian.Uint16(chunk[2:4])),
+		SampleRate: int(binary.LittleEndian.Uint32(chunk[4:8])),
+	}
+	bits := binary.LittleEndian.Uint16(chunk[14:16])
+
+	if tag == wavFormatExtensible {
+		if len(chunk) < 26 {
+			return Format{}, errors.New("wav extensible format chunk too short")
+		}
+		// the sub format GUID starts with the actual format tag
+		tag = binary.LittleEndian.Uint16(chunk[24:26])
+	}
+
+	switch {
+	case tag == wavFormatPCM && bits == 8:
+		format.Encoding = EncodingPCM8
+	case tag == wavFormatPCM && bits == 16:
+		format.Encoding = EncodingPCM16
+	case tag == wavFormatPCM && bits == 24:
+		format.Encoding = EncodingPCM24
+	case tag == wavFormatPCM && bits == 32:
+		format.Encoding = EncodingPCM32
+	case tag == wavFormatFloat && bits == 32:
+		format.Encoding = EncodingFloat32
+	case tag == wavFormatALaw:
+		format.Encoding = EncodingALaw
+	case tag == wavFormatULaw:
+		format.Encoding = EncodingULaw
+	default:
+		return Format{}, fmt.Errorf("unsupported wav format %d with %d bits", tag, bits)
+	}
+
+	if format.Channels < 1 || format.SampleRate < 1 {
+		return Format{}, fmt.Errorf("invalid wav format: %d channels at %d Hz", format.Channels, format.SampleRate)
+	}
+
+	return format, nil
+}
@@ -0,0 +1,122 @@
+package announce
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// chunk returns a RIFF chunk, padded to an even size.
+func chunk(id string, data []byte) []byte {
+	b := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wav returns a WAV file of the given chunks.
+func wav(chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return chunk("RIFF", body)
+}
+
+func fmtChunk(tag, channels uint16, sampleRate uint32, bits uint16) []byte {
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint16(b[0:], tag)
+	binary.LittleEndian.PutUint16(b[2:], channels)
+	binary.LittleEndian.PutUint32(b[4:], sampleRate)
+	binary.LittleEndian.PutUint16(b[14:], bits)
+	return chunk("fmt ", b)
+}
+
+func TestReadWAV(t *testing.T) {
+	samples := []byte{1, 2, 3, 4}
+	file := wav(
+		fmtChunk(wavFormatPCM, 2, 16000, 16),
+		// unknown chunks of odd sizes are skipped with their padding
+		chunk("LIST", []byte("odd")),
+		chunk("data", samples),
+		chunk("junk", []byte("trailing")),
+	)
+
+	format, data, err := ReadWAV(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != (Format{Encoding: EncodingPCM16, SampleRate: 16000, Channels: 2}) {
+		t.Errorf("got format %+v", format)
+	}
+
+	b, err := io.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, samples) {
+		t.Errorf("got samples %x, want %x", b, samples)
+	}
+}
+
+func TestReadWAVFormats(t *testing.T) {
+	for _, test := range []struct {
+		tag      uint16
+		bits     uint16
+		encoding Encoding
+	}{
+		{wavFormatPCM, 8, EncodingPCM8},
+		{wavFormatPCM, 24, EncodingPCM24},
+		{wavFormatFloat, 32, EncodingFloat32},
+		{wavFormatALaw, 8, EncodingALaw},
+		{wavFormatULaw, 8, EncodingULaw},
+	} {
+		format, _, err := ReadWAV(bytes.NewReader(wav(fmtChunk(test.tag, 1, 8000, test.bits), chunk("data", nil))))
+		if err != nil {
+			t.Errorf("format %d with %d bits: %s", test.tag, test.bits, err)
+			continue
+		}
+		if format.Encoding != test.encoding {
+			t.Errorf("format %d with %d bits read as %d", test.tag, test.bits, format.Encoding)
+		}
+	}
+}
+
+func TestReadWAVLongFormat(t *testing.T) {
+	// a fmt chunk claiming 4 GB is not allocated, only skipped
+	format := fmtChunk(wavFormatPCM, 1, 8000, 16)
+	binary.LittleEndian.PutUint32(format[4:], 0xfffffff0)
+	if _, _, err := ReadWAV(bytes.NewReader(wav(format))); err == nil {
+		t.Error("read a truncated fmt chunk without error")
+	}
+
+	// bytes past the known fields are skipped
+	format = fmtChunk(wavFormatPCM, 1, 8000, 16)
+	binary.LittleEndian.PutUint32(format[4:], 16+wavFormatSize)
+	format = append(format, make([]byte, wavFormatSize)...)
+	f, samples, err := ReadWAV(bytes.NewReader(wav(format, chunk("data", []byte{1, 2}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(samples); f.Encoding != EncodingPCM16 || !bytes.Equal(data, []byte{1, 2}) {
+		t.Errorf("got %+v with samples %v", f, data)
+	}
+}
+
+func TestReadWAVErrors(t *testing.T) {
+	for name, file := range map[string][]byte{
+		"not riff":           []byte("OggS and more bytes"),
+		"data before format": wav(chunk("data", []byte{0, 0}), fmtChunk(wavFormatPCM, 1, 8000, 16)),
+		"unsupported format": wav(fmtChunk(0x55, 1, 8000, 0), chunk("data", nil)),
+		"no channels":        wav(fmtChunk(wavFormatPCM, 0, 8000, 16), chunk("data", nil)),
+		"truncated":          wav(fmtChunk(wavFormatPCM, 1, 8000, 16))[:30],
+	} {
+		if _, _, err := ReadWAV(bytes.NewReader(file)); err == nil {
+			t.Errorf("%s: read without error", name)
+		}
+	}
+}
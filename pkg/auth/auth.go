@@ -0,0 +1,287 @@
+// Package auth authenticates HTTP and WebSocket clients with bearer tokens,
+// HTTP Basic passwords or signed links, and grants them permissions per
+// camera.
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Permission is what a client may do with a camera.
+type Permission string
+
+const (
+	// View watches the preview and the recordings.
+	View Permission = "view"
+	// Talk plays audio through the speaker.
+	Talk Permission = "talk"
+	// PTZ moves the camera.
+	PTZ Permission = "ptz"
+)
+
+// AllCameras grants permissions on every camera, including those opened by
+// address and credentials.
+const AllCameras = "*"
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+// Identity is an authenticated client, with its permissions by camera ID.
+type Identity struct {
+	Name    string
+	Cameras map[string][]Permission
+}
+
+// Anonymous is the identity of clients when authentication is disabled.
+var Anonymous = &Identity{
+	Name:    "anonymous",
+	Cameras: map[string][]Permission{AllCameras: {View, Talk, PTZ}},
+}
+
+// Allowed returns whether the identity has a permission on a camera, by its
+// grants on the camera or on AllCameras.
+func (i *Identity) Allowed(camera string, permission Permission) bool {
+	for _, id := range []string{camera, AllCameras} {
+		for _, p := range i.Cameras[id] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check returns ErrForbidden unless the identity has a permission on a
+// camera.
+func (i *Identity) Check(camera string, permission Permission) error {
+	if !i.Allowed(camera, permission) {
+		if camera == "" {
+			camera = "direct cameras"
+		}
+		return fmt.Errorf("%s may not %s %s: %w", i.Name, permission, camera, ErrForbidden)
+	}
+	return nil
+}
+
+// File is the authentication configuration file, in YAML or JSON:
+//
+//	linkSecret: a long random string
+//	users:
+//	  alice:
+//	    password: $2a$10$... (bcrypt)
+//	    tokens: [a long random string]
+//	    cameras:
+//	      door: [view, talk, ptz]
+//	      "*": [view]
+type File struct {
+	// LinkSecret signs links, links are refused without it.
+	LinkSecret string                `yaml:"linkSecret" json:"linkSecret"`
+	Users      map[string]UserConfig `yaml:"users" json:"users"`
+}
+
+type UserConfig struct {
+	// Password is a bcrypt hash for HTTP Basic authentication.
+	Password string `yaml:"password" json:"password"`
+	// Tokens are bearer tokens of the user.
+	Tokens  []string                `yaml:"tokens" json:"tokens"`
+	Cameras map[string][]Permission `yaml:"cameras" json:"cameras"`
+}
+
+type user struct {
+	identity *Identity
+	password []byte
+}
+
+// Auth authenticates requests.
+type Auth struct {
+	linkSecret []byte
+	users      map[string]*user
+	tokens     map[string]*Identity
+
+	lock *sync.Mutex
+	// verified caches the Basic credentials bcrypt accepted, bcrypt is
+	// too slow to run on every HLS segment
+	verified map[[sha256.Size]byte]*Identity
+}
+
+func New(file *File) (*Auth, error) {
+	a := &Auth{
+		linkSecret: []byte(file.LinkSecret),
+		users:      map[string]*user{},
+		tokens:     map[string]*Identity{},
+		lock:       &sync.Mutex{},
+		verified:   map[[sha256.Size]byte]*Identity{},
+	}
+
+	for name, config := range file.Users {
+		for _, permissions := range config.Cameras {
+			for _, p := range permissions {
+				if p != View && p != Talk && p != PTZ {
+					return nil, fmt.Errorf("user %s: unknown permission %q", name, p)
+				}
+			}
+		}
+
+		u := &user{
+			identity: &Identity{Name: name, Cameras: config.Cameras},
+			password: []byte(config.Password),
+		}
+		a.users[name] = u
+
+		for _, token := range config.Tokens {
+			if token == "" {
+				return nil, fmt.Errorf("user %s: empty token", name)
+			}
+			a.tokens[token] = u.identity
+		}
+	}
+
+	return a, nil
+}
+
+// Load reads a configuration file, JSON when its extension is .json and
+// YAML otherwise.
+func Load(path string) (*Auth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read auth: %w", err)
+	}
+
+	var file File
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return New(&file)
+}
+
+// Authenticate returns the identity of a request, from a bearer token in
+// the Authorization header or the access_token query parameter, from HTTP
+// Basic credentials, or from a signed link.
+func (a *Auth) Authenticate(r *http.Request) (*Identity, error) {
+	authorization := r.Header.Get("Authorization")
+
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		return a.token(token)
+	}
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return a.token(token)
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		return a.basic(username, password)
+	}
+
+	if r.URL.Query().Has(linkSignature) {
+		return a.link(r.URL.Query())
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+func (a *Auth) token(token string) (*Identity, error) {
+	for t, identity := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return identity, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid token: %w", ErrUnauthenticated)
+}
+
+func (a *Auth) basic(username, password string) (*Identity, error) {
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+
+	a.lock.Lock()
+	identity, ok := a.verified[key]
+	a.lock.Unlock()
+	if ok {
+		return identity, nil
+	}
+
+	u, ok := a.users[username]
+	if !ok || len(u.password) == 0 {
+		return nil, fmt.Errorf("invalid password: %w", ErrUnauthenticated)
+	}
+	if err := bcrypt.CompareHashAndPassword(u.password, []byte(password)); err != nil {
+		return nil, fmt.Errorf("invalid password: %w", ErrUnauthenticated)
+	}
+
+	a.lock.Lock()
+	a.verified[key] = u.identity
+	a.lock.Unlock()
+
+	return u.identity, nil
+}
+
+// Unauthorized answers a request which failed to authenticate, or lacked a
+// permission.
+func (a *Auth) Unauthorized(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="sbipc"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// Require authenticates requests and checks they have a permission on the
+// camera named by the first segment of their path, before passing them to
+// next. CORS preflights pass through, and every request when a is nil.
+func (a *Auth) Require(permission Permission, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := a.Authenticate(r)
+		if err == nil {
+			camera, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+			err = identity.Check(camera, permission)
+		}
+		if err != nil {
+			a.Unauthorized(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticated passes authenticated requests to next, whatever their
+// permissions, and every request when a is nil.
+func (a *Auth) Authenticated(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := a.Authenticate(r); err != nil {
+			a.Unauthorized(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
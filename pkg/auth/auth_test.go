@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestAuth(t *testing.T) *Auth {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(&File{
+		LinkSecret: "link secret",
+		Users: map[string]UserConfig{
+			"alice": {
+				Password: string(hash),
+				Tokens:   []string{"alice-token"},
+				Cameras:  map[string][]Permission{"door": {View, Talk}, AllCameras: {View}},
+			},
+			"bob": {
+				Tokens:  []string{"bob-token"},
+				Cameras: map[string][]Permission{"garden": {PTZ}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuth(t)
+
+	for _, test := range []struct {
+		name     string
+		setup    func(r *http.Request)
+		identity string
+	}{
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer alice-token") }, "alice"},
+		{"access token", func(r *http.Request) { r.URL.RawQuery = "access_token=bob-token" }, "bob"},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, "alice"},
+		{"basic cached", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, "alice"},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, ""},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "nope") }, ""},
+		{"no password", func(r *http.Request) { r.SetBasicAuth("bob", "") }, ""},
+		{"nothing", func(r *http.Request) {}, ""},
+	} {
+		r := httptest.NewRequest("GET", "/door/index.m3u8", nil)
+		test.setup(r)
+
+		identity, err := a.Authenticate(r)
+		if test.identity == "" {
+			if !errors.Is(err, ErrUnauthenticated) {
+				t.Errorf("%s: got %v, want unauthenticated", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if identity.Name != test.identity {
+			t.Errorf("%s: got %s, want %s", test.name, identity.Name, test.identity)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	a := newTestAuth(t)
+	alice := a.tokens["alice-token"]
+
+	if err := alice.Check("door", Talk); err != nil {
+		t.Error(err)
+	}
+	if err := alice.Check("garden", View); err != nil {
+		t.Errorf("view on every camera: %s", err)
+	}
+	if err := alice.Check("garden", PTZ); !errors.Is(err, ErrForbidden) {
+		t.Errorf("got %v, want forbidden", err)
+	}
+	if err := Anonymous.Check("", PTZ); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewRefusesUnknownPermissions(t *testing.T) {
+	_, err := New(&File{Users: map[string]UserConfig{
+		"alice": {Cameras: map[string][]Permission{"door": {"fly"}}},
+	}})
+	if err == nil {
+		t.Error("accepted an unknown permission")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "auth.yaml")
+	os.WriteFile(yamlPath, []byte("users:\n  alice:\n    tokens: [yaml-token]\n    cameras:\n      door: [view]\n"), 0o600)
+	jsonPath := filepath.Join(dir, "auth.json")
+	os.WriteFile(jsonPath, []byte(`{"users": {"alice": {"tokens": ["json-token"], "cameras": {"door": ["view"]}}}}`), 0o600)
+
+	for path, token := range map[string]string{yamlPath: "yaml-token", jsonPath: "json-token"} {
+		a, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity, err := a.token(token); err != nil || !identity.Allowed("door", View) {
+			t.Errorf("%s: got %v, %v", path, identity, err)
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	a := newTestAuth(t)
+
+	query, err := a.SignLink("door", []Permission{View}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/door/index.m3u8?"+query.Encode(), nil)
+	identity, err := a.Authenticate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.Allowed("door", View) || identity.Allowed("door", Talk) || identity.Allowed("garden", View) {
+		t.Errorf("link grants %v", identity.Cameras)
+	}
+
+	// granting more than signed
+	query.Set(linkPermissions, "view,talk")
+	if _, err := a.link(query); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("got %v for a tampered link", err)
+	}
+
+	expired, _ := a.SignLink("door", []Permission{View}, time.Now().Add(-time.Second))
+	if _, err := a.link(expired); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("got %v for an expired link", err)
+	}
+
+	noSecret, _ := New(&File{})
+	if _, err := noSecret.SignLink("door", []Permission{View}, time.Now().Add(time.Hour)); err == nil {
+		t.Error("signed a link without a secret")
+	}
+	if _, err := noSecret.link(query); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("got %v with links disabled", err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	a := newTestAuth(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, test := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "/door/talk", "alice-token", http.StatusOK},
+		{"GET", "/garden/talk", "alice-token", http.StatusForbidden},
+		{"GET", "/door/talk", "", http.StatusUnauthorized},
+		{"OPTIONS", "/door/talk", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		a.Require(Talk, ok).ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s with %q: got %d, want %d", test.method, test.path, test.token, w.Code, test.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("no WWW-Authenticate header")
+		}
+	}
+
+	var disabled *Auth
+	w := httptest.NewRecorder()
+	disabled.Require(PTZ, ok).ServeHTTP(w, httptest.NewRequest("GET", "/door", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d with authentication disabled", w.Code)
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The query parameters of signed links.
+const (
+	linkCamera      = "camera"
+	linkPermissions = "permissions"
+	linkExpires     = "expires"
+	linkSignature   = "signature"
+)
+
+// SignLink returns the query parameters granting permissions on a camera
+// until expires, to append to the URL shared.
+func (a *Auth) SignLink(camera string, permissions []Permission, expires time.Time) (url.Values, error) {
+	if len(a.linkSecret) == 0 {
+		return nil, fmt.Errorf("no link secret")
+	}
+
+	names := make([]string, len(permissions))
+	for i, p := range permissions {
+		names[i] = string(p)
+	}
+
+	query := url.Values{}
+	query.Set(linkCamera, camera)
+	query.Set(linkPermissions, strings.Join(names, ","))
+	query.Set(linkExpires, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(linkSignature, a.sign(query))
+	return query, nil
+}
+
+// sign returns the signature of the link parameters of a query.
+func (a *Auth) sign(query url.Values) string {
+	mac := hmac.New(sha256.New, a.linkSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%s", query.Get(linkCamera), query.Get(linkPermissions), query.Get(linkExpires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// link returns the identity of a signed link.
+func (a *Auth) link(query url.Values) (*Identity, error) {
+	if len(a.linkSecret) == 0 {
+		return nil, fmt.Errorf("links disabled: %w", ErrUnauthenticated)
+	}
+
+	if !hmac.Equal([]byte(query.Get(linkSignature)), []byte(a.sign(query))) {
+		return nil, fmt.Errorf("invalid link signature: %w", ErrUnauthenticated)
+	}
+
+	expires, err := strconv.ParseInt(query.Get(linkExpires), 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return nil, fmt.Errorf("link expired: %w", ErrUnauthenticated)
+	}
+
+	camera := query.Get(linkCamera)
+	var permissions []Permission
+	for _, p := range strings.Split(query.Get(linkPermissions), ",") {
+		permissions = append(permissions, Permission(p))
+	}
+
+	return &Identity{
+		Name:    "link to " + camera,
+		Cameras: map[string][]Permission{camera: permissions},
+	}, nil
+}
@@ -0,0 +1,141 @@
+package avc
+
+import (
+	"bytes"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+
+	"github.com/pion/rtp/v2"
+)
+
+func TestParseSPS(t *testing.T) {
+	info, err := ParseSPS(tplinktest.SPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Width != 1280 || info.Height != 720 {
+		t.Errorf("got %dx%d, want 1280x720", info.Width, info.Height)
+	}
+	if info.ProfileIdc != 66 || info.LevelIdc != 31 {
+		t.Errorf("got profile %d level %d, want 66 and 31", info.ProfileIdc, info.LevelIdc)
+	}
+	if codec := Codec(tplinktest.SPS); codec != "avc1.42c01f" {
+		t.Errorf("got codec %s, want avc1.42c01f", codec)
+	}
+}
+
+func TestParseSPSTooShort(t *testing.T) {
+	if _, err := ParseSPS([]byte{0x67, 0x42}); err == nil {
+		t.Error("parsed a truncated sps")
+	}
+}
+
+func TestParseSpropParameterSets(t *testing.T) {
+	sps, pps := ParseSpropParameterSets("packetization-mode=1;profile-level-id=42C01F;sprop-parameter-sets=Z0LAHxoyNQCgC2QDwiEagA==,aBo048g=")
+
+	if !bytes.Equal(sps, tplinktest.SPS) {
+		t.Errorf("got sps %x, want %x", sps, tplinktest.SPS)
+	}
+	if !bytes.Equal(pps, tplinktest.PPS) {
+		t.Errorf("got pps %x, want %x", pps, tplinktest.PPS)
+	}
+}
+
+func packet(seq uint16, ts uint32, marker bool, payload []byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts, Marker: marker},
+		Payload: payload,
+	}
+}
+
+// fragments splits a NAL unit into FU-A payloads of size bytes.
+func fragments(nalu []byte, size int) [][]byte {
+	var payloads [][]byte
+	header := nalu[0]
+	data := nalu[1:]
+	for i := 0; i < len(data); i += size {
+		end := min(i+size, len(data))
+		fu := header & 0x1f
+		if i == 0 {
+			fu |= 0x80
+		}
+		if end == len(data) {
+			fu |= 0x40
+		}
+		payloads = append(payloads, append([]byte{header&0xe0 | 28, fu}, data[i:end]...))
+	}
+	return payloads
+}
+
+func TestDepacketizerKeyFrame(t *testing.T) {
+	d := NewDepacketizer()
+
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 100)...)
+	payloads := append([][]byte{tplinktest.SPS, tplinktest.PPS}, fragments(idr, 30)...)
+
+	var au *AccessUnit
+	for i, payload := range payloads {
+		au = d.Push(packet(uint16(i), 3000, i == len(payloads)-1, payload))
+		if au != nil && i != len(payloads)-1 {
+			t.Fatalf("frame completed by packet %d", i)
+		}
+	}
+
+	if au == nil {
+		t.Fatal("no frame")
+	}
+	if !au.IsKeyFrame || au.Timestamp != 3000 {
+		t.Errorf("got key frame %v at %d", au.IsKeyFrame, au.Timestamp)
+	}
+	if len(au.NALUs) != 3 || !bytes.Equal(au.NALUs[2], idr) {
+		t.Errorf("got %d nal units, want sps, pps and the reassembled idr", len(au.NALUs))
+	}
+	if !bytes.Equal(d.SPS, tplinktest.SPS) || !bytes.Equal(d.PPS, tplinktest.PPS) {
+		t.Error("parameter sets not kept")
+	}
+
+	avcc := au.AVCC()
+	if len(avcc) != 3*4+len(tplinktest.SPS)+len(tplinktest.PPS)+len(idr) || avcc[3] != byte(len(tplinktest.SPS)) {
+		t.Errorf("bad avcc: %x", avcc[:8])
+	}
+	if annexB := au.AnnexB(); !bytes.HasPrefix(annexB, append([]byte{0, 0, 0, 1}, tplinktest.SPS...)) {
+		t.Errorf("bad annex b: %x", annexB[:8])
+	}
+}
+
+func TestDepacketizerMissingMarker(t *testing.T) {
+	d := NewDepacketizer()
+
+	if au := d.Push(packet(0, 3000, false, []byte{0x65, 1, 0, 0})); au != nil {
+		t.Fatal("frame completed without a marker")
+	}
+	au := d.Push(packet(1, 6000, true, []byte{0x41, 2, 0, 0}))
+	if au == nil || au.Timestamp != 3000 {
+		t.Fatalf("got %+v, want the first frame ended by a new timestamp", au)
+	}
+	if au = d.Push(packet(2, 9000, true, []byte{0x41, 3, 0, 0})); au == nil || au.Timestamp != 6000 {
+		t.Fatalf("got %+v, want the second frame", au)
+	}
+}
+
+func TestDepacketizerDropsFramesAfterLoss(t *testing.T) {
+	d := NewDepacketizer()
+
+	if au := d.Push(packet(0, 0, true, []byte{0x65, 1, 0, 0})); au == nil {
+		t.Fatal("no key frame")
+	}
+	// packet 1 is lost
+	if au := d.Push(packet(2, 3000, true, []byte{0x41, 2, 0, 0})); au != nil {
+		t.Error("got a frame predicted from a lost one")
+	}
+	if au := d.Push(packet(3, 6000, true, []byte{0x41, 3, 0, 0})); au != nil {
+		t.Error("got a frame before the next key frame")
+	}
+	if au := d.Push(packet(4, 9000, true, []byte{0x65, 4, 0, 0})); au == nil || !au.IsKeyFrame {
+		t.Error("next key frame dropped")
+	}
+	if au := d.Push(packet(5, 12000, true, []byte{0x41, 5, 0, 0})); au == nil {
+		t.Error("frame after the key frame dropped")
+	}
+}
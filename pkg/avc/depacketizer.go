@@ -0,0 +1,172 @@
+// Package avc reassembles H.264 access units from the RTP packets sent by
+// the cameras, and parses what muxers need to know about them.
+package avc
+
+import (
+	"encoding/binary"
+	"sbipc/pkg/metrics"
+
+	"github.com/pion/rtp/v2"
+	"github.com/pion/rtp/v2/codecs"
+)
+
+const (
+	NaluTypeSlice = 1
+	NaluTypeIDR   = 5
+	NaluTypeSEI   = 6
+	NaluTypeSPS   = 7
+	NaluTypePPS   = 8
+	NaluTypeAUD   = 9
+)
+
+// AccessUnit is a complete video frame.
+type AccessUnit struct {
+	// Timestamp is the RTP timestamp of the frame, in 90 kHz units.
+	Timestamp uint32
+	// NALUs are the NAL units of the frame, without start codes nor length
+	// prefixes.
+	NALUs [][]byte
+	// IsKeyFrame is set when the frame contains an IDR slice.
+	IsKeyFrame bool
+}
+
+// AVCC returns the NAL units of the frame prefixed by their 4 bytes length,
+// as stored in MP4 samples.
+func (au *AccessUnit) AVCC() []byte {
+	size := 0
+	for _, nalu := range au.NALUs {
+		size += 4 + len(nalu)
+	}
+
+	b := make([]byte, 0, size)
+	for _, nalu := range au.NALUs {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// AnnexB returns the NAL units of the frame prefixed by start codes.
+func (au *AccessUnit) AnnexB() []byte {
+	b := make([]byte, 0)
+	for _, nalu := range au.NALUs {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// droppedFrames counts the frames damaged by packet loss, of every
+// depacketizer.
+var droppedFrames = metrics.NewCounter("sbipc_dropped_frames_total", "Video frames dropped after packet loss until the next key frame.")
+
+// Depacketizer reassembles access units from H.264 RTP packets, and keeps
+// track of the latest parameter sets.
+type Depacketizer struct {
+	// SPS and PPS are the latest parameter sets seen in the stream.
+	SPS []byte
+	PPS []byte
+
+	packet  *codecs.H264Packet
+	current *AccessUnit
+	started bool
+	lastSeq uint16
+	// broken is set after a lost packet, until the next key frame
+	broken bool
+}
+
+func NewDepacketizer() *Depacketizer {
+	return &Depacketizer{
+		packet: &codecs.H264Packet{IsAVC: true},
+	}
+}
+
+// Push adds an RTP packet, and returns the access unit it completes if any.
+// Frames damaged by packet loss are dropped until the next key frame.
+func (d *Depacketizer) Push(p *rtp.Packet) *AccessUnit {
+	var done *AccessUnit
+
+	if d.started && p.SequenceNumber != d.lastSeq+1 {
+		d.packet = &codecs.H264Packet{IsAVC: true}
+		d.current = nil
+		d.broken = true
+	}
+	d.started = true
+	d.lastSeq = p.SequenceNumber
+
+	// the marker bit may be missing, so a new timestamp also ends a frame
+	if d.current != nil && d.current.Timestamp != p.Timestamp {
+		done = d.finish()
+	}
+
+	avcc, err := d.packet.Unmarshal(p.Payload)
+	if err != nil {
+		d.packet = &codecs.H264Packet{IsAVC: true}
+		d.current = nil
+		d.broken = true
+		return done
+	}
+
+	if d.current == nil {
+		d.current = &AccessUnit{Timestamp: p.Timestamp}
+	}
+
+	for len(avcc) >= 4 {
+		size := int(binary.BigEndian.Uint32(avcc))
+		if size > len(avcc)-4 {
+			break
+		}
+		d.addNalu(avcc[4 : 4+size])
+		avcc = avcc[4+size:]
+	}
+
+	if p.Marker {
+		if done != nil {
+			// only one frame can be returned at a time, the current one is
+			// returned along the next packet
+			return done
+		}
+		done = d.finish()
+	}
+
+	return done
+}
+
+func (d *Depacketizer) addNalu(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+
+	switch nalu[0] & 0x1f {
+	case NaluTypeSPS:
+		d.SPS = append([]byte{}, nalu...)
+	case NaluTypePPS:
+		d.PPS = append([]byte{}, nalu...)
+	case NaluTypeIDR:
+		d.current.IsKeyFrame = true
+	case NaluTypeAUD:
+		// muxers insert their own if needed
+		return
+	}
+
+	d.current.NALUs = append(d.current.NALUs, nalu)
+}
+
+func (d *Depacketizer) finish() *AccessUnit {
+	au := d.current
+	d.current = nil
+
+	if au == nil || len(au.NALUs) == 0 {
+		return nil
+	}
+
+	if d.broken {
+		if !au.IsKeyFrame {
+			droppedFrames.Inc()
+			return nil
+		}
+		d.broken = false
+	}
+
+	return au
+}
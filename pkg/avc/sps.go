@@ -0,0 +1,322 @@
+package avc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errShortSPS = errors.New("sps too short")
+
+// SPSInfo is what muxers need to know from a sequence parameter set.
+type SPSInfo struct {
+	ProfileIdc uint8
+	LevelIdc   uint8
+	Width      int
+	Height     int
+}
+
+// Codec returns the RFC 6381 codecs string of the stream, like avc1.42c01f.
+func Codec(sps []byte) string {
+	if len(sps) < 4 {
+		return "avc1"
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errShortSPS
+	}
+	b := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned exp-Golomb code.
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, fmt.Errorf("invalid exp-golomb code")
+		}
+	}
+
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << zeros) - 1 + v, nil
+}
+
+// se reads a signed exp-Golomb code.
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int(v+1) / 2, nil
+	}
+	return -int(v / 2), nil
+}
+
+// unescape removes the emulation prevention bytes of a NAL unit.
+func unescape(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// ParseSPS parses the profile, level and picture size of a SPS NAL unit.
+func ParseSPS(sps []byte) (*SPSInfo, error) {
+	if len(sps) < 4 {
+		return nil, errShortSPS
+	}
+
+	data := unescape(sps)
+	info := &SPSInfo{
+		ProfileIdc: data[1],
+		LevelIdc:   data[3],
+	}
+	r := &bitReader{data: data[4:]}
+
+	// seq_parameter_set_id
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+
+	chromaFormatIdc := uint(1)
+	switch info.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormatIdc, err = r.ue(); err != nil {
+			return nil, err
+		}
+		if chromaFormatIdc == 3 {
+			// separate_colour_plane_flag
+			if _, err := r.bit(); err != nil {
+				return nil, err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+		scalingMatrixPresent, err := r.bit()
+		if err != nil {
+			return nil, err
+		}
+		if scalingMatrixPresent == 1 {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.bit()
+				if err != nil {
+					return nil, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipScalingList(r, size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	switch pocType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		if _, err := r.ue(); err != nil {
+			return nil, err
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		if _, err := r.se(); err != nil {
+			return nil, err
+		}
+		if _, err := r.se(); err != nil {
+			return nil, err
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err := r.se(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// max_num_ref_frames
+	if _, err := r.ue(); err != nil {
+		return nil, err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err := r.bit(); err != nil {
+		return nil, err
+	}
+
+	widthMbs, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	frameMbsOnly, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	if frameMbsOnly == 0 {
+		// mb_adaptive_frame_field_flag
+		if _, err := r.bit(); err != nil {
+			return nil, err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err := r.bit(); err != nil {
+		return nil, err
+	}
+
+	width := int(widthMbs+1) * 16
+	height := int(2-frameMbsOnly) * int(heightMapUnits+1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return nil, err
+	}
+	if cropping == 1 {
+		var crop [4]uint
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return nil, err
+			}
+		}
+
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if chromaFormatIdc == 1 {
+			cropUnitX, cropUnitY = 2, 2*int(2-frameMbsOnly)
+		} else if chromaFormatIdc == 2 {
+			cropUnitX = 2
+		}
+
+		width -= cropUnitX * int(crop[0]+crop[1])
+		height -= cropUnitY * int(crop[2]+crop[3])
+	}
+
+	info.Width = width
+	info.Height = height
+
+	return info, nil
+}
+
+// ParseSpropParameterSets extracts the SPS and PPS from the
+// sprop-parameter-sets of a fmtp line.
+func ParseSpropParameterSets(fmtp string) (sps, pps []byte) {
+	for _, param := range strings.Split(fmtp, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if key != "sprop-parameter-sets" {
+			continue
+		}
+
+		for _, encoded := range strings.Split(value, ",") {
+			nalu, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(nalu) == 0 {
+				continue
+			}
+
+			switch nalu[0] & 0x1f {
+			case NaluTypeSPS:
+				sps = nalu
+			case NaluTypePPS:
+				pps = nalu
+			}
+		}
+	}
+
+	return sps, pps
+}
@@ -0,0 +1,216 @@
+// Package certs provides the certificates of HTTPS servers, loaded from
+// files or issued by a local CA persisted on disk, and reloaded when they
+// change so that renewals need no restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkInterval is how often the certificate files are checked for changes,
+// and the self-signed certificate for renewal.
+const checkInterval = 10 * time.Second
+
+// Config is the TLS configuration of a server, in YAML or JSON:
+//
+//	cert: /etc/letsencrypt/live/cam.example.com/fullchain.pem
+//	key: /etc/letsencrypt/live/cam.example.com/privkey.pem
+//
+// or:
+//
+//	selfSigned: true
+//	dir: /var/lib/sbipc/certs
+//	hosts: [cam.example.com]
+type Config struct {
+	// Cert and Key are PEM files, reloaded when they change.
+	Cert string `yaml:"cert" json:"cert"`
+	Key  string `yaml:"key" json:"key"`
+	// SelfSigned issues a certificate from a local CA instead, which
+	// clients must trust once to reach the server.
+	SelfSigned bool `yaml:"selfSigned" json:"selfSigned"`
+	// Dir keeps the CA and the certificate it issued, ./certs by default.
+	Dir string `yaml:"dir" json:"dir"`
+	// Hosts are the names and IPs the self-signed certificate is valid
+	// for, besides localhost, the host name and the IPs of the host.
+	Hosts []string `yaml:"hosts" json:"hosts"`
+}
+
+// Enabled reports whether HTTPS is configured.
+func (c *Config) Enabled() bool {
+	return c.Cert != "" || c.SelfSigned
+}
+
+// Manager hands the current certificate to TLS handshakes.
+type Manager struct {
+	certFile string
+	keyFile  string
+	ca       *authority
+	hosts    []string
+
+	lock    *sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// New loads the certificate of a configuration, creating the CA and issuing
+// the certificate first when self-signed.
+func New(config *Config) (*Manager, error) {
+	m := &Manager{
+		certFile: config.Cert,
+		keyFile:  config.Key,
+		hosts:    config.Hosts,
+		lock:     &sync.Mutex{},
+	}
+
+	switch {
+	case config.Cert != "" && config.SelfSigned:
+		return nil, errors.New("cert and selfSigned are exclusive")
+	case config.Cert != "":
+		if config.Key == "" {
+			return nil, errors.New("cert given without key")
+		}
+	case config.SelfSigned:
+		dir := config.Dir
+		if dir == "" {
+			dir = "certs"
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("create certs dir: %w", err)
+		}
+
+		ca, err := loadAuthority(dir)
+		if err != nil {
+			return nil, err
+		}
+		m.ca = ca
+		m.certFile = filepath.Join(dir, "cert.pem")
+		m.keyFile = filepath.Join(dir, "key.pem")
+	default:
+		return nil, errors.New("no certificate configured")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if err := m.check(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// TLSConfig returns a server configuration using the current certificate.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// GetCertificate returns the current certificate, reloading it first when
+// its files changed. A certificate which fails to reload is logged and the
+// previous one kept.
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if time.Since(m.checked) >= checkInterval {
+		if err := m.check(); err != nil {
+			log.Printf("certs: %s", err)
+		}
+	}
+
+	return m.cert, nil
+}
+
+// check renews the self-signed certificate if needed, and reloads the
+// certificate files when they changed.
+func (m *Manager) check() error {
+	m.checked = time.Now()
+
+	if m.ca != nil {
+		if err := m.ca.renew(m.certFile, m.keyFile, append(defaultHosts(), m.hosts...)); err != nil {
+			return err
+		}
+	}
+
+	modTime, err := latestModTime(m.certFile, m.keyFile)
+	if err != nil {
+		return err
+	}
+	if m.cert != nil && modTime.Equal(m.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(m.certFile, m.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+
+	log.Printf("certs: loaded %s for %v, valid until %s", m.certFile, names(cert.Leaf), cert.Leaf.NotAfter.Format(time.RFC3339))
+
+	m.cert = &cert
+	m.modTime = modTime
+	return nil
+}
+
+// CA returns the PEM certificate of the local CA, nil when certificates are
+// provided.
+func (m *Manager) CA() []byte {
+	if m.ca == nil {
+		return nil
+	}
+	return m.ca.certPEM
+}
+
+// ServeCA serves the local CA, for clients to install and trust.
+func (m *Manager) ServeCA(w http.ResponseWriter, r *http.Request) {
+	ca := m.CA()
+	if ca == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="sbipc-ca.pem"`)
+	w.Write(ca)
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("stat certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// names returns the host names and IPs a certificate is valid for.
+func names(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
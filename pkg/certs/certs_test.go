@@ -0,0 +1,158 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func verify(t *testing.T, m *Manager, host string) error {
+	t.Helper()
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(m.CA()) {
+		t.Fatal("no ca")
+	}
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+	return err
+}
+
+func TestSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := New(&Config{SelfSigned: true, Dir: dir, Hosts: []string{"cam.example.com", "203.0.113.7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "cam.example.com", "203.0.113.7"} {
+		if err := verify(t, m, host); err != nil {
+			t.Errorf("%s: %s", host, err)
+		}
+	}
+	if err := verify(t, m, "other.example.com"); err == nil {
+		t.Error("certificate valid for another host")
+	}
+
+	ca, err := parseCert(m.CA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.IsCA || time.Until(ca.NotAfter) < 9*365*24*time.Hour {
+		t.Errorf("got ca valid until %s", ca.NotAfter)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ca-key.pem")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got ca key %v, %v", info, err)
+	}
+
+	// restarts keep the ca and the certificate
+	certPEM, _ := os.ReadFile(filepath.Join(dir, "cert.pem"))
+	again, err := New(&Config{SelfSigned: true, Dir: dir, Hosts: []string{"cam.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.CA(), m.CA()) {
+		t.Error("ca created again")
+	}
+	if reissued, _ := os.ReadFile(filepath.Join(dir, "cert.pem")); !bytes.Equal(reissued, certPEM) {
+		t.Error("certificate issued again")
+	}
+
+	// a new host issues the certificate again, from the same ca
+	again, err = New(&Config{SelfSigned: true, Dir: dir, Hosts: []string{"cam.example.org"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.CA(), m.CA()) {
+		t.Error("ca created again")
+	}
+	if err := verify(t, again, "cam.example.org"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCertFilesReloaded(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := loadAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ca.issue(certFile, keyFile, []string{"one.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(&Config{Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.CA() != nil {
+		t.Error("got a ca for provided certificates")
+	}
+
+	if err := ca.issue(certFile, keyFile, []string{"two.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	// not checked again before checkInterval
+	cert, _ := m.GetCertificate(nil)
+	if cert.Leaf.Subject.CommonName != "one.example.com" {
+		t.Errorf("reloaded before the check interval")
+	}
+
+	m.lock.Lock()
+	m.checked = time.Time{}
+	m.lock.Unlock()
+	cert, _ = m.GetCertificate(nil)
+	if cert.Leaf.Subject.CommonName != "two.example.com" {
+		t.Errorf("got %s, want the new certificate", cert.Leaf.Subject.CommonName)
+	}
+
+	// a broken certificate keeps the previous one
+	os.WriteFile(certFile, []byte("broken"), 0644)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	m.lock.Lock()
+	m.checked = time.Time{}
+	m.lock.Unlock()
+	if cert, _ := m.GetCertificate(nil); cert == nil || cert.Leaf.Subject.CommonName != "two.example.com" {
+		t.Error("lost the certificate")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, config := range []*Config{
+		{},
+		{Cert: "cert.pem"},
+		{Cert: "cert.pem", Key: "key.pem", SelfSigned: true},
+		{Cert: filepath.Join(t.TempDir(), "missing.pem"), Key: "key.pem"},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
+
+func TestServeCA(t *testing.T) {
+	m, err := New(&Config{SelfSigned: true, Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeCA(w, httptest.NewRequest(http.MethodGet, "/ca.pem", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), m.CA()) {
+		t.Errorf("got %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
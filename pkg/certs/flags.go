@@ -0,0 +1,22 @@
+package certs
+
+import (
+	"flag"
+	"strings"
+)
+
+// AddFlags adds the -tls-* flags filling the configuration to flags.
+func (c *Config) AddFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.Cert, "tls-cert", "", "pem certificate file serving https and wss with -tls-key, reloaded when it changes")
+	flags.StringVar(&c.Key, "tls-key", "", "pem key file of -tls-cert")
+	flags.BoolVar(&c.SelfSigned, "tls-self-signed", false, "serve https and wss with a certificate issued by a local ca, which clients download at /ca.pem to trust it")
+	flags.StringVar(&c.Dir, "tls-dir", "certs", "directory keeping the local ca and its certificate")
+	flags.Func("tls-hosts", "comma separated host names and ips of the self-signed certificate, besides localhost, the host name and its ips", func(value string) error {
+		for _, host := range strings.Split(value, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				c.Hosts = append(c.Hosts, host)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,60 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// boxWriter builds ISO BMFF boxes in memory.
+type boxWriter struct {
+	bytes.Buffer
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.WriteByte(v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *boxWriter) u24(v uint32) {
+	w.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *boxWriter) zeros(n int) {
+	w.Write(make([]byte, n))
+}
+
+// box writes a box, with its content written by fn.
+func (w *boxWriter) box(typ string, fn func()) {
+	start := w.Len()
+	w.u32(0)
+	w.WriteString(typ)
+	fn()
+	binary.BigEndian.PutUint32(w.Bytes()[start:], uint32(w.Len()-start))
+}
+
+// fullBox writes a box with a version and flags.
+func (w *boxWriter) fullBox(typ string, version uint8, flags uint32, fn func()) {
+	w.box(typ, func() {
+		w.u8(version)
+		w.u24(flags)
+		fn()
+	})
+}
+
+// matrix writes the identity transformation matrix.
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
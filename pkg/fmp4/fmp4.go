@@ -0,0 +1,329 @@
+// Package fmp4 writes fragmented MP4, as used by the recorder and HLS.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type Codec string
+
+const (
+	CodecH264 Codec = "avc1"
+	CodecALaw Codec = "alaw"
+	CodecULaw Codec = "ulaw"
+)
+
+type Track struct {
+	ID        uint32
+	Codec     Codec
+	TimeScale uint32
+
+	// Width, Height, SPS and PPS describe H.264 tracks.
+	Width  int
+	Height int
+	SPS    []byte
+	PPS    []byte
+
+	// SampleRate and Channels describe audio tracks.
+	SampleRate int
+	Channels   int
+}
+
+func (t *Track) isVideo() bool {
+	return t.Codec == CodecH264
+}
+
+type Sample struct {
+	// Data is an AVCC access unit for video, or raw samples for audio.
+	Data     []byte
+	Duration uint32
+	IsSync   bool
+}
+
+// Run is the samples of a track in a fragment.
+type Run struct {
+	Track *Track
+	// BaseTime is the decode time of the first sample, in the track
+	// timescale.
+	BaseTime uint64
+	Samples  []*Sample
+}
+
+// Duration returns the total duration of the samples.
+func (r *Run) Duration() uint64 {
+	var d uint64
+	for _, s := range r.Samples {
+		d += uint64(s.Duration)
+	}
+	return d
+}
+
+const (
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// Init returns the initialization segment (ftyp and moov) for tracks.
+func Init(tracks []*Track) ([]byte, error) {
+	w := &boxWriter{}
+
+	w.box("ftyp", func() {
+		w.WriteString("iso5")
+		w.u32(512)
+		w.WriteString("iso5")
+		w.WriteString("iso6")
+		w.WriteString("mp41")
+	})
+
+	var err error
+	w.box("moov", func() {
+		w.fullBox("mvhd", 0, 0, func() {
+			w.u32(0)       // creation_time
+			w.u32(0)       // modification_time
+			w.u32(1000)    // timescale
+			w.u32(0)       // duration
+			w.u32(0x10000) // rate
+			w.u16(0x100)   // volume
+			w.zeros(10)
+			w.matrix()
+			w.zeros(24)
+			w.u32(uint32(len(tracks) + 1)) // next_track_ID
+		})
+
+		for _, t := range tracks {
+			if e := writeTrak(w, t); e != nil {
+				err = e
+			}
+		}
+
+		w.box("mvex", func() {
+			for _, t := range tracks {
+				w.fullBox("trex", 0, 0, func() {
+					w.u32(t.ID)
+					w.u32(1) // default_sample_description_index
+					w.u32(0) // default_sample_duration
+					w.u32(0) // default_sample_size
+					w.u32(0) // default_sample_flags
+				})
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w.Bytes(), nil
+}
+
+func writeTrak(w *boxWriter, t *Track) error {
+	var err error
+
+	w.box("trak", func() {
+		w.fullBox("tkhd", 0, 3, func() {
+			w.u32(0) // creation_time
+			w.u32(0) // modification_time
+			w.u32(t.ID)
+			w.u32(0) // reserved
+			w.u32(0) // duration
+			w.zeros(8)
+			w.u16(0) // layer
+			w.u16(0) // alternate_group
+			if t.isVideo() {
+				w.u16(0)
+			} else {
+				w.u16(0x100)
+			}
+			w.u16(0)
+			w.matrix()
+			w.u32(uint32(t.Width) << 16)
+			w.u32(uint32(t.Height) << 16)
+		})
+
+		w.box("mdia", func() {
+			w.fullBox("mdhd", 0, 0, func() {
+				w.u32(0) // creation_time
+				w.u32(0) // modification_time
+				w.u32(t.TimeScale)
+				w.u32(0)      // duration
+				w.u16(0x55c4) // language: und
+				w.u16(0)
+			})
+
+			w.fullBox("hdlr", 0, 0, func() {
+				w.u32(0)
+				if t.isVideo() {
+					w.WriteString("vide")
+				} else {
+					w.WriteString("soun")
+				}
+				w.zeros(12)
+				if t.isVideo() {
+					w.WriteString("VideoHandler\x00")
+				} else {
+					w.WriteString("SoundHandler\x00")
+				}
+			})
+
+			w.box("minf", func() {
+				if t.isVideo() {
+					w.fullBox("vmhd", 0, 1, func() {
+						w.zeros(8)
+					})
+				} else {
+					w.fullBox("smhd", 0, 0, func() {
+						w.zeros(4)
+					})
+				}
+
+				w.box("dinf", func() {
+					w.fullBox("dref", 0, 0, func() {
+						w.u32(1)
+						w.fullBox("url ", 0, 1, func() {})
+					})
+				})
+
+				w.box("stbl", func() {
+					w.fullBox("stsd", 0, 0, func() {
+						w.u32(1)
+						err = writeSampleEntry(w, t)
+					})
+					// samples are described by the fragments
+					w.fullBox("stts", 0, 0, func() {
+						w.u32(0)
+					})
+					w.fullBox("stsc", 0, 0, func() {
+						w.u32(0)
+					})
+					w.fullBox("stsz", 0, 0, func() {
+						w.u32(0)
+						w.u32(0)
+					})
+					w.fullBox("stco", 0, 0, func() {
+						w.u32(0)
+					})
+				})
+			})
+		})
+	})
+
+	return err
+}
+
+func writeSampleEntry(w *boxWriter, t *Track) error {
+	switch t.Codec {
+	case CodecH264:
+		if len(t.SPS) < 4 || len(t.PPS) == 0 {
+			return fmt.Errorf("missing sps or pps")
+		}
+
+		w.box("avc1", func() {
+			w.zeros(6)
+			w.u16(1) // data_reference_index
+			w.zeros(16)
+			w.u16(uint16(t.Width))
+			w.u16(uint16(t.Height))
+			w.u32(0x00480000) // horizresolution
+			w.u32(0x00480000) // vertresolution
+			w.u32(0)
+			w.u16(1) // frame_count
+			w.zeros(32)
+			w.u16(0x18)   // depth
+			w.u16(0xffff) // pre_defined
+
+			w.box("avcC", func() {
+				w.u8(1)
+				w.u8(t.SPS[1]) // profile
+				w.u8(t.SPS[2]) // profile compatibility
+				w.u8(t.SPS[3]) // level
+				w.u8(0xff)     // 4 bytes NALU length
+				w.u8(0xe1)     // 1 SPS
+				w.u16(uint16(len(t.SPS)))
+				w.Write(t.SPS)
+				w.u8(1) // 1 PPS
+				w.u16(uint16(len(t.PPS)))
+				w.Write(t.PPS)
+			})
+		})
+	case CodecALaw, CodecULaw:
+		channels := t.Channels
+		if channels == 0 {
+			channels = 1
+		}
+
+		w.box(string(t.Codec), func() {
+			w.zeros(6)
+			w.u16(1) // data_reference_index
+			w.zeros(8)
+			w.u16(uint16(channels))
+			w.u16(16) // samplesize
+			w.u16(0)
+			w.u16(0)
+			w.u32(uint32(t.SampleRate) << 16)
+		})
+	default:
+		return fmt.Errorf("unsupported codec: %s", t.Codec)
+	}
+
+	return nil
+}
+
+// MediaSegment returns a fragment (moof and mdat) holding runs.
+func MediaSegment(sequence uint32, runs []*Run) []byte {
+	w := &boxWriter{}
+
+	// positions of the trun data_offset fields to patch once the moof size
+	// is known
+	offsets := make([]int, 0, len(runs))
+
+	w.box("moof", func() {
+		w.fullBox("mfhd", 0, 0, func() {
+			w.u32(sequence)
+		})
+
+		for _, r := range runs {
+			w.box("traf", func() {
+				// default-base-is-moof
+				w.fullBox("tfhd", 0, 0x020000, func() {
+					w.u32(r.Track.ID)
+				})
+				w.fullBox("tfdt", 1, 0, func() {
+					w.u64(r.BaseTime)
+				})
+				// data-offset, sample duration, size and flags present
+				w.fullBox("trun", 0, 0x000701, func() {
+					w.u32(uint32(len(r.Samples)))
+					offsets = append(offsets, w.Len())
+					w.u32(0)
+					for _, s := range r.Samples {
+						w.u32(s.Duration)
+						w.u32(uint32(len(s.Data)))
+						if s.IsSync || !r.Track.isVideo() {
+							w.u32(sampleFlagsSync)
+						} else {
+							w.u32(sampleFlagsNonSync)
+						}
+					}
+				})
+			})
+		}
+	})
+
+	dataOffset := w.Len() + 8
+	for i, r := range runs {
+		binary.BigEndian.PutUint32(w.Bytes()[offsets[i]:], uint32(dataOffset))
+		for _, s := range r.Samples {
+			dataOffset += len(s.Data)
+		}
+	}
+
+	w.box("mdat", func() {
+		for _, r := range runs {
+			for _, s := range r.Samples {
+				w.Write(s.Data)
+			}
+		}
+	})
+
+	return w.Bytes()
+}
@@ -0,0 +1,240 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+// boxes returns the types of the boxes of data, failing on sizes overflowing
+// it.
+func boxes(t *testing.T, data []byte) []string {
+	t.Helper()
+
+	var types []string
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header: %x", data)
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("box %s of size %d in %d bytes", data[4:8], size, len(data))
+		}
+		types = append(types, string(data[4:8]))
+		data = data[size:]
+	}
+	return types
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testTracks() []*Track {
+	return []*Track{
+		{ID: 1, Codec: CodecH264, TimeScale: 90000, Width: 1280, Height: 720, SPS: tplinktest.SPS, PPS: tplinktest.PPS},
+		{ID: 2, Codec: CodecALaw, TimeScale: 8000, SampleRate: 8000, Channels: 1},
+	}
+}
+
+func TestInit(t *testing.T) {
+	init, err := Init(testTracks())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if types := boxes(t, init); !equal(types, []string{"ftyp", "moov"}) {
+		t.Errorf("got boxes %v, want ftyp and moov", types)
+	}
+	for _, box := range []string{"avc1", "avcC", "alaw", "mvex"} {
+		if !bytes.Contains(init, []byte(box)) {
+			t.Errorf("no %s box", box)
+		}
+	}
+}
+
+func TestMediaSegment(t *testing.T) {
+	tracks := testTracks()
+	segment := MediaSegment(7, []*Run{
+		{Track: tracks[0], Samples: []*Sample{
+			{Data: []byte{0, 0, 0, 2, 0x65, 1}, Duration: 3000, IsSync: true},
+			{Data: []byte{0, 0, 0, 2, 0x41, 2}, Duration: 3000},
+		}},
+		{Track: tracks[1], Samples: []*Sample{
+			{Data: bytes.Repeat([]byte{0xd5}, 320), Duration: 320, IsSync: true},
+		}},
+	})
+
+	if types := boxes(t, segment); !equal(types, []string{"moof", "mdat"}) {
+		t.Fatalf("got boxes %v, want moof and mdat", types)
+	}
+
+	moofSize := binary.BigEndian.Uint32(segment)
+	mdat := segment[moofSize:]
+	if size := binary.BigEndian.Uint32(mdat); size != 8+6+6+320 {
+		t.Errorf("mdat of %d bytes, want %d", size, 8+6+6+320)
+	}
+}
+
+// mediaStream generates the RTP packets of a video at 25 frames per second
+// with a key frame every gop frames, along with 40 ms of A-law audio.
+type mediaStream struct {
+	gop   int
+	frame int
+	seq   uint16
+}
+
+func (s *mediaStream) marshal(seq uint16, ts uint32, marker bool, payload []byte) []byte {
+	p := &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: ts, Marker: marker},
+		Payload: payload,
+	}
+	b, err := p.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// next returns the video packets and the audio packet of the next frame.
+func (s *mediaStream) next() ([][]byte, []byte) {
+	ts := uint32(s.frame * 3600)
+
+	var nalus [][]byte
+	if s.frame%s.gop == 0 {
+		nalus = [][]byte{tplinktest.SPS, tplinktest.PPS, {0x65, 0x88, 0x84, 0x00}}
+	} else {
+		nalus = [][]byte{{0x41, 0x9a, 0x02, 0x00}}
+	}
+
+	var video [][]byte
+	for i, nalu := range nalus {
+		video = append(video, s.marshal(s.seq, ts, i == len(nalus)-1, nalu))
+		s.seq++
+	}
+	audio := s.marshal(uint16(s.frame), uint32(s.frame*320), true, bytes.Repeat([]byte{0xd5}, 320))
+
+	s.frame++
+	return video, audio
+}
+
+func TestMuxerFragmentsOnKeyFrames(t *testing.T) {
+	config := ConfigFromPreview(tplinktest.DefaultPreviewParams(), true)
+	if config.AudioCodec != CodecALaw || config.AudioSampleRate != 8000 || config.SPS == nil {
+		t.Fatalf("bad config from preview: %+v", config)
+	}
+
+	m := NewMuxer(config)
+	stream := &mediaStream{gop: 10}
+
+	var fragments []*Fragment
+	for i := 0; i < 31; i++ {
+		video, audio := stream.next()
+		for _, packet := range video {
+			fragment, err := m.WritePacket(0, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fragment != nil {
+				fragments = append(fragments, fragment)
+			}
+		}
+		if _, err := m.WritePacket(1, audio); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m.Init() == nil {
+		t.Fatal("no init segment")
+	}
+	if codecs := m.Codecs(); codecs != "avc1.42c01f,alaw" {
+		t.Errorf("got codecs %s", codecs)
+	}
+
+	// the key frames of frames 10, 20 and 30 end a fragment each
+	if len(fragments) != 3 {
+		t.Fatalf("got %d fragments, want 3", len(fragments))
+	}
+	for i, fragment := range fragments {
+		if !fragment.Independent {
+			t.Errorf("fragment %d does not start with a key frame", i)
+		}
+		if fragment.Duration != 400*time.Millisecond {
+			t.Errorf("fragment %d lasts %s, want 400ms", i, fragment.Duration)
+		}
+		if fragment.Time != time.Duration(i)*400*time.Millisecond {
+			t.Errorf("fragment %d at %s", i, fragment.Time)
+		}
+		if !bytes.Equal(fragment.Init, m.Init()) {
+			t.Errorf("fragment %d has another init segment", i)
+		}
+		if types := boxes(t, fragment.Data); !equal(types, []string{"moof", "mdat"}) {
+			t.Errorf("fragment %d has boxes %v", i, types)
+		}
+	}
+}
+
+func TestMuxerMaxFragmentDuration(t *testing.T) {
+	config := ConfigFromPreview(tplinktest.DefaultPreviewParams(), false)
+	config.MaxFragmentDuration = 100 * time.Millisecond
+
+	m := NewMuxer(config)
+	stream := &mediaStream{gop: 10}
+
+	var fragments []*Fragment
+	for i := 0; i < 11; i++ {
+		video, _ := stream.next()
+		for _, packet := range video {
+			fragment, err := m.WritePacket(0, packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fragment != nil {
+				fragments = append(fragments, fragment)
+			}
+		}
+	}
+
+	if len(fragments) < 3 {
+		t.Fatalf("got %d fragments, want the GOP split", len(fragments))
+	}
+	for i, fragment := range fragments {
+		if fragment.Duration > config.MaxFragmentDuration {
+			t.Errorf("fragment %d lasts %s", i, fragment.Duration)
+		}
+		if fragment.Independent != (i == 0) {
+			t.Errorf("fragment %d independent: %v", i, fragment.Independent)
+		}
+	}
+}
+
+func TestMuxerWaitsForKeyFrame(t *testing.T) {
+	m := NewMuxer(ConfigFromPreview(tplinktest.DefaultPreviewParams(), true))
+	stream := &mediaStream{gop: 10, frame: 1}
+
+	for i := 0; i < 5; i++ {
+		video, audio := stream.next()
+		for _, packet := range video {
+			if fragment, err := m.WritePacket(0, packet); err != nil || fragment != nil {
+				t.Fatalf("got fragment %v, error %v before a key frame", fragment, err)
+			}
+		}
+		m.WritePacket(1, audio)
+	}
+
+	if m.Init() != nil {
+		t.Error("init segment before a key frame")
+	}
+}
@@ -0,0 +1,316 @@
+package fmp4
+
+import (
+	"bytes"
+	"fmt"
+	"sbipc/pkg/avc"
+	"sbipc/pkg/tplink"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+const (
+	videoTrackId   = 1
+	audioTrackId   = 2
+	videoTimeScale = 90000
+)
+
+type MuxerConfig struct {
+	// AudioCodec is CodecALaw or CodecULaw, or empty to mux video only.
+	AudioCodec      Codec
+	AudioSampleRate int
+
+	// SPS and PPS are used until the stream carries its own.
+	SPS []byte
+	PPS []byte
+
+	// MaxFragmentDuration splits a GOP into several fragments when set,
+	// for low latency streaming.
+	MaxFragmentDuration time.Duration
+}
+
+// ConfigFromPreview returns the muxer configuration of a camera preview.
+func ConfigFromPreview(params *tplink.PreviewParams, withAudio bool) *MuxerConfig {
+	config := &MuxerConfig{}
+	if params == nil || len(params.AvConfig) == 0 {
+		return config
+	}
+
+	config.SPS, config.PPS = avc.ParseSpropParameterSets(params.AvConfig[0].ExtraData.VideoFmtp)
+
+	if withAudio {
+		switch strings.ToUpper(params.AvConfig[0].AudioCodec) {
+		case "PCMA", "G711A":
+			config.AudioCodec = CodecALaw
+		case "PCMU", "G711U":
+			config.AudioCodec = CodecULaw
+		}
+		config.AudioSampleRate = params.AudioClockRate()
+	}
+
+	return config
+}
+
+// Fragment is a moof and mdat pair produced by a Muxer.
+type Fragment struct {
+	Data []byte
+	// Init is the initialization segment the fragment must be played with.
+	Init []byte
+	// Time is the decode time of the fragment since the muxer started.
+	Time     time.Duration
+	Duration time.Duration
+	// Independent is set when the fragment starts with a key frame.
+	Independent bool
+}
+
+// Muxer turns the RTP packets of a preview into fMP4 fragments, starting a
+// new fragment at every key frame.
+type Muxer struct {
+	config       *MuxerConfig
+	depacketizer *avc.Depacketizer
+	init         []byte
+	video        *Track
+	audio        *Track
+	sequence     uint32
+
+	started      bool
+	audioStarted bool
+	videoTs      timeline
+	videoBase    uint64
+	audioBase    uint64
+	// pending is the latest frame, waiting for the next one to know its
+	// duration
+	pending   *avc.AccessUnit
+	pendingAt uint64
+	videoRun  []*Sample
+	audioRun  []*Sample
+}
+
+// timeline unwraps 32 bits RTP timestamps into a monotonic 64 bits clock.
+type timeline struct {
+	started bool
+	last    uint32
+	value   uint64
+}
+
+func (t *timeline) unwrap(ts uint32) uint64 {
+	if !t.started {
+		t.started = true
+		t.last = ts
+		return 0
+	}
+
+	t.value = uint64(int64(t.value) + int64(int32(ts-t.last)))
+	t.last = ts
+	return t.value
+}
+
+func NewMuxer(config *MuxerConfig) *Muxer {
+	return &Muxer{
+		config:       config,
+		depacketizer: avc.NewDepacketizer(),
+	}
+}
+
+// Init returns the current initialization segment, or nil until the first
+// key frame.
+func (m *Muxer) Init() []byte {
+	return m.init
+}
+
+// Codecs returns the RFC 6381 codecs of the stream, or an empty string
+// until the first key frame.
+func (m *Muxer) Codecs() string {
+	if m.video == nil {
+		return ""
+	}
+
+	codecs := avc.Codec(m.video.SPS)
+	if m.audio != nil {
+		codecs += "," + string(m.audio.Codec)
+	}
+	return codecs
+}
+
+// WritePacket adds an RTP packet received on a camera channel, and returns
+// the fragment it completes if any.
+func (m *Muxer) WritePacket(channel int, packet []byte) (*Fragment, error) {
+	var p rtp.Packet
+	if err := p.Unmarshal(packet); err != nil {
+		return nil, fmt.Errorf("unmarshal rtp: %w", err)
+	}
+
+	switch channel {
+	case 0:
+		return m.writeVideo(&p)
+	case 1:
+		m.writeAudio(&p)
+	}
+
+	return nil, nil
+}
+
+func (m *Muxer) writeVideo(p *rtp.Packet) (*Fragment, error) {
+	au := m.depacketizer.Push(p)
+	if au == nil {
+		return nil, nil
+	}
+
+	if !m.started {
+		if !au.IsKeyFrame {
+			return nil, nil
+		}
+		if err := m.setup(); err != nil {
+			return nil, err
+		}
+		m.started = true
+	}
+
+	at := m.videoTs.unwrap(au.Timestamp)
+
+	var fragment *Fragment
+	if m.pending != nil {
+		// the duration of a frame is only known once the next one arrives
+		duration := uint32(1)
+		if at > m.pendingAt {
+			duration = uint32(at - m.pendingAt)
+		}
+
+		m.videoRun = append(m.videoRun, &Sample{
+			Data:     m.pending.AVCC(),
+			Duration: duration,
+			IsSync:   m.pending.IsKeyFrame,
+		})
+
+		// a key frame starts a new fragment, and fragments are cut before
+		// the next frame would make them longer than MaxFragmentDuration
+		if au.IsKeyFrame || m.config.MaxFragmentDuration > 0 &&
+			m.runDuration()+time.Duration(duration)*time.Second/videoTimeScale > m.config.MaxFragmentDuration {
+			fragment = m.flush()
+		}
+	}
+
+	if au.IsKeyFrame && m.depacketizer.SPS != nil && m.depacketizer.PPS != nil &&
+		!bytes.Equal(m.depacketizer.SPS, m.video.SPS) {
+		// resolution or profile changed, the next fragments need a new init
+		if err := m.setup(); err != nil {
+			return fragment, err
+		}
+	}
+
+	m.pending = au
+	m.pendingAt = at
+
+	return fragment, nil
+}
+
+func (m *Muxer) writeAudio(p *rtp.Packet) {
+	if m.audio == nil || !m.started || len(p.Payload) == 0 {
+		return
+	}
+
+	if !m.audioStarted {
+		// align the first audio sample with the current video time
+		m.audioStarted = true
+		m.audioBase = m.pendingAt * uint64(m.audio.TimeScale) / videoTimeScale
+	}
+
+	channels := m.audio.Channels
+	if channels == 0 {
+		channels = 1
+	}
+
+	m.audioRun = append(m.audioRun, &Sample{
+		Data:     p.Payload,
+		Duration: uint32(len(p.Payload) / channels),
+		IsSync:   true,
+	})
+}
+
+// setup builds the tracks and the initialization segment from the latest
+// parameter sets.
+func (m *Muxer) setup() error {
+	sps, pps := m.depacketizer.SPS, m.depacketizer.PPS
+	if sps == nil {
+		sps = m.config.SPS
+	}
+	if pps == nil {
+		pps = m.config.PPS
+	}
+	if sps == nil || pps == nil {
+		return fmt.Errorf("no sps or pps in stream")
+	}
+
+	info, err := avc.ParseSPS(sps)
+	if err != nil {
+		return fmt.Errorf("parse sps: %w", err)
+	}
+
+	m.video = &Track{
+		ID:        videoTrackId,
+		Codec:     CodecH264,
+		TimeScale: videoTimeScale,
+		Width:     info.Width,
+		Height:    info.Height,
+		SPS:       sps,
+		PPS:       pps,
+	}
+	tracks := []*Track{m.video}
+
+	if m.config.AudioCodec != "" {
+		m.audio = &Track{
+			ID:         audioTrackId,
+			Codec:      m.config.AudioCodec,
+			TimeScale:  uint32(m.config.AudioSampleRate),
+			SampleRate: m.config.AudioSampleRate,
+			Channels:   1,
+		}
+		tracks = append(tracks, m.audio)
+	}
+
+	init, err := Init(tracks)
+	if err != nil {
+		return err
+	}
+	m.init = init
+
+	return nil
+}
+
+func (m *Muxer) runDuration() time.Duration {
+	var d uint64
+	for _, s := range m.videoRun {
+		d += uint64(s.Duration)
+	}
+	return time.Duration(d) * time.Second / videoTimeScale
+}
+
+// flush returns the fragment of the buffered samples.
+func (m *Muxer) flush() *Fragment {
+	m.sequence++
+
+	videoRun := &Run{Track: m.video, BaseTime: m.videoBase, Samples: m.videoRun}
+	runs := []*Run{videoRun}
+	if m.audio != nil && len(m.audioRun) > 0 {
+		audioRun := &Run{Track: m.audio, BaseTime: m.audioBase, Samples: m.audioRun}
+		runs = append(runs, audioRun)
+		m.audioBase += audioRun.Duration()
+	}
+
+	duration := videoRun.Duration()
+	fragment := &Fragment{
+		Data:        MediaSegment(m.sequence, runs),
+		Init:        m.init,
+		Time:        time.Duration(m.videoBase) * time.Second / videoTimeScale,
+		Duration:    time.Duration(duration) * time.Second / videoTimeScale,
+		Independent: len(m.videoRun) > 0 && m.videoRun[0].IsSync,
+	}
+
+	m.videoBase += duration
+	m.videoRun = nil
+	m.audioRun = nil
+
+	return fragment
+}
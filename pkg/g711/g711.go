@@ -0,0 +1,127 @@
+// Package g711 converts between 16 bits linear PCM and the A-law and µ-law
+// encodings the cameras use for audio.
+package g711
+
+const (
+	alawMask = 0x55
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+// EncodeALawSample encodes a linear sample to A-law.
+func EncodeALawSample(sample int16) byte {
+	pcm := int(sample)
+	sign := 0x80
+	if pcm < 0 {
+		sign = 0
+		pcm = -pcm - 1
+	}
+	if pcm > 0x7fff {
+		pcm = 0x7fff
+	}
+
+	var encoded int
+	if pcm < 256 {
+		encoded = pcm >> 4
+	} else {
+		exponent := 7
+		for mask := 0x4000; pcm&mask == 0 && exponent > 1; mask >>= 1 {
+			exponent--
+		}
+		encoded = exponent<<4 | (pcm>>(exponent+3))&0x0f
+	}
+
+	return byte((encoded | sign) ^ alawMask)
+}
+
+// DecodeALawSample decodes an A-law sample to linear.
+func DecodeALawSample(encoded byte) int16 {
+	a := int(encoded ^ alawMask)
+	exponent := (a & 0x70) >> 4
+	mantissa := a & 0x0f
+
+	var pcm int
+	if exponent == 0 {
+		pcm = mantissa<<4 + 8
+	} else {
+		pcm = (mantissa<<4 + 0x108) << (exponent - 1)
+	}
+
+	if a&0x80 == 0 {
+		pcm = -pcm
+	}
+	return int16(pcm)
+}
+
+// EncodeULawSample encodes a linear sample to µ-law.
+func EncodeULawSample(sample int16) byte {
+	pcm := int(sample)
+	sign := 0
+	if pcm < 0 {
+		sign = 0x80
+		pcm = -pcm
+	}
+	if pcm > ulawClip {
+		pcm = ulawClip
+	}
+	pcm += ulawBias
+
+	exponent := 7
+	for mask := 0x4000; pcm&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (pcm >> (exponent + 3)) & 0x0f
+
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// DecodeULawSample decodes a µ-law sample to linear.
+func DecodeULawSample(encoded byte) int16 {
+	u := int(^encoded)
+	exponent := (u & 0x70) >> 4
+	mantissa := u & 0x0f
+
+	pcm := (mantissa<<3 + ulawBias) << exponent
+	pcm -= ulawBias
+
+	if u&0x80 != 0 {
+		pcm = -pcm
+	}
+	return int16(pcm)
+}
+
+// EncodeALaw encodes linear samples to A-law.
+func EncodeALaw(pcm []int16) []byte {
+	out := make([]byte, len(pcm))
+	for i, sample := range pcm {
+		out[i] = EncodeALawSample(sample)
+	}
+	return out
+}
+
+// DecodeALaw decodes A-law samples to linear.
+func DecodeALaw(encoded []byte) []int16 {
+	out := make([]int16, len(encoded))
+	for i, b := range encoded {
+		out[i] = DecodeALawSample(b)
+	}
+	return out
+}
+
+// EncodeULaw encodes linear samples to µ-law.
+func EncodeULaw(pcm []int16) []byte {
+	out := make([]byte, len(pcm))
+	for i, sample := range pcm {
+		out[i] = EncodeULawSample(sample)
+	}
+	return out
+}
+
+// DecodeULaw decodes µ-law samples to linear.
+func DecodeULaw(encoded []byte) []int16 {
+	out := make([]int16, len(encoded))
+	for i, b := range encoded {
+		out[i] = DecodeULawSample(b)
+	}
+	return out
+}
@@ -0,0 +1,67 @@
+package g711
+
+import "testing"
+
+func TestSilence(t *testing.T) {
+	if b := EncodeALawSample(0); b != 0xd5 {
+		t.Errorf("A-law silence is %#x, want 0xd5", b)
+	}
+	if b := EncodeULawSample(0); b != 0xff {
+		t.Errorf("µ-law silence is %#x, want 0xff", b)
+	}
+}
+
+func TestALawRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		b := byte(i)
+		if got := EncodeALawSample(DecodeALawSample(b)); got != b {
+			t.Errorf("%#x decoded to %d encodes back to %#x", b, DecodeALawSample(b), got)
+		}
+	}
+}
+
+func TestULawRoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		b := byte(i)
+		// negative zero encodes back to positive zero
+		if b == 0x7f {
+			continue
+		}
+		if got := EncodeULawSample(DecodeULawSample(b)); got != b {
+			t.Errorf("%#x decoded to %d encodes back to %#x", b, DecodeULawSample(b), got)
+		}
+	}
+}
+
+func TestQuantizationError(t *testing.T) {
+	for _, sample := range []int16{-32768, -20000, -1000, -100, -1, 1, 100, 1000, 20000, 32767} {
+		// the quantization step grows with the magnitude, µ-law also clips
+		// above 32635
+		tolerance := abs(int(sample))/16 + 16
+
+		if got := DecodeALawSample(EncodeALawSample(sample)); abs(int(got)-int(sample)) > tolerance {
+			t.Errorf("A-law turned %d into %d", sample, got)
+		}
+		if got := DecodeULawSample(EncodeULawSample(sample)); abs(int(got)-int(sample)) > tolerance+ulawBias {
+			t.Errorf("µ-law turned %d into %d", sample, got)
+		}
+	}
+}
+
+func TestSlices(t *testing.T) {
+	pcm := []int16{0, 1000, -1000}
+
+	if got := DecodeALaw(EncodeALaw(pcm)); len(got) != len(pcm) || got[1] <= 0 || got[2] >= 0 {
+		t.Errorf("A-law turned %v into %v", pcm, got)
+	}
+	if got := DecodeULaw(EncodeULaw(pcm)); len(got) != len(pcm) || got[1] <= 0 || got[2] >= 0 {
+		t.Errorf("µ-law turned %v into %v", pcm, got)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
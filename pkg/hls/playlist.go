@@ -0,0 +1,81 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+// partListedSegments is how many of the latest segments have their parts
+// listed in low latency playlists.
+const partListedSegments = 3
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.5f", d.Seconds())
+}
+
+// playlist returns the media playlist of the stream, called with its lock
+// held.
+func (s *Server) playlist(st *stream) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("#EXTM3U\n")
+	if s.LowLatency {
+		b.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(st.targetDuration.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", st.segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", st.discontinuities)
+	if !st.cutSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+
+	if s.LowLatency {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%s\n", seconds(3*s.PartDuration))
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%s\n", seconds(s.PartDuration))
+	}
+
+	init := 0
+	for i, seg := range st.segments {
+		if !s.LowLatency && !seg.complete {
+			break
+		}
+
+		if seg.init != init {
+			if init != 0 {
+				b.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			init = seg.init
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init_%d.mp4\"\n", init)
+		}
+
+		if s.LowLatency && i >= len(st.segments)-partListedSegments {
+			for j, p := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%s,URI=\"part_%d_%d.m4s\"", seconds(p.duration), seg.msn, j)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%s,\n", seconds(seg.duration))
+			fmt.Fprintf(&b, "seg_%d.m4s\n", seg.msn)
+		}
+	}
+
+	if s.LowLatency {
+		last := st.segments[len(st.segments)-1]
+		if last.complete {
+			fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part_%d_0.m4s\"\n", last.msn+1)
+		} else {
+			fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part_%d_%d.m4s\"\n", last.msn, len(last.parts))
+		}
+	}
+
+	return b.Bytes()
+}
@@ -0,0 +1,273 @@
+// Package hls serves camera previews as HLS and low latency HLS with fMP4
+// segments, for browsers where WebRTC is not an option.
+package hls
+
+import (
+	"fmt"
+	"net/http"
+	"sbipc/pkg/hub"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentDuration = 2 * time.Second
+	DefaultPartDuration    = 500 * time.Millisecond
+	DefaultWindowSize      = 6
+	DefaultIdleTimeout     = 30 * time.Second
+
+	// startTimeout bounds how long a first request waits for a segment.
+	startTimeout = 15 * time.Second
+)
+
+// Server is an http.Handler serving /{camera}/index.m3u8 and its segments.
+// Streams are started by the first request and stopped when nobody fetched
+// them for IdleTimeout.
+type Server struct {
+	SegmentDuration time.Duration
+	PartDuration    time.Duration
+	// LowLatency enables partial segments and blocking playlist reloads.
+	LowLatency  bool
+	WindowSize  int
+	IdleTimeout time.Duration
+
+	hub     *hub.Hub
+	lock    *sync.Mutex
+	cameras map[string]hub.Camera
+	streams map[string]*stream
+}
+
+func New(h *hub.Hub) *Server {
+	return &Server{
+		SegmentDuration: DefaultSegmentDuration,
+		PartDuration:    DefaultPartDuration,
+		LowLatency:      true,
+		WindowSize:      DefaultWindowSize,
+		IdleTimeout:     DefaultIdleTimeout,
+		hub:             h,
+		lock:            &sync.Mutex{},
+		cameras:         map[string]hub.Camera{},
+		streams:         map[string]*stream{},
+	}
+}
+
+// AddCamera publishes a camera at /name/index.m3u8.
+func (s *Server) AddCamera(name string, camera hub.Camera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cameras[name] = camera
+}
+
+// stream returns the running stream of a camera, starting it if needed.
+func (s *Server) stream(name string) (*stream, error) {
+	s.lock.Lock()
+	camera, ok := s.cameras[name]
+	if !ok {
+		s.lock.Unlock()
+		return nil, nil
+	}
+
+	st, ok := s.streams[name]
+	if ok {
+		s.lock.Unlock()
+		st.touch()
+		return st, nil
+	}
+
+	st = newStream(s, name)
+	s.streams[name] = st
+	s.lock.Unlock()
+
+	if err := st.start(camera); err != nil {
+		st.fail(err)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (s *Server) removeStream(name string, st *stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.streams[name] == st {
+		delete(s.streams, name)
+	}
+}
+
+// Close stops every stream.
+func (s *Server) Close() {
+	s.lock.Lock()
+	streams := make([]*stream, 0, len(s.streams))
+	for _, st := range s.streams {
+		streams = append(streams, st)
+	}
+	s.lock.Unlock()
+
+	for _, st := range streams {
+		st.close()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, file, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+
+	st, err := s.stream(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to start stream: %s", err), http.StatusBadGateway)
+		return
+	}
+	if st == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch {
+	case file == "index.m3u8":
+		s.servePlaylist(w, r, st)
+	case strings.HasPrefix(file, "init_") && strings.HasSuffix(file, ".mp4"):
+		s.serveInit(w, st, strings.TrimSuffix(strings.TrimPrefix(file, "init_"), ".mp4"))
+	case strings.HasPrefix(file, "seg_") && strings.HasSuffix(file, ".m4s"):
+		s.serveSegment(w, st, strings.TrimSuffix(strings.TrimPrefix(file, "seg_"), ".m4s"))
+	case strings.HasPrefix(file, "part_") && strings.HasSuffix(file, ".m4s"):
+		s.servePart(w, st, strings.TrimSuffix(strings.TrimPrefix(file, "part_"), ".m4s"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, st *stream) {
+	playlist, status, err := s.waitPlaylist(r, st)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(playlist)
+}
+
+// waitPlaylist returns the playlist once the stream has a segment, and
+// once the part asked by a blocking reload is available.
+func (s *Server) waitPlaylist(r *http.Request, st *stream) ([]byte, int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if !st.wait(st.ready, startTimeout) {
+		if st.err != nil {
+			return nil, http.StatusBadGateway, fmt.Errorf("failed to start stream: %w", st.err)
+		}
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("stream is not ready")
+	}
+
+	query := r.URL.Query()
+	if s.LowLatency && query.Has("_HLS_msn") {
+		msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid _HLS_msn")
+		}
+		partIndex := -1
+		if query.Has("_HLS_part") {
+			if partIndex, err = strconv.Atoi(query.Get("_HLS_part")); err != nil {
+				return nil, http.StatusBadRequest, fmt.Errorf("invalid _HLS_part")
+			}
+		}
+
+		// requests too far in the future are rejected, as the spec asks
+		if msn > st.nextMsn+1 {
+			return nil, http.StatusBadRequest, fmt.Errorf("_HLS_msn is too far in the future")
+		}
+
+		st.wait(func() bool { return st.has(msn, partIndex) }, 3*st.targetDuration)
+	}
+
+	return s.playlist(st), http.StatusOK, nil
+}
+
+func (s *Server) serveInit(w http.ResponseWriter, st *stream, version string) {
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		http.Error(w, "invalid init", http.StatusNotFound)
+		return
+	}
+
+	st.lock.Lock()
+	init, ok := st.inits[v]
+	st.lock.Unlock()
+
+	if !ok {
+		http.Error(w, "init not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Write(init)
+}
+
+func (s *Server) serveSegment(w http.ResponseWriter, st *stream, name string) {
+	msn, err := strconv.Atoi(name)
+	if err != nil {
+		http.Error(w, "invalid segment", http.StatusNotFound)
+		return
+	}
+
+	st.lock.Lock()
+	var data []byte
+	if seg := st.segment(msn); seg != nil && seg.complete {
+		data = seg.data()
+	}
+	st.lock.Unlock()
+
+	if data == nil {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/iso.segment")
+	w.Write(data)
+}
+
+func (s *Server) servePart(w http.ResponseWriter, st *stream, name string) {
+	msnString, indexString, _ := strings.Cut(name, "_")
+	msn, err := strconv.Atoi(msnString)
+	if err != nil {
+		http.Error(w, "invalid part", http.StatusNotFound)
+		return
+	}
+	partIndex, err := strconv.Atoi(indexString)
+	if err != nil {
+		http.Error(w, "invalid part", http.StatusNotFound)
+		return
+	}
+
+	st.lock.Lock()
+	// the preload hint of the playlist points to the next part, which is
+	// served as soon as it exists
+	if msn <= st.nextMsn {
+		st.wait(func() bool { return st.has(msn, partIndex) }, 3*s.PartDuration+st.targetDuration)
+	}
+
+	var data []byte
+	if seg := st.segment(msn); seg != nil && partIndex >= 0 && partIndex < len(seg.parts) {
+		data = seg.parts[partIndex].data
+	}
+	st.lock.Unlock()
+
+	if data == nil {
+		http.Error(w, "part not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/iso.segment")
+	w.Write(data)
+}
@@ -0,0 +1,98 @@
+package hls
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, camera *tplinktest.Server, password string) *httptest.Server {
+	t.Helper()
+
+	h := hub.New()
+	t.Cleanup(h.Close)
+
+	s := New(h)
+	s.SegmentDuration = 500 * time.Millisecond
+	s.PartDuration = 100 * time.Millisecond
+	s.AddCamera("door", hub.Camera{Address: camera.Addr, Username: camera.Username, Password: password})
+	t.Cleanup(s.Close)
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestServePreview(t *testing.T) {
+	camera := tplinktest.NewUnstartedServer()
+	camera.FrameInterval = 10 * time.Millisecond
+	camera.Start()
+	defer camera.Close()
+
+	server := newTestServer(t, camera, camera.Password)
+
+	status, playlist := get(t, server.URL+"/door/index.m3u8")
+	if status != http.StatusOK {
+		t.Fatalf("got %d: %s", status, playlist)
+	}
+
+	segment := regexp.MustCompile(`seg_\d+\.m4s`).Find(playlist)
+	if segment == nil {
+		t.Fatalf("no segment in playlist:\n%s", playlist)
+	}
+	for _, file := range []string{"init_1.mp4", string(segment)} {
+		if status, body := get(t, server.URL+"/door/"+file); status != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s: got %d with %d bytes", file, status, len(body))
+		}
+	}
+
+	target := regexp.MustCompile(`#EXT-X-TARGETDURATION:\d+`)
+	first := target.Find(playlist)
+	time.Sleep(time.Second)
+	if _, playlist = get(t, server.URL+"/door/index.m3u8"); string(target.Find(playlist)) != string(first) {
+		t.Errorf("target duration changed from %s to %s", first, target.Find(playlist))
+	}
+
+	if status, _ := get(t, server.URL+"/garden/index.m3u8"); status != http.StatusNotFound {
+		t.Errorf("got %d for an unknown camera", status)
+	}
+	if status, _ := get(t, server.URL+"/door/seg_1000.m4s"); status != http.StatusNotFound {
+		t.Errorf("got %d for a missing segment", status)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	server := newTestServer(t, camera, "wrong")
+
+	start := time.Now()
+	if status, body := get(t, server.URL+"/door/index.m3u8"); status != http.StatusBadGateway {
+		t.Errorf("got %d: %s", status, body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("failing took %s", elapsed)
+	}
+}
@@ -0,0 +1,316 @@
+package hls
+
+import (
+	"bytes"
+	"log"
+	"sbipc/pkg/fmp4"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sync"
+	"time"
+)
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	// msn is the media sequence number of the segment.
+	msn      int
+	init     int
+	parts    []*part
+	duration time.Duration
+	complete bool
+}
+
+func (seg *segment) data() []byte {
+	var b bytes.Buffer
+	for _, p := range seg.parts {
+		b.Write(p.data)
+	}
+	return b.Bytes()
+}
+
+// stream muxes the preview of a camera into a sliding window of segments.
+type stream struct {
+	server *Server
+	name   string
+
+	lock         *sync.Mutex
+	subscription *hub.Subscription
+	muxer        *fmp4.Muxer
+	packets      chan *mtsp.Packet
+	done         chan struct{}
+	closeOnce    *sync.Once
+	lastAccess   time.Time
+	// err is why the stream failed to start
+	err error
+
+	inits       map[int][]byte
+	initVersion int
+	segments    []*segment
+	nextMsn     int
+	// discontinuities counts the discontinuities which left the window
+	discontinuities int
+	// targetDuration is set by the first segment, as clients must not see
+	// it change, and later segments are cut to fit it
+	targetDuration time.Duration
+	targetSet      bool
+	// cutSegments is set once a segment did not start on a key frame
+	cutSegments bool
+	// changed is closed and replaced whenever a part is added
+	changed chan struct{}
+}
+
+func newStream(server *Server, name string) *stream {
+	return &stream{
+		server:         server,
+		name:           name,
+		lock:           &sync.Mutex{},
+		packets:        make(chan *mtsp.Packet, 1024),
+		done:           make(chan struct{}),
+		closeOnce:      &sync.Once{},
+		lastAccess:     time.Now(),
+		inits:          map[int][]byte{},
+		targetDuration: server.SegmentDuration,
+		changed:        make(chan struct{}),
+	}
+}
+
+func (s *stream) start(camera hub.Camera) error {
+	sub, err := s.server.hub.Subscribe(camera, s.onPacket, s.close)
+	if err != nil {
+		return err
+	}
+
+	config := fmp4.ConfigFromPreview(sub.Params, true)
+	if s.server.LowLatency {
+		config.MaxFragmentDuration = s.server.PartDuration
+	}
+
+	s.lock.Lock()
+	s.subscription = sub
+	s.muxer = fmp4.NewMuxer(config)
+	s.lock.Unlock()
+
+	go s.work()
+
+	return nil
+}
+
+// fail closes a stream which failed to start, waking its waiters up.
+func (s *stream) fail(err error) {
+	s.lock.Lock()
+	s.err = err
+	s.lock.Unlock()
+
+	s.close()
+}
+
+func (s *stream) close() {
+	s.closeOnce.Do(func() {
+		s.lock.Lock()
+		sub := s.subscription
+		s.subscription = nil
+		s.lock.Unlock()
+
+		if sub != nil {
+			sub.Close()
+		}
+
+		close(s.done)
+		s.server.removeStream(s.name, s)
+	})
+}
+
+func (s *stream) touch() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastAccess = time.Now()
+}
+
+func (s *stream) onPacket(p *mtsp.Packet) {
+	body := make([]byte, len(p.Body))
+	copy(body, p.Body)
+
+	select {
+	case s.packets <- &mtsp.Packet{IsInterleaved: true, Channel: p.Channel, Body: body}:
+	default:
+		hub.DroppedPackets.Inc("hls")
+	}
+}
+
+func (s *stream) work() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			idle := time.Since(s.lastAccess)
+			s.lock.Unlock()
+
+			if idle > s.server.IdleTimeout {
+				log.Printf("hls %s: no viewer left, stopping", s.name)
+				s.close()
+				return
+			}
+		case p := <-s.packets:
+			fragment, err := s.muxer.WritePacket(p.Channel, p.Body)
+			if err != nil {
+				log.Printf("hls %s: %s", s.name, err)
+				continue
+			}
+			if fragment != nil {
+				s.addFragment(fragment)
+			}
+		}
+	}
+}
+
+func (s *stream) addFragment(fragment *fmp4.Fragment) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var current *segment
+	if len(s.segments) > 0 && !s.segments[len(s.segments)-1].complete {
+		current = s.segments[len(s.segments)-1]
+	}
+
+	if s.initVersion == 0 || !bytes.Equal(fragment.Init, s.inits[s.initVersion]) {
+		if !fragment.Independent {
+			return
+		}
+		s.initVersion++
+		s.inits[s.initVersion] = fragment.Init
+	}
+
+	// segments start on key frames, once the previous one is long enough or
+	// the initialization segment changed. Segments reaching the target
+	// duration are cut anyway, for key frames too far apart.
+	cut := false
+	if current != nil {
+		switch {
+		case fragment.Independent && (current.duration >= s.server.SegmentDuration || current.init != s.initVersion):
+			s.completeSegment(current)
+			current = nil
+		case s.targetSet && current.duration+fragment.Duration > s.targetDuration:
+			s.completeSegment(current)
+			current = nil
+			cut = true
+			s.cutSegments = true
+		}
+	}
+
+	if current == nil {
+		if !fragment.Independent && !cut {
+			return
+		}
+		current = &segment{msn: s.nextMsn, init: s.initVersion}
+		s.nextMsn++
+		s.segments = append(s.segments, current)
+	}
+
+	current.parts = append(current.parts, &part{
+		data:        fragment.Data,
+		duration:    fragment.Duration,
+		independent: fragment.Independent,
+	})
+	current.duration += fragment.Duration
+
+	// keep the window, plus the segment being written
+	if evicted := len(s.segments) - s.server.WindowSize - 1; evicted > 0 {
+		for i := 1; i <= evicted; i++ {
+			if s.segments[i].init != s.segments[i-1].init {
+				s.discontinuities++
+			}
+		}
+		s.segments = s.segments[evicted:]
+	}
+	for version := range s.inits {
+		if version < s.segments[0].init {
+			delete(s.inits, version)
+		}
+	}
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// completeSegment completes the segment being written, the first one
+// setting the target duration.
+func (s *stream) completeSegment(seg *segment) {
+	seg.complete = true
+
+	if !s.targetSet {
+		s.targetDuration = max(s.server.SegmentDuration, seg.duration)
+		// whole seconds, as in the playlist
+		s.targetDuration = (s.targetDuration + time.Second - 1).Truncate(time.Second)
+		s.targetSet = true
+	}
+}
+
+// segment returns a segment by its media sequence number.
+func (s *stream) segment(msn int) *segment {
+	for _, seg := range s.segments {
+		if seg.msn == msn {
+			return seg
+		}
+	}
+	return nil
+}
+
+// has reports whether the part of segment msn is available, a negative
+// part meaning the whole segment.
+func (s *stream) has(msn, partIndex int) bool {
+	seg := s.segment(msn)
+	if seg == nil {
+		return len(s.segments) > 0 && msn < s.segments[0].msn
+	}
+	if partIndex < 0 {
+		return seg.complete
+	}
+	return partIndex < len(seg.parts) || seg.complete
+}
+
+// wait blocks until cond holds, called with the lock held, or until the
+// timeout expires.
+func (s *stream) wait(cond func() bool, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for !cond() {
+		changed := s.changed
+		s.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			s.lock.Lock()
+			return cond()
+		case <-s.done:
+			s.lock.Lock()
+			return false
+		}
+
+		s.lock.Lock()
+	}
+
+	return true
+}
+
+// ready reports whether a first segment is complete.
+func (s *stream) ready() bool {
+	for _, seg := range s.segments {
+		if seg.complete {
+			return true
+		}
+	}
+	return false
+}
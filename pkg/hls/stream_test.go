@@ -0,0 +1,136 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"sbipc/pkg/fmp4"
+	"sbipc/pkg/tplink/tplinktest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fragment(duration time.Duration, independent bool) *fmp4.Fragment {
+	return &fmp4.Fragment{
+		Data:        []byte("fragment"),
+		Init:        []byte("init"),
+		Duration:    duration,
+		Independent: independent,
+	}
+}
+
+// newTestStream returns a stream fed by hand with addFragment.
+func newTestStream(s *Server) *stream {
+	st := newStream(s, "door")
+	st.muxer = fmp4.NewMuxer(fmp4.ConfigFromPreview(tplinktest.DefaultPreviewParams(), true))
+	return st
+}
+
+func TestSegmentsStartOnKeyFrames(t *testing.T) {
+	s := New(nil)
+	st := newTestStream(s)
+
+	// not playable without a key frame
+	st.addFragment(fragment(time.Second, false))
+	if len(st.segments) != 0 {
+		t.Fatal("segment started without a key frame")
+	}
+
+	for i := 0; i < 3; i++ {
+		st.addFragment(fragment(time.Second, true))
+		st.addFragment(fragment(time.Second, false))
+	}
+
+	if len(st.segments) != 3 || !st.segments[0].complete || !st.segments[1].complete || st.segments[2].complete {
+		t.Fatalf("got %d segments, want 2 complete and 1 written", len(st.segments))
+	}
+	if !st.ready() {
+		t.Error("stream not ready")
+	}
+	if st.targetDuration != 2*time.Second {
+		t.Errorf("got target duration %s, want 2s", st.targetDuration)
+	}
+
+	playlist := string(s.playlist(st))
+	for _, line := range []string{"#EXT-X-TARGETDURATION:2", "#EXT-X-INDEPENDENT-SEGMENTS", "#EXT-X-MAP:URI=\"init_1.mp4\"", "seg_1.m4s", "part_2_1.m4s"} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("no %s in playlist:\n%s", line, playlist)
+		}
+	}
+}
+
+func TestTargetDurationIsStable(t *testing.T) {
+	s := New(nil)
+	s.SegmentDuration = time.Second
+	st := newTestStream(s)
+
+	// a first segment of 2.5s sets the target to 3s
+	st.addFragment(fragment(2500*time.Millisecond, true))
+	st.addFragment(fragment(time.Second, true))
+	if st.targetDuration != 3*time.Second {
+		t.Fatalf("got target duration %s, want 3s", st.targetDuration)
+	}
+
+	// key frames 5s apart are cut to the target
+	for i := 0; i < 10; i++ {
+		st.addFragment(fragment(500*time.Millisecond, false))
+	}
+	st.addFragment(fragment(time.Second, true))
+
+	if st.targetDuration != 3*time.Second {
+		t.Errorf("target duration changed to %s", st.targetDuration)
+	}
+	for _, seg := range st.segments {
+		if seg.duration > st.targetDuration {
+			t.Errorf("segment %d lasts %s", seg.msn, seg.duration)
+		}
+	}
+	if !st.cutSegments {
+		t.Error("segments not cut")
+	}
+	if playlist := s.playlist(st); bytes.Contains(playlist, []byte("INDEPENDENT-SEGMENTS")) {
+		t.Errorf("cut segments listed as independent:\n%s", playlist)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	s := New(nil)
+	s.WindowSize = 2
+	st := newTestStream(s)
+
+	for i := 0; i < 10; i++ {
+		st.addFragment(fragment(2*time.Second, true))
+	}
+
+	if len(st.segments) != 3 || st.segments[0].msn != 7 {
+		t.Errorf("got %d segments from %d, want 3 from 7", len(st.segments), st.segments[0].msn)
+	}
+	if !st.has(2, -1) {
+		t.Error("segments out of the window are not reported as gone")
+	}
+	if st.has(9, 1) {
+		t.Error("has a part not written yet")
+	}
+}
+
+func TestDiscontinuitySequence(t *testing.T) {
+	s := New(nil)
+	s.WindowSize = 2
+	st := newTestStream(s)
+
+	// the initialization segment changes on every other segment
+	for i := 0; i < 8; i++ {
+		f := fragment(2*time.Second, true)
+		f.Init = []byte(fmt.Sprintf("init %d", i/2))
+		st.addFragment(f)
+	}
+
+	// segments 0 to 4 left the window, taking the discontinuities before
+	// segments 2 and 4
+	playlist := string(s.playlist(st))
+	for _, line := range []string{"#EXT-X-MEDIA-SEQUENCE:5", "#EXT-X-DISCONTINUITY-SEQUENCE:2", "#EXT-X-DISCONTINUITY\n"} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("no %q in playlist:\n%s", line, playlist)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package hub
+
+import (
+	"fmt"
+	"net/url"
+	"sbipc/pkg/tplink"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CameraFlags collects -camera name=username:password@host:port flags. The
+// stream is chosen with an optional ?resolution=VGA&channel=1&audio=false.
+type CameraFlags map[string]Camera
+
+func (c CameraFlags) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (c CameraFlags) Set(value string) error {
+	name, rest, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=username:password@host:port")
+	}
+
+	u, err := url.Parse("tcp://" + rest)
+	if err != nil {
+		return err
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = u.Host + ":554"
+	}
+	password, _ := u.User.Password()
+
+	camera := Camera{
+		Address:  address,
+		Username: u.User.Username(),
+		Password: password,
+	}
+
+	query := u.Query()
+	if v := query.Get("resolution"); v != "" {
+		camera.Resolution = tplink.Resolution(strings.ToUpper(v))
+	}
+	if v := query.Get("channel"); v != "" {
+		if camera.Channel, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid channel: %w", err)
+		}
+	}
+	if v := query.Get("audio"); v != "" {
+		audio, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid audio: %w", err)
+		}
+		camera.NoAudio = !audio
+	}
+
+	c[name] = camera
+	return nil
+}
@@ -0,0 +1,30 @@
+package hub
+
+import (
+	"sbipc/pkg/tplink"
+	"testing"
+)
+
+func TestCameraFlags(t *testing.T) {
+	flags := CameraFlags{}
+	if err := flags.Set("front=admin:secret@10.0.0.2:554"); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Set("back=admin:secret@10.0.0.3:554?resolution=vga&channel=1&audio=false"); err != nil {
+		t.Fatal(err)
+	}
+
+	if front := flags["front"]; front != (Camera{Address: "10.0.0.2:554", Username: "admin", Password: "secret"}) {
+		t.Errorf("got front %+v", front)
+	}
+	back := flags["back"]
+	if back.Address != "10.0.0.3:554" || back.Resolution != tplink.ResolutionVGA || back.Channel != 1 || !back.NoAudio {
+		t.Errorf("got back %+v", back)
+	}
+
+	for _, value := range []string{"side=admin:secret@10.0.0.4:554?channel=one", "side=admin:secret@10.0.0.4:554?audio=maybe"} {
+		if err := flags.Set(value); err == nil {
+			t.Errorf("%s accepted", value)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+// Package hub shares a single upstream preview per camera between every
+// viewer, since cameras only allow a few concurrent sessions.
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink"
+	"sync"
+	"time"
+)
+
+// requestTimeout bounds dialing the camera and each request sent to it.
+const requestTimeout = 10 * time.Second
+
+// readTimeout is how long the camera may stay silent before the upstream
+// is considered dead.
+const readTimeout = 10 * time.Second
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// DefaultGracePeriod is how long a preview is kept after its last
+// subscriber leaves, so a reconnecting viewer does not restart it.
+const DefaultGracePeriod = 10 * time.Second
+
+// Camera is a camera stream, cameras streaming several profiles are a
+// Camera each.
+type Camera struct {
+	Address  string
+	Username string
+	Password string
+
+	// Channel is the lens of multi lens cameras.
+	Channel int
+	// Resolution picks the main stream, or a sub stream, defaults to HD.
+	Resolution tplink.Resolution
+	// NoAudio streams the video only. The upstream is shared with the
+	// subscribers of the camera audio, and the audio dropped by the hub.
+	NoAudio bool
+}
+
+// upstream returns the camera whose preview is streamed for c, with audio
+// whether or not c wants it.
+func (c Camera) upstream() Camera {
+	c.NoAudio = false
+	return c
+}
+
+// PreviewOptions returns the preview options of the camera stream.
+func (c Camera) PreviewOptions() *tplink.PreviewOptions {
+	return &tplink.PreviewOptions{
+		Channels:   []int{c.Channel},
+		Resolution: c.Resolution,
+		NoAudio:    c.NoAudio,
+	}
+}
+
+type Hub struct {
+	GracePeriod time.Duration
+
+	lock    *sync.Mutex
+	streams map[Camera]*Stream
+	// stopping tracks the upstreams being stopped in the background
+	stopping *sync.WaitGroup
+}
+
+func New() *Hub {
+	return &Hub{
+		GracePeriod: DefaultGracePeriod,
+		lock:        &sync.Mutex{},
+		streams:     map[Camera]*Stream{},
+		stopping:    &sync.WaitGroup{},
+	}
+}
+
+// Stream returns the stream of a camera, creating it if needed. Cameras
+// differing by NoAudio only share their stream.
+func (h *Hub) Stream(camera Camera) *Stream {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	camera = camera.upstream()
+
+	s, ok := h.streams[camera]
+	if !ok {
+		s = &Stream{
+			hub:         h,
+			camera:      camera,
+			lock:        &sync.Mutex{},
+			subscribers: map[*Subscription]struct{}{},
+		}
+		h.streams[camera] = s
+	}
+
+	return s
+}
+
+// Close stops every stream and drops their subscribers, waiting for the
+// cameras to be told.
+func (h *Hub) Close() {
+	h.lock.Lock()
+	streams := make([]*Stream, 0, len(h.streams))
+	for _, s := range h.streams {
+		streams = append(streams, s)
+	}
+	h.lock.Unlock()
+
+	for _, s := range streams {
+		s.close()
+	}
+
+	h.stopping.Wait()
+}
+
+// remove forgets a stream which has no subscribers anymore.
+func (h *Hub) remove(s *Stream) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.streams[s.camera] == s {
+		delete(h.streams, s.camera)
+	}
+}
+
+// Subscribe is a shortcut of Stream(camera).Subscribe, which drops the
+// audio of NoAudio cameras.
+func (h *Hub) Subscribe(camera Camera, onPacket func(p *mtsp.Packet), onClose func()) (*Subscription, error) {
+	if camera.NoAudio {
+		onVideo := onPacket
+		onPacket = func(p *mtsp.Packet) {
+			if p.Channel != 1 {
+				onVideo(p)
+			}
+		}
+	}
+	return h.Stream(camera).Subscribe(onPacket, onClose)
+}
+
+// Stream is the preview of a single camera. It is started by the first
+// subscriber and stopped a grace period after the last one leaves. While it
+// has subscribers, a failed upstream is reconnected with exponential
+// backoff, transparently to them.
+type Stream struct {
+	hub         *Hub
+	camera      Camera
+	lock        *sync.Mutex
+	conn        *tplink.Conn
+	params      *tplink.PreviewParams
+	sessionId   string
+	subscribers map[*Subscription]struct{}
+	sequencers  map[int]*Sequencer
+	stopTimer   *time.Timer
+	// stopped is closed when the running upstream is stopped, it is nil
+	// while no upstream is running
+	stopped chan struct{}
+	// removed is set once the stream left the hub, subscribers then go
+	// to a new stream of the camera
+	removed bool
+}
+
+type Subscription struct {
+	// Params are the parameters the camera answered the preview with.
+	Params *tplink.PreviewParams
+
+	stream   *Stream
+	onPacket func(p *mtsp.Packet)
+	onClose  func()
+}
+
+// Close unsubscribes from the stream.
+func (sub *Subscription) Close() {
+	sub.stream.unsubscribe(sub)
+}
+
+// Subscribe starts receiving the interleaved packets of the camera, starting
+// the preview if needed. onPacket must not block nor modify the packet, as
+// it is shared with other subscribers. onClose is called if the subscription
+// is dropped because the hub was closed.
+func (s *Stream) Subscribe(onPacket func(p *mtsp.Packet), onClose func()) (*Subscription, error) {
+	s.lock.Lock()
+	if s.removed {
+		s.lock.Unlock()
+		return s.hub.Subscribe(s.camera, onPacket, onClose)
+	}
+	defer s.lock.Unlock()
+
+	if s.stopTimer != nil {
+		s.stopTimer.Stop()
+		s.stopTimer = nil
+	}
+
+	if s.stopped == nil {
+		if err := s.start(); err != nil {
+			if len(s.subscribers) == 0 {
+				s.remove()
+			}
+			return nil, err
+		}
+	}
+
+	sub := &Subscription{
+		Params:   s.params,
+		stream:   s,
+		onPacket: onPacket,
+		onClose:  onClose,
+	}
+	s.subscribers[sub] = struct{}{}
+	subscribers.Inc(s.camera.Address)
+
+	return sub, nil
+}
+
+// Subscribers returns the number of current subscribers.
+func (s *Stream) Subscribers() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.subscribers)
+}
+
+func (s *Stream) unsubscribe(sub *Subscription) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.subscribers[sub]; !ok {
+		return
+	}
+	delete(s.subscribers, sub)
+	subscribers.Dec(s.camera.Address)
+
+	if len(s.subscribers) > 0 || s.stopped == nil {
+		return
+	}
+
+	if s.hub.GracePeriod <= 0 {
+		s.stop()
+		return
+	}
+
+	stopped := s.stopped
+	s.stopTimer = time.AfterFunc(s.hub.GracePeriod, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if s.stopped == stopped && len(s.subscribers) == 0 {
+			s.stopTimer = nil
+			s.stop()
+		}
+	})
+}
+
+func (s *Stream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopTimer != nil {
+		s.stopTimer.Stop()
+		s.stopTimer = nil
+	}
+
+	for sub := range s.subscribers {
+		delete(s.subscribers, sub)
+		subscribers.Dec(s.camera.Address)
+		if sub.onClose != nil {
+			go sub.onClose()
+		}
+	}
+
+	if s.stopped != nil {
+		s.stop()
+	} else {
+		s.remove()
+	}
+}
+
+// remove takes the stream out of the hub, with the lock held.
+func (s *Stream) remove() {
+	s.removed = true
+	s.hub.remove(s)
+}
+
+// connect dials the camera and starts a preview.
+func (s *Stream) connect() (*tplink.Conn, *tplink.PreviewParams, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	c, err := tplink.DialContext(ctx, s.camera.Address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if err := c.HandshakeContext(ctx, s.camera.Username, s.camera.Password); err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	params, err := c.StartPreviewWithOptionsContext(ctx, s.camera.PreviewOptions())
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("start preview: %w", err)
+	}
+
+	return c, params, nil
+}
+
+func (s *Stream) start() error {
+	c, params, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("started preview of %s", s.camera.Address)
+
+	s.conn = c
+	s.params = params
+	s.sessionId = params.SessionID
+	s.stopped = make(chan struct{})
+	s.sequencers = map[int]*Sequencer{
+		0: NewSequencer(90000),
+		1: NewSequencer(params.AudioClockRate()),
+	}
+
+	go s.supervise(c, s.stopped)
+
+	return nil
+}
+
+// stop stops the upstream, with the lock held. The camera is told in the
+// background, as pump needs the lock to read on until the answer comes.
+func (s *Stream) stop() {
+	log.Printf("stop preview of %s", s.camera.Address)
+
+	close(s.stopped)
+	s.stopped = nil
+
+	if s.conn != nil {
+		c, sessionId := s.conn, s.sessionId
+		s.conn = nil
+
+		s.hub.stopping.Add(1)
+		go func() {
+			defer s.hub.stopping.Done()
+			stopUpstream(c, sessionId)
+		}()
+	}
+
+	if len(s.subscribers) == 0 {
+		s.remove()
+	}
+}
+
+// stopUpstream stops the preview of a connection and closes it.
+func stopUpstream(c *tplink.Conn, sessionId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	c.StopPreviewContext(ctx, sessionId)
+	c.Close()
+}
+
+// supervise pumps packets from the upstream, and reconnects it whenever it
+// fails until the stream is stopped.
+func (s *Stream) supervise(c *tplink.Conn, stopped chan struct{}) {
+	for {
+		err := s.pump(c)
+
+		select {
+		case <-stopped:
+			return
+		default:
+		}
+
+		log.Printf("upstream of %s failed: %s", s.camera.Address, err)
+		upstreamFailures.Inc(s.camera.Address)
+		c.Close()
+
+		s.lock.Lock()
+		if s.conn == c {
+			s.conn = nil
+		}
+		for _, q := range s.sequencers {
+			q.Reset()
+		}
+		s.lock.Unlock()
+
+		if c = s.reconnect(stopped); c == nil {
+			return
+		}
+	}
+}
+
+// reconnect dials the camera again with exponential backoff, until it
+// succeeds or the stream is stopped.
+func (s *Stream) reconnect(stopped chan struct{}) *tplink.Conn {
+	backoff := minBackoff
+	for {
+		select {
+		case <-stopped:
+			return nil
+		case <-time.After(backoff):
+		}
+
+		c, params, err := s.connect()
+		if err != nil {
+			log.Printf("reconnect to %s failed: %s", s.camera.Address, err)
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+
+		s.lock.Lock()
+		select {
+		case <-stopped:
+			s.lock.Unlock()
+			stopUpstream(c, params.SessionID)
+			return nil
+		default:
+		}
+
+		log.Printf("reconnected to %s", s.camera.Address)
+		reconnects.Inc(s.camera.Address)
+		s.conn = c
+		s.sessionId = params.SessionID
+		s.lock.Unlock()
+
+		return c
+	}
+}
+
+// pump forwards packets from the camera to every subscriber, until reading
+// fails or the camera stays silent for too long.
+func (s *Stream) pump(c *tplink.Conn) error {
+	counters := map[int]*channelCounters{}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+		p, err := c.ReadContext(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		if !p.IsInterleaved {
+			continue
+		}
+
+		cc, ok := counters[p.Channel]
+		if !ok {
+			cc = newChannelCounters(s.camera.Address, p.Channel)
+			counters[p.Channel] = cc
+		}
+		cc.packets.Inc()
+		cc.bytes.Add(int64(len(p.Body)))
+
+		s.lock.Lock()
+		if q, ok := s.sequencers[p.Channel]; ok {
+			q.Rewrite(p.Body)
+		}
+		for sub := range s.subscribers {
+			sub.onPacket(p)
+		}
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,252 @@
+package hub
+
+import (
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink/tplinktest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testCamera(server *tplinktest.Server) Camera {
+	return Camera{
+		Address:  server.Addr,
+		Username: server.Username,
+		Password: server.Password,
+	}
+}
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Stream) running() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.stopped != nil
+}
+
+func (h *Hub) streamCount() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.streams)
+}
+
+func TestSubscribersShareUpstream(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := New()
+	defer h.Close()
+
+	var first, second atomic.Int64
+	sub1, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) { first.Add(1) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub1.Close()
+	sub2, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) { second.Add(1) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub2.Close()
+
+	if sub1.Params == nil || sub1.Params != sub2.Params {
+		t.Errorf("subscribers got params %p and %p, want the same", sub1.Params, sub2.Params)
+	}
+	if n := server.Previews(); n != 1 {
+		t.Errorf("%d previews started, want 1", n)
+	}
+	if n := h.Stream(testCamera(server)).Subscribers(); n != 2 {
+		t.Errorf("%d subscribers, want 2", n)
+	}
+
+	waitFor(t, "packets", func() bool { return first.Load() > 0 && second.Load() > 0 })
+}
+
+func TestNoAudioSharesUpstream(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := New()
+	defer h.Close()
+
+	var audio, video, videoOnly atomic.Int64
+	sub1, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) {
+		if p.Channel == 1 {
+			audio.Add(1)
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub1.Close()
+
+	camera := testCamera(server)
+	camera.NoAudio = true
+	sub2, err := h.Subscribe(camera, func(p *mtsp.Packet) {
+		if p.Channel == 1 {
+			videoOnly.Add(1)
+		} else {
+			video.Add(1)
+		}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub2.Close()
+
+	if n := server.Previews(); n != 1 {
+		t.Errorf("%d previews started, want 1", n)
+	}
+	waitFor(t, "packets", func() bool { return audio.Load() > 0 && video.Load() > 0 })
+	if n := videoOnly.Load(); n != 0 {
+		t.Errorf("%d audio packets sent without audio", n)
+	}
+}
+
+func TestGracePeriodKeepsUpstream(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := New()
+	h.GracePeriod = 100 * time.Millisecond
+	defer h.Close()
+
+	sub, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+
+	// back within the grace period
+	sub, err = h.Subscribe(testCamera(server), func(p *mtsp.Packet) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Previews(); n != 1 {
+		t.Errorf("%d previews started within the grace period, want 1", n)
+	}
+	stream := h.Stream(testCamera(server))
+	sub.Close()
+
+	waitFor(t, "the stream to stop", func() bool { return !stream.running() })
+	if n := h.streamCount(); n != 0 {
+		t.Errorf("%d streams kept once stopped", n)
+	}
+
+	sub, err = h.Subscribe(testCamera(server), func(p *mtsp.Packet) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if n := server.Previews(); n != 2 {
+		t.Errorf("%d previews started after the grace period, want 2", n)
+	}
+}
+
+func TestUnsubscribeDoesNotWaitForCamera(t *testing.T) {
+	server := tplinktest.NewUnstartedServer()
+	// enough frames to fill the buffers while the stream is stopped
+	server.FrameInterval = time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	h := New()
+	h.GracePeriod = 0
+	defer h.Close()
+
+	sub, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) {
+		time.Sleep(time.Millisecond)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	sub.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unsubscribing took %s", elapsed)
+	}
+	if n := h.streamCount(); n != 0 {
+		t.Errorf("%d streams left, want 0", n)
+	}
+}
+
+func TestStartFailureForgetsStream(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := New()
+	defer h.Close()
+
+	camera := testCamera(server)
+	camera.Password = "wrong"
+	if _, err := h.Subscribe(camera, func(p *mtsp.Packet) {}, nil); err == nil {
+		t.Fatal("subscribed with a wrong password")
+	}
+	if n := h.streamCount(); n != 0 {
+		t.Errorf("%d streams kept after failing to start", n)
+	}
+}
+
+func TestCloseDropsSubscribers(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := New()
+
+	closed := make(chan struct{})
+	if _, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) {}, func() { close(closed) }); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("onClose not called")
+	}
+}
+
+func TestUpstreamReconnects(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := New()
+	defer h.Close()
+
+	var packets atomic.Int64
+	sub, err := h.Subscribe(testCamera(server), func(p *mtsp.Packet) { packets.Add(1) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	waitFor(t, "packets", func() bool { return packets.Load() > 0 })
+	server.CloseClientConnections()
+
+	deadline := time.Now().Add(minBackoff + 2*time.Second)
+	for server.Previews() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	received := packets.Load()
+	waitFor(t, "packets after reconnecting", func() bool { return packets.Load() > received })
+}
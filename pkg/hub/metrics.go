@@ -0,0 +1,32 @@
+package hub
+
+import (
+	"sbipc/pkg/metrics"
+	"strconv"
+)
+
+var (
+	subscribers      = metrics.NewGauge("sbipc_preview_subscribers", "Viewers and recorders subscribed to camera previews.", "camera")
+	rtpPackets       = metrics.NewCounter("sbipc_rtp_packets_total", "RTP packets received from cameras.", "camera", "channel")
+	rtpBytes         = metrics.NewCounter("sbipc_rtp_bytes_total", "RTP bytes received from cameras.", "camera", "channel")
+	upstreamFailures = metrics.NewCounter("sbipc_upstream_failures_total", "Previews which failed or stayed silent.", "camera")
+	reconnects       = metrics.NewCounter("sbipc_camera_reconnects_total", "Previews reconnected after a failure.", "camera")
+)
+
+// DroppedPackets counts the packets subscribers too slow to keep up
+// dropped, by kind of subscriber.
+var DroppedPackets = metrics.NewCounter("sbipc_dropped_packets_total", "Packets dropped by subscribers too slow to keep up.", "subscriber")
+
+// channelCounters are the RTP counters of an interleaved channel.
+type channelCounters struct {
+	packets metrics.Value
+	bytes   metrics.Value
+}
+
+func newChannelCounters(camera string, channel int) *channelCounters {
+	c := strconv.Itoa(channel)
+	return &channelCounters{
+		packets: rtpPackets.With(camera, c),
+		bytes:   rtpBytes.With(camera, c),
+	}
+}
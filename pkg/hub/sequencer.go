@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Sequencer rewrites the RTP sequence numbers, timestamps and SSRC of a
+// channel, so they continue seamlessly when the upstream is reconnected and
+// the camera starts over with new ones.
+type Sequencer struct {
+	clockRate uint32
+	started   bool
+	resync    bool
+	ssrc      uint32
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+	lastTime  time.Time
+}
+
+func NewSequencer(clockRate int) *Sequencer {
+	return &Sequencer{
+		clockRate: uint32(clockRate),
+	}
+}
+
+// Reset makes the next packet continue right after the last one, with its
+// timestamp advanced by the wall clock time elapsed in between.
+func (q *Sequencer) Reset() {
+	q.resync = true
+}
+
+// Rewrite rewrites an RTP packet in place.
+func (q *Sequencer) Rewrite(packet []byte) {
+	if len(packet) < 12 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint16(packet[2:])
+	ts := binary.BigEndian.Uint32(packet[4:])
+	now := time.Now()
+
+	if !q.started {
+		q.ssrc = binary.BigEndian.Uint32(packet[8:])
+		q.started = true
+	} else if q.resync {
+		elapsed := uint32(now.Sub(q.lastTime).Seconds() * float64(q.clockRate))
+		if elapsed == 0 {
+			elapsed = 1
+		}
+
+		q.seqOffset = q.lastSeq + 1 - seq
+		q.tsOffset = q.lastTs + elapsed - ts
+	}
+	q.resync = false
+
+	q.lastSeq = seq + q.seqOffset
+	q.lastTs = ts + q.tsOffset
+	q.lastTime = now
+
+	binary.BigEndian.PutUint16(packet[2:], q.lastSeq)
+	binary.BigEndian.PutUint32(packet[4:], q.lastTs)
+	binary.BigEndian.PutUint32(packet[8:], q.ssrc)
+}
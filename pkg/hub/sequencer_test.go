@@ -0,0 +1,74 @@
+package hub
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func rtpPacket(seq uint16, ts, ssrc uint32) []byte {
+	packet := make([]byte, 12)
+	packet[0] = 0x80
+	binary.BigEndian.PutUint16(packet[2:], seq)
+	binary.BigEndian.PutUint32(packet[4:], ts)
+	binary.BigEndian.PutUint32(packet[8:], ssrc)
+	return packet
+}
+
+func rtpHeader(packet []byte) (uint16, uint32, uint32) {
+	return binary.BigEndian.Uint16(packet[2:]), binary.BigEndian.Uint32(packet[4:]), binary.BigEndian.Uint32(packet[8:])
+}
+
+func TestSequencerPassesThroughFirstUpstream(t *testing.T) {
+	q := NewSequencer(90000)
+
+	for i := 0; i < 3; i++ {
+		packet := rtpPacket(100+uint16(i), 1000+uint32(i)*3000, 0xaabbccdd)
+		q.Rewrite(packet)
+
+		seq, ts, ssrc := rtpHeader(packet)
+		if seq != 100+uint16(i) || ts != 1000+uint32(i)*3000 || ssrc != 0xaabbccdd {
+			t.Fatalf("packet %d rewritten to seq %d ts %d ssrc %x", i, seq, ts, ssrc)
+		}
+	}
+}
+
+func TestSequencerContinuesAfterReset(t *testing.T) {
+	q := NewSequencer(90000)
+
+	q.Rewrite(rtpPacket(65535, 4294967000, 1))
+	q.Reset()
+	time.Sleep(20 * time.Millisecond)
+
+	// the new upstream starts over with other numbers and SSRC
+	packet := rtpPacket(7, 500, 2)
+	q.Rewrite(packet)
+
+	seq, ts, ssrc := rtpHeader(packet)
+	if seq != 0 {
+		t.Errorf("seq = %d, want 0 after 65535", seq)
+	}
+	if ssrc != 1 {
+		t.Errorf("ssrc = %d, want the first one", ssrc)
+	}
+	// 20 ms at 90 kHz is 1800, wrapping around
+	if elapsed := ts - 4294967000; elapsed < 1800 || elapsed > 90000 {
+		t.Errorf("timestamp advanced by %d, want the elapsed time", elapsed)
+	}
+
+	next := rtpPacket(8, 3500, 2)
+	q.Rewrite(next)
+	if nextSeq, nextTs, _ := rtpHeader(next); nextSeq != 1 || nextTs != ts+3000 {
+		t.Errorf("next packet rewritten to seq %d ts %d, want 1 and %d", nextSeq, nextTs, ts+3000)
+	}
+}
+
+func TestSequencerIgnoresShortPackets(t *testing.T) {
+	q := NewSequencer(8000)
+
+	packet := []byte{0x80, 0x08, 0x00}
+	q.Rewrite(packet)
+	if packet[2] != 0 {
+		t.Errorf("short packet modified: %v", packet)
+	}
+}
@@ -0,0 +1,207 @@
+// Package metrics keeps the counters and gauges of the process, served in
+// the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type kind string
+
+const (
+	kindCounter kind = "counter"
+	kindGauge   kind = "gauge"
+)
+
+// Value is the value of a metric for a set of label values, held by hot
+// paths to skip looking it up.
+type Value struct {
+	v *atomic.Int64
+}
+
+func (v Value) Add(delta int64) { v.v.Add(delta) }
+func (v Value) Inc()            { v.v.Add(1) }
+
+// metric is a metric with its values by label values.
+type metric struct {
+	name   string
+	help   string
+	kind   kind
+	labels []string
+
+	lock   *sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  *atomic.Int64
+}
+
+var (
+	lock    = &sync.Mutex{}
+	metrics = map[string]*metric{}
+)
+
+func register(name, help string, k kind, labels []string) *metric {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+
+	m := &metric{
+		name:   name,
+		help:   help,
+		kind:   k,
+		labels: labels,
+		lock:   &sync.Mutex{},
+		values: map[string]*series{},
+	}
+	metrics[name] = m
+	return m
+}
+
+func (m *metric) with(values []string) *atomic.Int64 {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.values[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...), value: &atomic.Int64{}}
+		m.values[key] = s
+	}
+	return s.value
+}
+
+// Counter is a metric which only goes up.
+type Counter struct {
+	m *metric
+}
+
+// NewCounter registers a counter, its name should end in _total.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, kindCounter, labels)}
+}
+
+// With returns the value of label values, in the order of the labels.
+func (c *Counter) With(values ...string) Value {
+	return Value{c.m.with(values)}
+}
+
+func (c *Counter) Add(delta int64, values ...string) {
+	c.m.with(values).Add(delta)
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.m.with(values).Add(1)
+}
+
+// Gauge is a metric which goes up and down.
+type Gauge struct {
+	m *metric
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, kindGauge, labels)}
+}
+
+func (g *Gauge) Inc(values ...string) {
+	g.m.with(values).Add(1)
+}
+
+func (g *Gauge) Dec(values ...string) {
+	g.m.with(values).Add(-1)
+}
+
+func (g *Gauge) Set(v int64, values ...string) {
+	g.m.with(values).Store(v)
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func WriteText(w io.Writer) error {
+	lock.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	lock.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		lock.Lock()
+		m := metrics[name]
+		lock.Unlock()
+
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeHelp(m.help), m.name, m.kind); err != nil {
+			return err
+		}
+
+		m.lock.Lock()
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		lines := make([]string, 0, len(keys))
+		for _, key := range keys {
+			s := m.values[key]
+			lines = append(lines, fmt.Sprintf("%s%s %d\n", m.name, labels(m.labels, s.labels), s.value.Load()))
+		}
+		m.lock.Unlock()
+
+		// metrics without labels are shown before their first use
+		if len(m.labels) == 0 && len(lines) == 0 {
+			lines = append(lines, m.name+" 0\n")
+		}
+
+		for _, line := range lines {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handler serves the metrics, at /metrics usually.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
+
+func labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+var runs atomic.Int32
+
+// unique returns a metric name prefix not registered yet, as metrics are
+// registered once per process and tests may run several times.
+func unique(name string) string {
+	return fmt.Sprintf("%s%d_", name, runs.Add(1))
+}
+
+// text returns the lines of the metrics whose names start with prefix.
+func text(t *testing.T, prefix string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if strings.HasPrefix(line, prefix) || strings.HasPrefix(line, "# HELP "+prefix) || strings.HasPrefix(line, "# TYPE "+prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func TestWriteText(t *testing.T) {
+	prefix := unique("text")
+
+	requests := NewCounter(prefix+"requests_total", "Requests served.", "method", "path")
+	requests.Inc("GET", "/")
+	requests.Add(2, "GET", `/say "hi"`)
+	requests.With("POST", "/").Inc()
+
+	sessions := NewGauge(prefix+"sessions", "Sessions running,\nby kind.", "kind")
+	sessions.Inc("talk")
+	sessions.Inc("talk")
+	sessions.Dec("talk")
+	sessions.Set(7, "preview")
+
+	NewCounter(prefix+"errors_total", "Errors.")
+
+	want := `# HELP text_errors_total Errors.
+# TYPE text_errors_total counter
+text_errors_total 0
+# HELP text_requests_total Requests served.
+# TYPE text_requests_total counter
+text_requests_total{method="GET",path="/"} 1
+text_requests_total{method="GET",path="/say \"hi\""} 2
+text_requests_total{method="POST",path="/"} 1
+# HELP text_sessions Sessions running,\nby kind.
+# TYPE text_sessions gauge
+text_sessions{kind="preview"} 7
+text_sessions{kind="talk"} 1
+`
+	want = strings.ReplaceAll(want, "text_", prefix)
+	if got := text(t, prefix); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	name := unique("twice") + "sessions"
+	NewGauge(name, "Sessions.")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registered twice")
+		}
+	}()
+	NewCounter(name, "Sessions.")
+}
+
+func TestLabelValuesChecked(t *testing.T) {
+	c := NewCounter(unique("labels")+"requests_total", "Requests.", "method")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("counted without the label value")
+		}
+	}()
+	c.Inc()
+}
+
+func TestHandler(t *testing.T) {
+	name := unique("handler") + "requests_total"
+	NewCounter(name, "Requests.").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "\n"+name+" 1\n") {
+		t.Errorf("got\n%s", w.Body)
+	}
+}
@@ -0,0 +1,161 @@
+// Package mic decodes the microphone audio of camera previews to 16 bits
+// linear PCM.
+package mic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sbipc/pkg/g711"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink"
+	"sync"
+
+	"github.com/pion/rtp/v2"
+)
+
+// maxGapSeconds is the longest loss filled with silence, a longer gap is
+// taken for a restart of the stream.
+const maxGapSeconds = 1
+
+// Decoder decodes the G.711 RTP packets of the preview audio channel.
+type Decoder struct {
+	// SampleRate is the rate of the decoded samples.
+	SampleRate int
+
+	ulaw bool
+	// next is the timestamp expected on the next packet
+	next    uint32
+	started bool
+}
+
+// NewDecoder returns a decoder for the audio of a preview.
+func NewDecoder(params *tplink.PreviewParams) *Decoder {
+	return &Decoder{
+		SampleRate: params.AudioClockRate(),
+		ulaw:       params.AudioULaw(),
+	}
+}
+
+// Decode returns the samples of an RTP packet. Lost packets are replaced by
+// silence, so the samples keep the timing of the camera.
+func (d *Decoder) Decode(packet []byte) ([]int16, error) {
+	var p rtp.Packet
+	if err := p.Unmarshal(packet); err != nil {
+		return nil, fmt.Errorf("unmarshal rtp: %w", err)
+	}
+
+	// each G.711 byte is a sample, and timestamps count samples
+	var samples []int16
+	if gap := int32(p.Timestamp - d.next); d.started && gap > 0 && int(gap) <= d.SampleRate*maxGapSeconds {
+		samples = make([]int16, gap, int(gap)+len(p.Payload))
+	} else if d.started && gap < 0 {
+		// a late or duplicated packet, already covered by silence
+		return nil, nil
+	}
+	d.next = p.Timestamp + uint32(len(p.Payload))
+	d.started = true
+
+	if d.ulaw {
+		return append(samples, g711.DecodeULaw(p.Payload)...), nil
+	}
+	return append(samples, g711.DecodeALaw(p.Payload)...), nil
+}
+
+// Listener receives the decoded microphone audio of a camera, through the
+// hub so it shares the preview with other consumers.
+type Listener struct {
+	// SampleRate is the rate of the samples read.
+	SampleRate int
+
+	decoder      *Decoder
+	subscription *hub.Subscription
+	packets      chan []byte
+	closed       chan struct{}
+	closeOnce    *sync.Once
+	// pending holds the bytes of samples not read yet by Read
+	pending []byte
+}
+
+// Listen starts receiving the microphone of a camera.
+func Listen(h *hub.Hub, camera hub.Camera) (*Listener, error) {
+	l := &Listener{
+		packets:   make(chan []byte, 256),
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+
+	subscription, err := h.Subscribe(camera, l.onPacket, func() {
+		go l.Close()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("subscribe preview: %w", err)
+	}
+	l.subscription = subscription
+	l.decoder = NewDecoder(subscription.Params)
+	l.SampleRate = l.decoder.SampleRate
+
+	return l, nil
+}
+
+func (l *Listener) onPacket(p *mtsp.Packet) {
+	if p.Channel != 1 {
+		return
+	}
+
+	select {
+	case l.packets <- append([]byte{}, p.Body...):
+	default:
+		hub.DroppedPackets.Inc("mic")
+	}
+}
+
+// ReadSamples returns the next decoded samples, blocking until some are
+// received. It returns io.EOF once the listener is closed.
+func (l *Listener) ReadSamples() ([]int16, error) {
+	for {
+		select {
+		case packet := <-l.packets:
+			samples, err := l.decoder.Decode(packet)
+			if err != nil {
+				log.Printf("mic: %s", err)
+				continue
+			}
+			if len(samples) > 0 {
+				return samples, nil
+			}
+		case <-l.closed:
+			return nil, io.EOF
+		}
+	}
+}
+
+// Read reads the samples as signed 16 bits little endian PCM.
+func (l *Listener) Read(b []byte) (int, error) {
+	for len(l.pending) == 0 {
+		samples, err := l.ReadSamples()
+		if err != nil {
+			return 0, err
+		}
+
+		l.pending = make([]byte, len(samples)*2)
+		for i, s := range samples {
+			binary.LittleEndian.PutUint16(l.pending[i*2:], uint16(s))
+		}
+	}
+
+	n := copy(b, l.pending)
+	l.pending = l.pending[n:]
+
+	return n, nil
+}
+
+// Close stops listening, pending reads return io.EOF.
+func (l *Listener) Close() {
+	l.closeOnce.Do(func() {
+		l.subscription.Close()
+		close(l.closed)
+	})
+}
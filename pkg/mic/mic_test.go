@@ -0,0 +1,154 @@
+package mic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/metrics"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink/tplinktest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+func audioPacket(t *testing.T, ts uint32, payload []byte) []byte {
+	t.Helper()
+
+	p := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 8, Timestamp: ts}, Payload: payload}
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecoderFillsGaps(t *testing.T) {
+	d := NewDecoder(tplinktest.DefaultPreviewParams())
+	if d.SampleRate != 8000 {
+		t.Errorf("got sample rate %d, want 8000", d.SampleRate)
+	}
+
+	// A-law 0x55 decodes to -8
+	payload := bytes.Repeat([]byte{0x55}, 160)
+	for _, test := range []struct {
+		ts      uint32
+		samples int
+	}{
+		{1000, 160},
+		{1160, 160},
+		// a packet of 160 samples was lost
+		{1480, 320},
+		// late, already covered by silence
+		{1320, 0},
+		// a restart of the stream is not filled
+		{100000, 160},
+	} {
+		samples, err := d.Decode(audioPacket(t, test.ts, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != test.samples {
+			t.Fatalf("packet at %d decoded to %d samples, want %d", test.ts, len(samples), test.samples)
+		}
+		if len(samples) > 0 && samples[len(samples)-1] != -8 {
+			t.Errorf("packet at %d decoded to %d", test.ts, samples[len(samples)-1])
+		}
+		if len(samples) > 160 && samples[0] != 0 {
+			t.Errorf("gap before %d filled with %d", test.ts, samples[0])
+		}
+	}
+}
+
+func TestDecoderULaw(t *testing.T) {
+	params := tplinktest.DefaultPreviewParams()
+	params.AvConfig[0].AudioCodec = "PCMU"
+
+	samples, err := NewDecoder(params).Decode(audioPacket(t, 0, []byte{0xff, 0x00}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[0] != 0 || samples[1] >= 0 {
+		t.Errorf("got %v, want silence then a negative peak", samples)
+	}
+}
+
+func TestListener(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	h := hub.New()
+	defer h.Close()
+
+	l, err := Listen(h, hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fake camera sends A-law silence, which decodes to 8
+	b := make([]byte, 100)
+	if _, err := io.ReadFull(l, b); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(b); i += 2 {
+		if s := int16(binary.LittleEndian.Uint16(b[i:])); s != 8 {
+			t.Fatalf("sample %d is %d, want 8", i/2, s)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.ReadSamples()
+		for err == nil {
+			_, err = l.ReadSamples()
+		}
+		done <- err
+	}()
+	l.Close()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("got %v once closed, want EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not ended by Close")
+	}
+}
+
+// droppedPackets returns the packets dropped by listeners too slow.
+func droppedPackets(t *testing.T) int {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := metrics.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, count, ok := strings.Cut(buf.String(), "\nsbipc_dropped_packets_total{subscriber=\"mic\"} ")
+	if !ok {
+		return 0
+	}
+	count, _, _ = strings.Cut(count, "\n")
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestListenerCountsDrops(t *testing.T) {
+	// nobody reads the samples
+	l := &Listener{packets: make(chan []byte)}
+
+	before := droppedPackets(t)
+	l.onPacket(&mtsp.Packet{IsInterleaved: true, Channel: 1, Body: audioPacket(t, 0, []byte{0x55})})
+	l.onPacket(&mtsp.Packet{IsInterleaved: true, Channel: 0, Body: []byte("video")})
+
+	if n := droppedPackets(t) - before; n != 1 {
+		t.Errorf("%d packets counted as dropped, want 1", n)
+	}
+}
@@ -0,0 +1,83 @@
+package mic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const wavHeaderSize = 44
+
+// WAVWriter writes mono 16 bits PCM samples as a WAV file.
+type WAVWriter struct {
+	w          io.Writer
+	sampleRate int
+	size       uint32
+}
+
+// NewWAVWriter writes the header of a WAV file to w. Its sizes are only
+// known on Close, and are left as unknown when w cannot seek, which most
+// readers take for a stream.
+func NewWAVWriter(w io.Writer, sampleRate int) (*WAVWriter, error) {
+	writer := &WAVWriter{w: w, sampleRate: sampleRate}
+
+	if _, err := w.Write(writer.header(0xffffffff)); err != nil {
+		return nil, fmt.Errorf("write wav header: %w", err)
+	}
+
+	return writer, nil
+}
+
+// WriteSamples appends samples to the file.
+func (w *WAVWriter) WriteSamples(samples []int16) error {
+	b := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[i*2:], uint16(s))
+	}
+
+	n, err := w.w.Write(b)
+	w.size += uint32(n)
+	return err
+}
+
+// Close writes the final sizes in the header, when the writer can seek. It
+// does not close the underlying writer.
+func (w *WAVWriter) Close() error {
+	seeker, ok := w.w.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		// pipes are files too, but do not seek
+		return nil
+	}
+	if _, err := seeker.Write(w.header(w.size)); err != nil {
+		return fmt.Errorf("write wav header: %w", err)
+	}
+	_, err := seeker.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (w *WAVWriter) header(dataSize uint32) []byte {
+	riffSize := dataSize
+	if dataSize != 0xffffffff {
+		riffSize = dataSize + wavHeaderSize - 8
+	}
+
+	b := make([]byte, wavHeaderSize)
+	copy(b[0:], "RIFF")
+	binary.LittleEndian.PutUint32(b[4:], riffSize)
+	copy(b[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(b[16:], 16)
+	binary.LittleEndian.PutUint16(b[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(b[22:], 1) // mono
+	binary.LittleEndian.PutUint32(b[24:], uint32(w.sampleRate))
+	binary.LittleEndian.PutUint32(b[28:], uint32(w.sampleRate*2))
+	binary.LittleEndian.PutUint16(b[32:], 2)
+	binary.LittleEndian.PutUint16(b[34:], 16)
+	copy(b[36:], "data")
+	binary.LittleEndian.PutUint32(b[40:], dataSize)
+
+	return b
+}
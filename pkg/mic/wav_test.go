@@ -0,0 +1,67 @@
+package mic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAVWriterSeekable(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "mic.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewWAVWriter(f, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.WriteSamples([]int16{1, -1, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != wavHeaderSize+12 {
+		t.Fatalf("got %d bytes, want %d", len(b), wavHeaderSize+12)
+	}
+	if riff, data := binary.LittleEndian.Uint32(b[4:]), binary.LittleEndian.Uint32(b[40:]); riff != 48 || data != 12 {
+		t.Errorf("got riff size %d and data size %d, want 48 and 12", riff, data)
+	}
+	if rate := binary.LittleEndian.Uint32(b[24:]); rate != 8000 {
+		t.Errorf("got sample rate %d", rate)
+	}
+	if s := int16(binary.LittleEndian.Uint16(b[wavHeaderSize+2:])); s != -1 {
+		t.Errorf("second sample is %d, want -1", s)
+	}
+}
+
+func TestWAVWriterStream(t *testing.T) {
+	var buf bytes.Buffer
+
+	w, err := NewWAVWriter(&buf, 16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteSamples([]int16{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if len(b) != wavHeaderSize+4 || binary.LittleEndian.Uint32(b[40:]) != 0xffffffff {
+		t.Errorf("got %d bytes with data size %#x, want an unknown size", len(b), binary.LittleEndian.Uint32(b[40:]))
+	}
+}
@@ -0,0 +1,7 @@
+package mtsp
+
+import "sbipc/pkg/metrics"
+
+// droppedFrames counts the interleaved frames dropped by deliver so that
+// responses are not stuck behind them.
+var droppedFrames = metrics.NewCounter("sbipc_mtsp_dropped_frames_total", "Interleaved frames dropped while a request waited for its response.")
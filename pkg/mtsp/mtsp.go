@@ -2,7 +2,10 @@ package mtsp
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/textproto"
@@ -10,17 +13,38 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+var ErrClosed = errors.New("mtsp: connection closed")
+
+// aLongTimeAgo is a deadline in the past, used to abort blocked writes.
+var aLongTimeAgo = time.Unix(1, 0)
+
+var statusLineRe = regexp.MustCompile(`(?m)RTSP/1\.0\s(\d+)`)
+
+var requestLineRe = regexp.MustCompile(`^(\S+)\s+(\S+)\s+RTSP/1\.0$`)
+
 type Conn struct {
 	underlying io.ReadWriteCloser
 	reader     *textproto.Reader
 	cseq       int
 	writeLock  *sync.Mutex
+
+	pendingLock *sync.Mutex
+	pending     []*pendingRequest
+	frames      chan *Packet
+	requested   chan struct{}
+	done        chan struct{}
+	closing     chan struct{}
+	closeOnce   *sync.Once
+	err         error
 }
 
 type Packet struct {
 	IsInterleaved bool
+	Method        string
+	URL           string
 	Status        string
 	StatusCode    int
 	Headers       *textproto.MIMEHeader
@@ -28,18 +52,58 @@ type Packet struct {
 	Body          []byte
 }
 
+// pendingRequest is a text request waiting for its response. Responses are
+// matched by CSeq first, then by the JSON "seq" of the body, and finally in
+// the order requests were sent.
+type pendingRequest struct {
+	cseq     int
+	seq      int
+	hasSeq   bool
+	response chan *Packet
+}
+
+type jsonSeq struct {
+	Seq *int `json:"seq"`
+}
+
+func parseJsonSeq(body []byte) (int, bool) {
+	if len(body) == 0 || body[0] != '{' {
+		return 0, false
+	}
+
+	var s jsonSeq
+	if err := json.Unmarshal(body, &s); err != nil || s.Seq == nil {
+		return 0, false
+	}
+
+	return *s.Seq, true
+}
+
 func (c *Conn) WriteMultiTrans(headers *textproto.MIMEHeader, body []byte) error {
 	return c.WriteText("MULTITRANS", headers, body)
 }
 
 func (c *Conn) WriteTeardown() error {
-	return c.WriteText("TEARDOWN", &textproto.MIMEHeader{}, []byte{})
+	return c.WriteTeardownContext(context.Background())
+}
+
+// WriteTeardownContext is like WriteTeardown but gives up when ctx is done.
+func (c *Conn) WriteTeardownContext(ctx context.Context) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	defer c.bindWriteDeadline(ctx)()
+	return c.writeText("TEARDOWN", &textproto.MIMEHeader{}, []byte{})
 }
 
 func (c *Conn) WriteText(method string, headers *textproto.MIMEHeader, body []byte) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
+	return c.writeText(method, headers, body)
+}
+
+func (c *Conn) writeText(method string, headers *textproto.MIMEHeader, body []byte) error {
 	buf := make([]string, 0)
 	buf = append(buf, fmt.Sprintf("%s rtsp://127.0.0.1/multitrans RTSP/1.0", method))
 	buf = append(buf, fmt.Sprintf("CSeq: %d", c.cseq))
@@ -66,22 +130,320 @@ func (c *Conn) WriteText(method string, headers *textproto.MIMEHeader, body []by
 	return nil
 }
 
+// MultiTrans sends a MULTITRANS request and waits for its response.
+func (c *Conn) MultiTrans(headers *textproto.MIMEHeader, body []byte) (*Packet, error) {
+	return c.DoContext(context.Background(), "MULTITRANS", headers, body)
+}
+
+// MultiTransContext is like MultiTrans but gives up when ctx is done.
+func (c *Conn) MultiTransContext(ctx context.Context, headers *textproto.MIMEHeader, body []byte) (*Packet, error) {
+	return c.DoContext(ctx, "MULTITRANS", headers, body)
+}
+
+// Do sends a text request and waits for the matching response, while
+// interleaved frames keep flowing to Read.
+func (c *Conn) Do(method string, headers *textproto.MIMEHeader, body []byte) (*Packet, error) {
+	return c.DoContext(context.Background(), method, headers, body)
+}
+
+// DoContext is like Do but gives up when ctx is done. The deadline of ctx
+// also bounds writing the request if the underlying connection supports
+// write deadlines.
+func (c *Conn) DoContext(ctx context.Context, method string, headers *textproto.MIMEHeader, body []byte) (*Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.send(ctx, method, headers, body)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case p := <-req.response:
+		return p, nil
+	case <-ctx.Done():
+		c.forget(req)
+		return nil, ctx.Err()
+	case <-c.done:
+		c.forget(req)
+		// the response may have been delivered right before the reader stopped
+		select {
+		case p := <-req.response:
+			return p, nil
+		default:
+		}
+		return nil, c.err
+	}
+}
+
+func (c *Conn) send(ctx context.Context, method string, headers *textproto.MIMEHeader, body []byte) (*pendingRequest, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	defer c.bindWriteDeadline(ctx)()
+
+	req := &pendingRequest{
+		cseq:     c.cseq,
+		response: make(chan *Packet, 1),
+	}
+	req.seq, req.hasSeq = parseJsonSeq(body)
+
+	c.pendingLock.Lock()
+	c.pending = append(c.pending, req)
+	c.pendingLock.Unlock()
+
+	// wake the reader up if it waits for Read while frames are full
+	select {
+	case c.requested <- struct{}{}:
+	default:
+	}
+
+	if err := c.writeText(method, headers, body); err != nil {
+		c.forget(req)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	return req, nil
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// bindWriteDeadline makes writes on the underlying connection honour the
+// deadline and cancellation of ctx, until the returned function is called.
+func (c *Conn) bindWriteDeadline(ctx context.Context) func() {
+	d, ok := c.underlying.(writeDeadliner)
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		d.SetWriteDeadline(deadline)
+	}
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		d.SetWriteDeadline(aLongTimeAgo)
+		close(fired)
+	})
+
+	return func() {
+		if !stop() {
+			<-fired
+		}
+		d.SetWriteDeadline(time.Time{})
+	}
+}
+
+func (c *Conn) forget(req *pendingRequest) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	for i, r := range c.pending {
+		if r == req {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// claim finds and removes the pending request a text response belongs to.
+func (c *Conn) claim(p *Packet) *pendingRequest {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	if len(c.pending) == 0 {
+		return nil
+	}
+
+	match := -1
+	if cseq, err := strconv.Atoi(p.Headers.Get("CSeq")); err == nil {
+		for i, r := range c.pending {
+			if r.cseq == cseq {
+				match = i
+				break
+			}
+		}
+	} else if seq, ok := parseJsonSeq(p.Body); ok {
+		for i, r := range c.pending {
+			if r.hasSeq && r.seq == seq {
+				match = i
+				break
+			}
+		}
+	} else {
+		match = 0
+	}
+
+	if match < 0 {
+		return nil
+	}
+
+	req := c.pending[match]
+	c.pending = append(c.pending[:match], c.pending[match+1:]...)
+	return req
+}
+
+// WriteResponse answers a request read from the peer, echoing its CSeq.
+func (c *Conn) WriteResponse(req *Packet, statusCode int, reason string, headers *textproto.MIMEHeader, body []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	buf := make([]string, 0)
+	buf = append(buf, fmt.Sprintf("RTSP/1.0 %d %s", statusCode, reason))
+	if req != nil && req.Headers != nil && req.Headers.Get("CSeq") != "" {
+		buf = append(buf, fmt.Sprintf("CSeq: %s", req.Headers.Get("CSeq")))
+	}
+	buf = append(buf, fmt.Sprintf("Content-Length: %d", len(body)))
+
+	if headers != nil {
+		for key, values := range *headers {
+			for _, v := range values {
+				buf = append(buf, fmt.Sprintf("%s: %s", key, v))
+			}
+		}
+	}
+
+	header := []byte(strings.Join(buf, "\r\n") + "\r\n\r\n")
+
+	payload := make([]byte, len(header)+len(body))
+	copy(payload, header)
+	copy(payload[len(header):], body)
+
+	if _, err := c.underlying.Write(payload); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
 func (c *Conn) WriteInterleaved(data []byte) error {
+	return c.WriteInterleavedChannel(0, data)
+}
+
+func (c *Conn) WriteInterleavedChannel(channel int, data []byte) error {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 
-	channel := 0
 	payload := make([]byte, len(data)+4)
 	payload[0] = '$'
 	payload[1] = byte(channel)
 	binary.BigEndian.PutUint16(payload[2:], uint16(len(data)))
 	copy(payload[4:], data)
 
-	c.underlying.Write(payload)
+	if _, err := c.underlying.Write(payload); err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
 	return nil
 }
 
+// Read returns the next interleaved frame, or a text packet which is not
+// the response of any request sent with Do. On the serving side, incoming
+// requests are returned by Read with Method and URL set.
+//
+// Up to 64 packets are buffered. Once the buffer is full, the reader waits
+// for Read, unless a request waits for its response: interleaved frames
+// are then dropped so that the response is not stuck behind them, and
+// counted by sbipc_mtsp_dropped_frames_total.
 func (c *Conn) Read() (*Packet, error) {
+	return c.ReadContext(context.Background())
+}
+
+// ReadContext is like Read but gives up when ctx is done.
+func (c *Conn) ReadContext(ctx context.Context) (*Packet, error) {
+	select {
+	case p := <-c.frames:
+		return p, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		// drain frames received before the reader stopped
+		select {
+		case p := <-c.frames:
+			return p, nil
+		default:
+		}
+		return nil, c.err
+	}
+}
+
+// Close closes the underlying connection and stops the reader.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+	})
+	return c.underlying.Close()
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.done)
+
+	for {
+		p, err := c.readPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				err = fmt.Errorf("%w: %w", ErrClosed, err)
+			}
+			c.err = err
+			return
+		}
+
+		if !p.IsInterleaved && p.Method == "" {
+			if req := c.claim(p); req != nil {
+				req.response <- p
+				continue
+			}
+		}
+
+		if !c.deliver(p) {
+			c.err = ErrClosed
+			return
+		}
+	}
+}
+
+// deliver hands a packet to Read, dropping and counting interleaved frames
+// while the buffer is full and requests wait for their responses. It returns false
+// once the connection is closing.
+func (c *Conn) deliver(p *Packet) bool {
+	for {
+		select {
+		case c.frames <- p:
+			return true
+		case <-c.closing:
+			return false
+		default:
+		}
+
+		if p.IsInterleaved && c.hasPending() {
+			droppedFrames.Inc()
+			return true
+		}
+
+		select {
+		case c.frames <- p:
+			return true
+		case <-c.requested:
+		case <-c.closing:
+			return false
+		}
+	}
+}
+
+func (c *Conn) hasPending() bool {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	return len(c.pending) > 0
+}
+
+func (c *Conn) readPacket() (*Packet, error) {
 	b, err := c.reader.R.Peek(1)
 	if err != nil {
 		return nil, fmt.Errorf("peek: %w", err)
@@ -123,9 +485,16 @@ func (c *Conn) Read() (*Packet, error) {
 			return nil, fmt.Errorf("read status line: %w", err)
 		}
 
-		re := regexp.MustCompile(`(?m)RTSP/1\.0\s(\d+)`)
-		m := re.FindStringSubmatch(status)
-		statusCode, _ := strconv.Atoi(m[1])
+		var method, url string
+		var statusCode int
+		if m := statusLineRe.FindStringSubmatch(status); m != nil && strings.HasPrefix(status, "RTSP/") {
+			statusCode, _ = strconv.Atoi(m[1])
+		} else if m := requestLineRe.FindStringSubmatch(status); m != nil {
+			// a request, when we are the serving side
+			method, url = m[1], m[2]
+		} else {
+			return nil, fmt.Errorf("invalid status line: %q", status)
+		}
 
 		headers, err := c.reader.ReadMIMEHeader()
 		if err != nil {
@@ -149,6 +518,8 @@ func (c *Conn) Read() (*Packet, error) {
 
 		p := &Packet{
 			IsInterleaved: false,
+			Method:        method,
+			URL:           url,
 			Status:        status,
 			StatusCode:    statusCode,
 			Headers:       &headers,
@@ -160,10 +531,20 @@ func (c *Conn) Read() (*Packet, error) {
 }
 
 func NewConn(underlying io.ReadWriteCloser) *Conn {
-	return &Conn{
-		underlying: underlying,
-		reader:     textproto.NewReader(bufio.NewReader(underlying)),
-		cseq:       0,
-		writeLock:  &sync.Mutex{},
+	c := &Conn{
+		underlying:  underlying,
+		reader:      textproto.NewReader(bufio.NewReader(underlying)),
+		cseq:        0,
+		writeLock:   &sync.Mutex{},
+		pendingLock: &sync.Mutex{},
+		frames:      make(chan *Packet, 64),
+		requested:   make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		closing:     make(chan struct{}),
+		closeOnce:   &sync.Once{},
 	}
+
+	go c.readLoop()
+
+	return c
 }
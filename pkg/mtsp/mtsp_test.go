@@ -0,0 +1,392 @@
+package mtsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sbipc/pkg/metrics"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// camera is the far end of a connection, reading requests and writing
+// responses and frames by hand.
+type camera struct {
+	net.Conn
+	reader *textproto.Reader
+}
+
+// newPair returns a connection and the camera it talks to.
+func newPair(t *testing.T) (*Conn, *camera) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	c := NewConn(a)
+	t.Cleanup(func() {
+		c.Close()
+		b.Close()
+	})
+	return c, &camera{Conn: b, reader: textproto.NewReader(bufio.NewReader(b))}
+}
+
+// readRequest returns the CSeq and the body of the next request.
+func (c *camera) readRequest() (int, []byte, error) {
+	if _, err := c.reader.ReadLine(); err != nil {
+		return 0, nil, err
+	}
+	headers, err := c.reader.ReadMIMEHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	cseq, _ := strconv.Atoi(headers.Get("CSeq"))
+	length, _ := strconv.Atoi(headers.Get("Content-Length"))
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader.R, body); err != nil {
+		return 0, nil, err
+	}
+	return cseq, body, nil
+}
+
+// respond writes a response, without CSeq when cseq is negative.
+func (c *camera) respond(cseq int, body string) error {
+	header := ""
+	if cseq >= 0 {
+		header = fmt.Sprintf("CSeq: %d\r\n", cseq)
+	}
+	_, err := fmt.Fprintf(c, "RTSP/1.0 200 OK\r\n%sContent-Length: %d\r\n\r\n%s", header, len(body), body)
+	return err
+}
+
+func (c *camera) frame(channel int, body []byte) error {
+	header := []byte{'$', byte(channel), 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(body)))
+	_, err := c.Write(append(header, body...))
+	return err
+}
+
+func TestDoDemuxesFrames(t *testing.T) {
+	c, cam := newPair(t)
+
+	go func() {
+		cseq, _, err := cam.readRequest()
+		if err != nil {
+			return
+		}
+		cam.frame(0, []byte("video"))
+		cam.frame(1, []byte("audio"))
+		cam.respond(cseq, "answer")
+	}()
+
+	resp, err := c.Do("MULTITRANS", &textproto.MIMEHeader{}, []byte("question"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || string(resp.Body) != "answer" {
+		t.Errorf("got response %d %q", resp.StatusCode, resp.Body)
+	}
+
+	for _, want := range []struct {
+		channel int
+		body    string
+	}{{0, "video"}, {1, "audio"}} {
+		p, err := c.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.IsInterleaved || p.Channel != want.channel || string(p.Body) != want.body {
+			t.Errorf("got packet %+v, want %q on channel %d", p, want.body, want.channel)
+		}
+	}
+}
+
+func TestResponsesMatchedByCSeq(t *testing.T) {
+	c, cam := newPair(t)
+
+	go func() {
+		var cseqs []int
+		var bodies []string
+		for i := 0; i < 2; i++ {
+			cseq, body, err := cam.readRequest()
+			if err != nil {
+				return
+			}
+			cseqs = append(cseqs, cseq)
+			bodies = append(bodies, string(body))
+		}
+		// answered out of order
+		cam.respond(cseqs[1], bodies[1])
+		cam.respond(cseqs[0], bodies[0])
+	}()
+
+	results := make(chan error, 2)
+	for _, body := range []string{"one", "two"} {
+		go func(body string) {
+			resp, err := c.Do("MULTITRANS", &textproto.MIMEHeader{}, []byte(body))
+			if err == nil && string(resp.Body) != body {
+				err = fmt.Errorf("request %q got response %q", body, resp.Body)
+			}
+			results <- err
+		}(body)
+		// keep the order of the requests
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestResponsesMatchedByJsonSeq(t *testing.T) {
+	c, cam := newPair(t)
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			if _, _, err := cam.readRequest(); err != nil {
+				return
+			}
+		}
+		// without CSeq, out of order
+		cam.respond(-1, `{"type":"response","seq":2}`)
+		cam.respond(-1, `{"type":"response","seq":1}`)
+	}()
+
+	results := make(chan error, 2)
+	for _, seq := range []int{1, 2} {
+		go func(seq int) {
+			resp, err := c.Do("MULTITRANS", &textproto.MIMEHeader{}, []byte(fmt.Sprintf(`{"type":"request","seq":%d}`, seq)))
+			if err == nil {
+				if got, _ := parseJsonSeq(resp.Body); got != seq {
+					err = fmt.Errorf("request %d got the response of %d", seq, got)
+				}
+			}
+			results <- err
+		}(seq)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestFramesKeptWithoutPendingRequests(t *testing.T) {
+	c, cam := newPair(t)
+
+	const frames = 200
+	go func() {
+		for i := 0; i < frames; i++ {
+			if err := cam.frame(0, []byte{byte(i)}); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < frames; i++ {
+		p, err := c.Read()
+		if err != nil {
+			t.Fatalf("frame %d: %s", i, err)
+		}
+		if p.Body[0] != byte(i) {
+			t.Fatalf("got frame %d, want %d", p.Body[0], i)
+		}
+	}
+}
+
+// dropped returns the count of sbipc_mtsp_dropped_frames_total.
+func dropped(t *testing.T) int {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := metrics.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	_, count, _ := strings.Cut(buf.String(), "\nsbipc_mtsp_dropped_frames_total ")
+	count, _, _ = strings.Cut(count, "\n")
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		t.Fatalf("no dropped frames count: %s", err)
+	}
+	return n
+}
+
+func TestResponseNotStuckBehindFrames(t *testing.T) {
+	c, cam := newPair(t)
+	before := dropped(t)
+
+	go func() {
+		cseq, _, err := cam.readRequest()
+		if err != nil {
+			return
+		}
+		// more frames than buffered, while nobody reads them
+		for i := 0; i < 100; i++ {
+			if err := cam.frame(0, []byte{byte(i)}); err != nil {
+				return
+			}
+		}
+		cam.respond(cseq, "answer")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.DoContext(ctx, "MULTITRANS", &textproto.MIMEHeader{}, []byte("question"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "answer" {
+		t.Errorf("got response %q", resp.Body)
+	}
+
+	if p, err := c.Read(); err != nil || p.Body[0] != 0 {
+		t.Errorf("got %v, %v, want the first frame", p, err)
+	}
+	if n := dropped(t) - before; n == 0 {
+		t.Error("dropped frames not counted")
+	}
+}
+
+func TestReadFailsOnceClosed(t *testing.T) {
+	c, cam := newPair(t)
+
+	cam.frame(0, []byte("last"))
+	cam.Close()
+
+	if p, err := c.Read(); err != nil || string(p.Body) != "last" {
+		t.Errorf("got %v, %v, want the frame sent before closing", p, err)
+	}
+	if _, err := c.Read(); err == nil {
+		t.Error("read on a closed connection")
+	}
+	if _, err := c.Do("MULTITRANS", &textproto.MIMEHeader{}, nil); err == nil {
+		t.Error("request succeeded on a closed connection")
+	}
+}
+
+func TestDoContextGivesUp(t *testing.T) {
+	c, cam := newPair(t)
+
+	requests := make(chan int, 2)
+	go func() {
+		for {
+			cseq, _, err := cam.readRequest()
+			if err != nil {
+				return
+			}
+			requests <- cseq
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.DoContext(ctx, "MULTITRANS", &textproto.MIMEHeader{}, []byte("unanswered")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline exceeded", err)
+	}
+	late := <-requests
+
+	go func() {
+		cseq := <-requests
+		// the late response is not mistaken for the next one
+		cam.respond(late, "late")
+		cam.respond(cseq, "answer")
+	}()
+
+	resp, err := c.Do("MULTITRANS", &textproto.MIMEHeader{}, []byte("question"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != "answer" {
+		t.Errorf("got response %q", resp.Body)
+	}
+}
+
+func TestDoContextBoundsWrites(t *testing.T) {
+	// nobody reads the requests
+	c, _ := newPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.DoContext(ctx, "MULTITRANS", &textproto.MIMEHeader{}, []byte("stuck"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("request written to nobody")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write not bounded by the context")
+	}
+}
+
+func TestWriteTeardownContextGivesUp(t *testing.T) {
+	// nobody reads the teardown
+	c, _ := newPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- c.WriteTeardownContext(ctx) }()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("teardown written to nobody")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("teardown not bounded by the context")
+	}
+}
+
+func TestReadContextGivesUp(t *testing.T) {
+	c, _ := newPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline exceeded", err)
+	}
+}
+
+func TestServerReadsRequests(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewConn(a), NewConn(b)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		p, err := server.Read()
+		if err != nil {
+			return
+		}
+		if p.Method != "MULTITRANS" || string(p.Body) != "question" {
+			server.WriteResponse(p, 400, "Bad Request", nil, nil)
+			return
+		}
+		server.WriteResponse(p, 200, "OK", nil, []byte("answer"))
+	}()
+
+	resp, err := client.Do("MULTITRANS", &textproto.MIMEHeader{}, []byte("question"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || string(resp.Body) != "answer" {
+		t.Errorf("got response %d %q", resp.StatusCode, resp.Body)
+	}
+}
@@ -0,0 +1,144 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultICEServers are used without an ICE configuration.
+var defaultICEServers = []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}
+
+// ICEConfig is how peer connections gather their candidates, in YAML or
+// JSON:
+//
+//	servers:
+//	  - urls: [turn:turn.example.com:3478]
+//	    username: sbipc
+//	    credential: secret
+//	nat1to1IPs: [203.0.113.7]
+//	udpPortMin: 50000
+//	udpPortMax: 50100
+type ICEConfig struct {
+	// Servers are the STUN and TURN servers, none when empty.
+	Servers []ICEServer `yaml:"servers" json:"servers"`
+	// NAT1To1IPs are the public IPs of the host, announced instead of its
+	// own, or besides them when NAT1To1CandidateType is srflx.
+	NAT1To1IPs           []string `yaml:"nat1to1IPs" json:"nat1to1IPs"`
+	NAT1To1CandidateType string   `yaml:"nat1to1CandidateType" json:"nat1to1CandidateType"`
+	// UDPPortMin and UDPPortMax bound the ephemeral UDP ports.
+	UDPPortMin uint16 `yaml:"udpPortMin" json:"udpPortMin"`
+	UDPPortMax uint16 `yaml:"udpPortMax" json:"udpPortMax"`
+	// UDPMuxPort serves every peer connection on a single UDP port.
+	UDPMuxPort int `yaml:"udpMuxPort" json:"udpMuxPort"`
+	// TCPMuxPort enables ICE-TCP, serving every peer connection on a single
+	// TCP port.
+	TCPMuxPort int `yaml:"tcpMuxPort" json:"tcpMuxPort"`
+}
+
+type ICEServer struct {
+	URLs       []string `yaml:"urls" json:"urls"`
+	Username   string   `yaml:"username" json:"username"`
+	Credential string   `yaml:"credential" json:"credential"`
+}
+
+// LoadICEConfig reads an ICE configuration file, JSON when its extension is
+// .json and YAML otherwise.
+func LoadICEConfig(path string) (*ICEConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ice config: %w", err)
+	}
+
+	var config ICEConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+var (
+	iceLock       = &sync.Mutex{}
+	iceServers    = defaultICEServers
+	settingEngine = webrtc.SettingEngine{}
+	iceConfigured bool
+)
+
+// ConfigureICE applies an ICE configuration to every peer connection, it
+// must be called once before the first one is created. The muxes listen
+// right away.
+func ConfigureICE(config *ICEConfig) error {
+	iceLock.Lock()
+	defer iceLock.Unlock()
+
+	if iceConfigured {
+		return errors.New("ice already configured")
+	}
+
+	engine := webrtc.SettingEngine{}
+
+	if len(config.NAT1To1IPs) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if config.NAT1To1CandidateType != "" {
+			var err error
+			if candidateType, err = webrtc.NewICECandidateType(config.NAT1To1CandidateType); err != nil {
+				return fmt.Errorf("nat1to1 candidate type: %w", err)
+			}
+		}
+		engine.SetNAT1To1IPs(config.NAT1To1IPs, candidateType)
+	}
+
+	if config.UDPPortMin != 0 || config.UDPPortMax != 0 {
+		if err := engine.SetEphemeralUDPPortRange(config.UDPPortMin, config.UDPPortMax); err != nil {
+			return fmt.Errorf("udp port range: %w", err)
+		}
+	}
+
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	if config.UDPMuxPort != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: config.UDPMuxPort})
+		if err != nil {
+			return fmt.Errorf("listen udp mux: %w", err)
+		}
+		engine.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+
+	if config.TCPMuxPort != 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: config.TCPMuxPort})
+		if err != nil {
+			return fmt.Errorf("listen tcp mux: %w", err)
+		}
+		engine.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	engine.SetNetworkTypes(networkTypes)
+
+	servers := make([]webrtc.ICEServer, 0, len(config.Servers))
+	for _, s := range config.Servers {
+		server := webrtc.ICEServer{URLs: s.URLs, Username: s.Username}
+		if s.Credential != "" {
+			server.Credential = s.Credential
+		}
+		servers = append(servers, server)
+	}
+
+	settingEngine = engine
+	iceServers = servers
+	iceConfigured = true
+	return nil
+}
@@ -0,0 +1,47 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadICEConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "ice.yaml")
+	os.WriteFile(yamlPath, []byte("servers:\n  - urls: [turn:turn.example.com:3478]\n    username: sbipc\n    credential: secret\nnat1to1IPs: [203.0.113.7]\nudpPortMin: 50000\nudpPortMax: 50100\n"), 0o600)
+	jsonPath := filepath.Join(dir, "ice.json")
+	os.WriteFile(jsonPath, []byte(`{"servers": [{"urls": ["turn:turn.example.com:3478"], "username": "sbipc", "credential": "secret"}], "nat1to1IPs": ["203.0.113.7"], "udpPortMin": 50000, "udpPortMax": 50100}`), 0o600)
+
+	want := &ICEConfig{
+		Servers:    []ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "sbipc", Credential: "secret"}},
+		NAT1To1IPs: []string{"203.0.113.7"},
+		UDPPortMin: 50000,
+		UDPPortMax: 50100,
+	}
+	for _, path := range []string{yamlPath, jsonPath} {
+		config, err := LoadICEConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("%s: got %+v", path, config)
+		}
+	}
+
+	if _, err := LoadICEConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestConfigureICEOnce(t *testing.T) {
+	// configured by TestMain
+	if err := ConfigureICE(&ICEConfig{}); err == nil {
+		t.Error("configured twice")
+	}
+	if len(iceServers) != 0 {
+		t.Errorf("got ice servers %v", iceServers)
+	}
+}
@@ -1,32 +1,78 @@
 package peer
 
 import (
+	"log"
 	"net/http"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/registry"
+	"sbipc/pkg/turnserver"
+	"sync"
 
 	"github.com/olahol/melody"
 )
 
 type Server struct {
-	melody *melody.Melody
+	// AllowDirect accepts cameras sent with their credentials by clients,
+	// besides the IDs of the registry.
+	AllowDirect bool
+	// Auth authenticates clients, which may then only open the cameras
+	// they have permissions on. Every client is auth.Anonymous without it.
+	Auth *auth.Auth
+	// TURN is handed to clients to relay through.
+	TURN *turnserver.Server
+
+	melody  *melody.Melody
+	hub     *hub.Hub
+	cameras *registry.Registry
 }
 
 func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
-	s.melody.HandleRequestWithKeys(w, r, map[string]interface{}{})
+	identity := auth.Anonymous
+	if s.Auth != nil {
+		var err error
+		identity, err = s.Auth.Authenticate(r)
+		if err != nil {
+			log.Printf("refused websocket from %s: %s", r.RemoteAddr, err)
+			s.Auth.Unauthorized(w, err)
+			return
+		}
+	}
+
+	s.melody.HandleRequestWithKeys(w, r, map[string]interface{}{"identity": identity})
 }
 
-func NewServer() *Server {
+// Close ends every session, stopping their talk, previews and playbacks.
+func (s *Server) Close() {
+	sessions, _ := s.melody.Sessions()
+	for _, ms := range sessions {
+		if relay, ok := ms.Get("relay"); ok {
+			relay.(*MelodyRelay).Close()
+		}
+	}
+	s.melody.Close()
+}
+
+func NewServer(h *hub.Hub, cameras *registry.Registry) *Server {
 	m := melody.New()
 	m.Config.MaxMessageSize = 1024 * 1024
 
 	s := &Server{
-		melody: m,
+		melody:  m,
+		hub:     h,
+		cameras: cameras,
 	}
 
-	m.HandleConnect(func(s *melody.Session) {
-		relay := NewMelodyRelay(s)
-		session := NewSession(relay)
-		s.Keys["relay"] = relay
-		s.Keys["session"] = session
+	m.HandleConnect(func(ms *melody.Session) {
+		relay := NewMelodyRelay(ms)
+		session := NewSession(relay, s.hub, &SessionOptions{
+			Cameras:     s.cameras,
+			AllowDirect: s.AllowDirect,
+			Identity:    ms.MustGet("identity").(*auth.Identity),
+			TURN:        s.TURN,
+		})
+		ms.Set("relay", relay)
+		ms.Set("session", session)
 	})
 
 	m.HandleMessage(func(s *melody.Session, msg []byte) {
@@ -45,24 +91,27 @@ func NewServer() *Server {
 }
 
 func getSession(s *melody.Session) *Session {
-	return s.Keys["session"].(*Session)
+	return s.MustGet("session").(*Session)
 }
 
 func getRelay(s *melody.Session) *MelodyRelay {
-	return s.Keys["relay"].(*MelodyRelay)
+	return s.MustGet("relay").(*MelodyRelay)
 }
 
 type MelodyRelay struct {
 	melodySession *melody.Session
 	dataCallback  func(data string)
 	closeCallback func()
+	closeOnce     *sync.Once
 }
 
 func (m *MelodyRelay) Close() {
-	if m.closeCallback != nil {
-		m.closeCallback()
-	}
-	m.melodySession.CloseWithMsg(melody.FormatCloseMessage(4001, "relay closed"))
+	m.closeOnce.Do(func() {
+		if m.closeCallback != nil {
+			m.closeCallback()
+		}
+		m.melodySession.CloseWithMsg(melody.FormatCloseMessage(4001, "relay closed"))
+	})
 }
 
 func (m *MelodyRelay) Send(data string) error {
@@ -88,5 +137,6 @@ var _ Relay = (*MelodyRelay)(nil)
 func NewMelodyRelay(m *melody.Session) *MelodyRelay {
 	return &MelodyRelay{
 		melodySession: m,
+		closeOnce:     &sync.Once{},
 	}
 }
@@ -0,0 +1,41 @@
+package peer
+
+import (
+	"sbipc/pkg/metrics"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+var peerConnections = metrics.NewGauge("sbipc_webrtc_peers", "WebRTC peer connections by state, closed ones are not counted.", "kind", "state")
+
+// The kinds of peer connections of sbipc_webrtc_peers.
+const (
+	peerIPC  = "ipc"
+	peerWHEP = "whep"
+	peerWHIP = "whip"
+)
+
+// observePeer counts a new peer connection, and returns the function to
+// call with its states to count it in them. State changes are delivered
+// concurrently, so the closed state is final.
+func observePeer(kind string) func(webrtc.PeerConnectionState) {
+	lock := &sync.Mutex{}
+	current := webrtc.PeerConnectionStateNew
+	peerConnections.Inc(kind, current.String())
+
+	return func(state webrtc.PeerConnectionState) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if current == state || current == webrtc.PeerConnectionStateClosed {
+			return
+		}
+
+		peerConnections.Dec(kind, current.String())
+		if state != webrtc.PeerConnectionStateClosed {
+			peerConnections.Inc(kind, state.String())
+		}
+		current = state
+	}
+}
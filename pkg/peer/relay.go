@@ -1,6 +1,12 @@
 package peer
 
 import (
+	"errors"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/ptz"
+	"sbipc/pkg/tplink"
+	"time"
+
 	"github.com/pion/webrtc/v4"
 )
 
@@ -11,24 +17,123 @@ type Relay interface {
 	Close()
 }
 
+var (
+	ErrCameraNotFound = errors.New("camera not found")
+	// ErrDirectCamera refuses cameras sent with their credentials.
+	ErrDirectCamera = errors.New("cameras must be opened by id")
+)
+
 type RelayError struct {
 	Message string `json:"message"`
+	// Code is a machine readable reason, see relayErrorCodes.
+	Code string `json:"code,omitempty"`
+	// DeviceCode is the error_code the camera answered with, if any.
+	DeviceCode int `json:"deviceCode,omitempty"`
+}
+
+// relayErrorCodes are the codes of the camera refusals clients may act on.
+var relayErrorCodes = []struct {
+	err  error
+	code string
+}{
+	{tplink.ErrUnauthorized, "unauthorized"},
+	{tplink.ErrForbidden, "forbidden"},
+	{tplink.ErrSessionNotFound, "session_not_found"},
+	{tplink.ErrSessionLimit, "session_limit"},
+	{tplink.ErrPrivacyMode, "privacy_mode"},
+	{tplink.ErrUnsupported, "unsupported"},
+	{tplink.ErrBusy, "busy"},
+	{ErrCameraNotFound, "camera_not_found"},
+	{ErrDirectCamera, "direct_camera"},
+	{auth.ErrForbidden, "permission_denied"},
+}
+
+func newRelayError(err error) *RelayError {
+	relayError := &RelayError{Message: err.Error()}
+
+	for _, c := range relayErrorCodes {
+		if errors.Is(err, c.err) {
+			relayError.Code = c.code
+			break
+		}
+	}
+
+	var tpErr *tplink.Error
+	if errors.As(err, &tpErr) {
+		relayError.DeviceCode = tpErr.Code
+		if relayError.Code == "" {
+			relayError.Code = "camera_error"
+		}
+	}
+
+	return relayError
 }
 
 type RelayData struct {
 	UserData           string                     `json:"userData"`
 	SessionDescription *webrtc.SessionDescription `json:"sessionDescription"`
-	Candidate          *webrtc.ICECandidateInit   `json:"candidate"`
-	Open               *struct {
+	// ICEServers come along the offer, with credentials of the embedded
+	// TURN server minted for the session.
+	ICEServers []webrtc.ICEServer       `json:"iceServers,omitempty"`
+	Candidate  *webrtc.ICECandidateInit `json:"candidate"`
+	Open       *struct {
+		// Camera is the ID of a camera of the registry, Address, Username
+		// and Password are only accepted when the server allows direct
+		// cameras.
+		Camera     string `json:"camera"`
 		Address    string `json:"address"`
 		Username   string `json:"username"`
 		Password   string `json:"password"`
 		EnableTalk bool   `json:"enableTalk"`
+		// Resolution is HD for the main stream, VGA or QVGA for the sub
+		// streams.
+		Resolution tplink.Resolution `json:"resolution"`
+		// Channel is the lens of multi lens cameras, missing for the
+		// channel of the registry.
+		Channel *int `json:"channel"`
+		NoAudio bool `json:"noAudio"`
+		// PlaybackStart plays the SD card recordings from this time, to
+		// PlaybackEnd or now, instead of the live preview.
+		PlaybackStart *time.Time `json:"playbackStart"`
+		PlaybackEnd   *time.Time `json:"playbackEnd"`
 	} `json:"open"`
-	Error   *RelayError `json:"error"`
-	Success *bool       `json:"success"`
+	// Search asks for the SD card recordings of a camera, answered with
+	// Recordings.
+	Search *struct {
+		Camera   string    `json:"camera"`
+		Address  string    `json:"address"`
+		Username string    `json:"username"`
+		Password string    `json:"password"`
+		Channel  int       `json:"channel"`
+		Start    time.Time `json:"start"`
+		End      time.Time `json:"end"`
+	} `json:"search"`
+	Recordings []tplink.Recording `json:"recordings,omitempty"`
+	// Playback controls an open playback, and is answered with Position.
+	Playback *struct {
+		Seek   *time.Time `json:"seek"`
+		Paused *bool      `json:"paused"`
+		Speed  float64    `json:"speed"`
+	} `json:"playback"`
+	Position *time.Time  `json:"position,omitempty"`
+	Error    *RelayError `json:"error"`
+	Success  *bool       `json:"success"`
 }
 
 func wrapBool(v bool) *bool {
 	return &v
 }
+
+// ControlMessage is a command sent by clients on the control data channel,
+// answered with a ControlReply of the same ID.
+type ControlMessage struct {
+	ID int `json:"id"`
+	ptz.Command
+}
+
+type ControlReply struct {
+	ID      int             `json:"id"`
+	Success bool            `json:"success"`
+	Presets []tplink.Preset `json:"presets,omitempty"`
+	Error   *RelayError     `json:"error,omitempty"`
+}
@@ -0,0 +1,35 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+)
+
+func TestNewRelayError(t *testing.T) {
+	camera := tplinktest.NewUnstartedServer()
+	camera.TalkErrorCode = -64324
+	camera.Start()
+	defer camera.Close()
+
+	c, err := dialCamera(camera.Addr, camera.Username, camera.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.StartTalk()
+	if err == nil {
+		t.Fatal("talk started in privacy mode")
+	}
+
+	relayError := newRelayError(fmt.Errorf("start talk: %w", err))
+	if relayError.Code != "privacy_mode" || relayError.DeviceCode != -64324 {
+		t.Errorf("got code %q and device code %d", relayError.Code, relayError.DeviceCode)
+	}
+
+	if relayError := newRelayError(errors.New("bad json")); relayError.Code != "" || relayError.DeviceCode != 0 {
+		t.Errorf("plain error got code %q and device code %d", relayError.Code, relayError.DeviceCode)
+	}
+}
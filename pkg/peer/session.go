@@ -1,27 +1,75 @@
 package peer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/playback"
+	"sbipc/pkg/ptz"
+	"sbipc/pkg/registry"
 	"sbipc/pkg/tplink"
+	"sbipc/pkg/turnserver"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
+const (
+	// dialTimeout bounds dialing and handshaking with the camera.
+	dialTimeout = 10 * time.Second
+	// requestTimeout bounds a single request to the camera.
+	requestTimeout = 10 * time.Second
+)
+
+func dialCamera(address, username, password string) (*tplink.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	c, err := tplink.DialContext(ctx, address)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if err := c.HandshakeContext(ctx, username, password); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	return c, nil
+}
+
 type Session struct {
-	tpConnPreview    *tplink.Conn
-	tpConnTalk       *tplink.Conn
-	tpPreviewSession string
-	tpTalkSession    string
-	peerConnection   *webrtc.PeerConnection
-	relay            Relay
-	enableTalk       bool
-	audioTrack       *webrtc.TrackLocalStaticRTP
-	videoTrack       *webrtc.TrackLocalStaticRTP
-	talkChannel      *webrtc.DataChannel
-	processLock      *sync.Mutex
+	hub        *hub.Hub
+	options    *SessionOptions
+	preview    *hub.Subscription
+	tpConnTalk *tplink.Conn
+	// talkLock guards tpTalkSession, which is set once the camera answers
+	talkLock       *sync.Mutex
+	tpTalkSession  string
+	peerConnection *webrtc.PeerConnection
+	relay          Relay
+	enableTalk     bool
+	audioTrack     *webrtc.TrackLocalStaticRTP
+	videoTrack     *webrtc.TrackLocalStaticRTP
+	talkChannel    *webrtc.DataChannel
+	processLock    *sync.Mutex
+	// player replaces preview when playing recordings
+	player *playback.Player
+	// cameraId is the registry ID of the camera, empty for direct cameras
+	cameraId string
+	// controller drives the motor from the control data channel
+	controller     *ptz.Controller
+	controlChannel *webrtc.DataChannel
+	// talkReady is closed once the camera accepted to talk
+	talkReady chan struct{}
+	talkOnce  *sync.Once
+	closed    chan struct{}
+	closeOnce *sync.Once
 }
 
 func (s *Session) onRelayData(data string) {
@@ -38,44 +86,62 @@ func (s *Session) onRelayData(data string) {
 	if err := json.Unmarshal([]byte(data), &relayData); err != nil {
 		errRelayData := RelayData{
 			Success: wrapBool(false),
-			Error: &RelayError{
-				Message: err.Error(),
-			},
+			Error:   newRelayError(err),
 		}
 		text, _ := json.Marshal(errRelayData)
 		s.relay.Send(string(text))
 	}
 
-	if err := s.processRelayData(&relayData); err != nil {
+	reply := RelayData{
+		UserData: relayData.UserData,
+		Success:  wrapBool(true),
+	}
+	if err := s.processRelayData(&relayData, &reply); err != nil {
 		log.Printf("relay data error: %s", err)
 		errRelayData := RelayData{
 			UserData: relayData.UserData,
 			Success:  wrapBool(false),
-			Error: &RelayError{
-				Message: err.Error(),
-			},
+			Error:    newRelayError(err),
 		}
 		text, _ := json.Marshal(errRelayData)
 		s.relay.Send(string(text))
 	} else {
-		errRelayData := RelayData{
-			UserData: relayData.UserData,
-			Success:  wrapBool(true),
-		}
-		text, _ := json.Marshal(errRelayData)
+		text, _ := json.Marshal(reply)
 		s.relay.Send(string(text))
 	}
 }
 
-func (s *Session) processRelayData(relayData *RelayData) error {
+func (s *Session) processRelayData(relayData *RelayData, reply *RelayData) error {
 	if relayData.Open != nil {
 		return s.open(relayData)
 	}
 
-	if s.tpConnPreview == nil || s.peerConnection == nil {
+	if relayData.Search != nil {
+		search := relayData.Search
+		camera, err := s.camera(search.Camera, search.Address, search.Username, search.Password, auth.View)
+		if err != nil {
+			return err
+		}
+		if search.Channel != 0 {
+			camera.Channel = search.Channel
+		}
+
+		recordings, err := playback.Search(camera, search.Start, search.End)
+		if err != nil {
+			return err
+		}
+		reply.Recordings = recordings
+		return nil
+	}
+
+	if s.preview == nil && s.player == nil || s.peerConnection == nil {
 		return fmt.Errorf("not open")
 	}
 
+	if relayData.Playback != nil {
+		return s.controlPlayback(relayData, reply)
+	}
+
 	if relayData.SessionDescription != nil {
 		if err := s.peerConnection.SetRemoteDescription(*relayData.SessionDescription); err != nil {
 			return fmt.Errorf("set remote description: %w", err)
@@ -94,38 +160,42 @@ func (s *Session) processRelayData(relayData *RelayData) error {
 }
 
 func (s *Session) open(relayData *RelayData) error {
-	if s.tpConnPreview != nil {
+	if s.preview != nil || s.player != nil || s.peerConnection != nil {
 		return fmt.Errorf("already open")
 	}
 
-	c, err := tplink.Dial(relayData.Open.Address)
-
+	open := relayData.Open
+	camera, err := s.camera(open.Camera, open.Address, open.Username, open.Password, auth.View)
 	if err != nil {
-		return fmt.Errorf("dial: %w", err)
+		return err
 	}
-
-	if err := c.Handshake(relayData.Open.Username, relayData.Open.Password); err != nil {
-		return fmt.Errorf("handshake: %w", err)
+	if open.EnableTalk {
+		if err := s.options.Identity.Check(open.Camera, auth.Talk); err != nil {
+			return err
+		}
+	}
+	s.cameraId = open.Camera
+	// the stream is up to the viewer
+	if open.Channel != nil {
+		camera.Channel = *open.Channel
+	}
+	if open.Resolution != "" {
+		camera.Resolution = open.Resolution
+	}
+	if open.NoAudio {
+		camera.NoAudio = true
 	}
-	s.tpConnPreview = c
 
-	s.enableTalk = relayData.Open.EnableTalk
+	s.enableTalk = open.EnableTalk
 	if s.enableTalk {
-		c, err := tplink.Dial(relayData.Open.Address)
-
+		c, err := dialCamera(camera.Address, camera.Username, camera.Password)
 		if err != nil {
-			return fmt.Errorf("dial: %w", err)
-		}
-
-		if err := c.Handshake(relayData.Open.Username, relayData.Open.Password); err != nil {
-			return fmt.Errorf("handshake: %w", err)
+			return err
 		}
 		s.tpConnTalk = c
 	}
 
-	peerConnection, err := webrtcApi.Value().NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
-	})
+	peerConnection, err := newPeerConnection()
 	if err != nil {
 		return fmt.Errorf("failed to create peer connection: %w", err)
 	}
@@ -143,12 +213,37 @@ func (s *Session) open(relayData *RelayData) error {
 	}
 	s.audioTrack = audioTrack
 
+	if start := open.PlaybackStart; start != nil {
+		end := time.Now()
+		if open.PlaybackEnd != nil {
+			end = *open.PlaybackEnd
+		}
+
+		player, err := playback.Open(camera, *start, end, s.onPreviewPacket, s.relay.Close)
+		if err != nil {
+			return fmt.Errorf("open playback: %w", err)
+		}
+		s.player = player
+	} else {
+		preview, err := s.hub.Subscribe(camera, s.onPreviewPacket, s.relay.Close)
+		if err != nil {
+			return fmt.Errorf("subscribe preview: %w", err)
+		}
+		s.preview = preview
+	}
+
 	_, err = peerConnection.AddTransceiverFromTrack(videoTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
 	if err != nil {
 		return fmt.Errorf("failed to add video track: %w", err)
 	}
 
-	_, err = peerConnection.AddTransceiverFromTrack(audioTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	// with talk, the browser sends its microphone on the same m-line, usually
+	// as opus, which is transcoded for the camera
+	audioDirection := webrtc.RTPTransceiverDirectionSendonly
+	if s.enableTalk {
+		audioDirection = webrtc.RTPTransceiverDirectionSendrecv
+	}
+	_, err = peerConnection.AddTransceiverFromTrack(audioTrack, webrtc.RTPTransceiverInit{Direction: audioDirection})
 	if err != nil {
 		return fmt.Errorf("failed to add audio track: %w", err)
 	}
@@ -164,6 +259,15 @@ func (s *Session) open(relayData *RelayData) error {
 		}
 	}
 
+	s.controller = ptz.NewController(camera)
+	s.controlChannel, err = peerConnection.CreateDataChannel("control", &webrtc.DataChannelInit{
+		Ordered: wrapBool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add control channel: %w", err)
+	}
+	s.controlChannel.OnMessage(s.onControlMessage)
+
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate != nil {
 			candidateInit := candidate.ToJSON()
@@ -182,67 +286,38 @@ func (s *Session) open(relayData *RelayData) error {
 		}
 	})
 
+	observe := observePeer(peerIPC)
 	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
+		observe(connectionState)
+
 		if connectionState == webrtc.PeerConnectionStateFailed {
 			log.Printf("peer connection state failed")
 			s.relay.Close()
 		} else if connectionState == webrtc.PeerConnectionStateConnected {
 			log.Printf("start streaming")
-			go func() {
-				_, err = s.tpConnPreview.StartPreview()
-				if err != nil {
-					log.Printf("failed to start preview: %s", err)
-					return
-				}
-
-				for {
-					p, err := s.tpConnPreview.Read()
-					if err != nil {
-						log.Printf("read error: %s", err)
-						return
-					}
-
-					if p.IsInterleaved {
-						if p.Channel == 0 {
-							_, err := videoTrack.Write(p.Body)
-							if err != nil {
-								log.Printf("write error: %s", err)
-								return
-							}
-						}
-
-						if p.Channel == 1 {
-							_, err := audioTrack.Write(p.Body)
-							if err != nil {
-								log.Printf("write error: %s", err)
-								return
-							}
-						}
-					}
-				}
-			}()
 
 			if s.enableTalk {
-				go func() {
-					ses, err := s.tpConnTalk.StartTalk()
-					log.Printf("start talking")
-					s.tpTalkSession = ses
-
-					if err != nil {
-						log.Printf("failed to start talk: %s", err)
-						return
-					}
-
-					s.talkChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-						s.tpConnTalk.WriteTalk(msg.Data)
-					})
-				}()
+				go s.startTalk()
 			}
 		}
 	})
 
 	peerConnection.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-		log.Printf("got track %s, it's a %s track with mime %s, ignore it.", tr.ID(), tr.Kind(), tr.Codec().MimeType)
+		if !s.enableTalk || tr.Kind() != webrtc.RTPCodecTypeAudio {
+			log.Printf("got track %s, it's a %s track with mime %s, ignore it.", tr.ID(), tr.Kind(), tr.Codec().MimeType)
+			return
+		}
+
+		select {
+		case <-s.talkReady:
+		case <-s.closed:
+			return
+		}
+
+		log.Printf("talking with %s track", tr.Codec().MimeType)
+		if err := forwardTalk(tr, s.tpConnTalk, s.params().AudioULaw()); err != nil {
+			log.Printf("failed to forward talk: %s", err)
+		}
 	})
 
 	sd, err := peerConnection.CreateOffer(nil)
@@ -256,30 +331,216 @@ func (s *Session) open(relayData *RelayData) error {
 	offerData := &RelayData{
 		SessionDescription: &sd,
 	}
+	if s.options.TURN != nil {
+		offerData.ICEServers = []webrtc.ICEServer{s.options.TURN.Credentials()}
+	}
 	offerDataText, _ := json.Marshal(offerData)
 	s.relay.Send(string(offerDataText))
 
 	return nil
 }
 
+// startTalk starts talking once the peer connection is up, it may go down
+// and up again but talk is started once.
+func (s *Session) startTalk() {
+	s.talkOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		ses, err := s.tpConnTalk.StartTalkContext(ctx)
+		cancel()
+		log.Printf("start talking")
+		s.talkLock.Lock()
+		s.tpTalkSession = ses
+		s.talkLock.Unlock()
+
+		if err != nil {
+			log.Printf("failed to start talk: %s", err)
+			text, _ := json.Marshal(&RelayData{Success: wrapBool(false), Error: newRelayError(fmt.Errorf("start talk: %w", err))})
+			s.relay.Send(string(text))
+			return
+		}
+		close(s.talkReady)
+
+		s.talkChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			s.tpConnTalk.WriteTalk(msg.Data)
+		})
+	})
+}
+
+func (s *Session) onPreviewPacket(p *mtsp.Packet) {
+	// write errors only happen once the peer connection is closed
+	if p.Channel == 0 {
+		s.videoTrack.Write(p.Body)
+	}
+
+	if p.Channel == 1 {
+		s.audioTrack.Write(p.Body)
+	}
+}
+
 func (s *Session) onClose() {
-	if s.peerConnection != nil {
-		s.peerConnection.Close()
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		if s.peerConnection != nil {
+			s.peerConnection.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+
+		if s.tpConnTalk != nil {
+			s.talkLock.Lock()
+			talkSession := s.tpTalkSession
+			s.talkLock.Unlock()
+
+			// talk may not have started, or failed to
+			if talkSession != "" {
+				s.tpConnTalk.StopTalkContext(ctx, talkSession)
+			}
+			s.tpConnTalk.Close()
+		}
+		if s.preview != nil {
+			s.preview.Close()
+		}
+		if s.player != nil {
+			s.player.Close()
+		}
+		if s.controller != nil {
+			s.controller.Close()
+		}
+	})
+}
+
+// onControlMessage sends a command of the control data channel to the
+// camera, and answers with its outcome.
+func (s *Session) onControlMessage(msg webrtc.DataChannelMessage) {
+	var message ControlMessage
+	reply := ControlReply{Success: true}
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		reply.Success = false
+		reply.Error = newRelayError(err)
+	} else if err := s.options.Identity.Check(s.cameraId, auth.PTZ); err != nil {
+		reply.ID = message.ID
+		reply.Success = false
+		reply.Error = newRelayError(err)
+	} else {
+		reply.ID = message.ID
+		presets, err := s.controller.Do(&message.Command)
+		if err != nil {
+			log.Printf("control error: %s", err)
+			reply.Success = false
+			reply.Error = newRelayError(err)
+		}
+		reply.Presets = presets
 	}
-	if s.tpConnTalk != nil {
-		s.tpConnTalk.StopTalk(s.tpTalkSession)
-		s.tpConnTalk.Close()
+
+	text, _ := json.Marshal(&reply)
+	s.controlChannel.SendText(string(text))
+}
+
+// params returns the parameters of the preview or playback being streamed.
+func (s *Session) params() *tplink.PreviewParams {
+	if s.player != nil {
+		return s.player.Params()
 	}
-	if s.tpConnPreview != nil {
-		s.tpConnPreview.StopPreview(s.tpPreviewSession)
-		s.tpConnPreview.Close()
+	return s.preview.Params
+}
+
+// controlPlayback seeks, pauses, resumes or changes the speed of the
+// playback, and replies with its position.
+func (s *Session) controlPlayback(relayData *RelayData, reply *RelayData) error {
+	if s.player == nil {
+		return fmt.Errorf("not playing recordings")
+	}
+	control := relayData.Playback
+
+	if control.Speed != 0 {
+		if err := s.player.SetSpeed(control.Speed); err != nil {
+			return fmt.Errorf("set speed: %w", err)
+		}
+	}
+	if control.Seek != nil {
+		if err := s.player.Seek(*control.Seek); err != nil {
+			return fmt.Errorf("seek: %w", err)
+		}
 	}
+	if control.Paused != nil {
+		var err error
+		if *control.Paused {
+			err = s.player.Pause()
+		} else {
+			err = s.player.Resume()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	position := s.player.Position()
+	reply.Position = &position
+	return nil
 }
 
-func NewSession(relay Relay) *Session {
+// camera returns the camera of a registry ID, or of the address and
+// credentials sent by the client when the server allows direct cameras,
+// after checking the client has a permission on it.
+func (s *Session) camera(id, address, username, password string, permission auth.Permission) (hub.Camera, error) {
+	if err := s.options.Identity.Check(id, permission); err != nil {
+		return hub.Camera{}, err
+	}
+
+	if id != "" {
+		if s.options.Cameras != nil {
+			if camera, ok := s.options.Cameras.Camera(id); ok {
+				return camera, nil
+			}
+		}
+		return hub.Camera{}, fmt.Errorf("camera %s: %w", id, ErrCameraNotFound)
+	}
+
+	if !s.options.AllowDirect {
+		return hub.Camera{}, ErrDirectCamera
+	}
+	if address == "" {
+		return hub.Camera{}, fmt.Errorf("no camera given")
+	}
+
+	return hub.Camera{Address: address, Username: username, Password: password}, nil
+}
+
+// SessionOptions are the cameras a session may open.
+type SessionOptions struct {
+	// Cameras are opened by their ID.
+	Cameras *registry.Registry
+	// AllowDirect accepts cameras sent with their credentials by the
+	// client.
+	AllowDirect bool
+	// Identity is the client, defaults to auth.Anonymous.
+	Identity *auth.Identity
+	// TURN mints credentials for the client to relay through.
+	TURN *turnserver.Server
+}
+
+// NewSession returns a session, options of nil opens direct cameras only.
+func NewSession(relay Relay, h *hub.Hub, options *SessionOptions) *Session {
+	if options == nil {
+		options = &SessionOptions{AllowDirect: true}
+	}
+	if options.Identity == nil {
+		o := *options
+		o.Identity = auth.Anonymous
+		options = &o
+	}
+
 	s := &Session{
+		hub:         h,
+		options:     options,
 		relay:       relay,
 		processLock: &sync.Mutex{},
+		talkLock:    &sync.Mutex{},
+		talkReady:   make(chan struct{}),
+		talkOnce:    &sync.Once{},
+		closed:      make(chan struct{}),
+		closeOnce:   &sync.Once{},
 	}
 
 	relay.OnData(s.onRelayData)
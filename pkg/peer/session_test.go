@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink/tplinktest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRelay hands the messages of a session to the test, and closes like
+// MelodyRelay.
+type fakeRelay struct {
+	sent      chan *RelayData
+	onData    func(data string)
+	onClose   func()
+	closeOnce *sync.Once
+}
+
+func newFakeRelay() *fakeRelay {
+	return &fakeRelay{sent: make(chan *RelayData, 64), closeOnce: &sync.Once{}}
+}
+
+func (r *fakeRelay) Send(data string) error {
+	var relayData RelayData
+	if err := json.Unmarshal([]byte(data), &relayData); err != nil {
+		return err
+	}
+	r.sent <- &relayData
+	return nil
+}
+
+func (r *fakeRelay) OnData(callback func(data string)) { r.onData = callback }
+func (r *fakeRelay) OnClose(callback func())           { r.onClose = callback }
+
+func (r *fakeRelay) Close() {
+	r.closeOnce.Do(r.onClose)
+}
+
+// next returns the next message of the session matching accept.
+func (r *fakeRelay) next(t *testing.T, accept func(d *RelayData) bool) *RelayData {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case d := <-r.sent:
+			if accept(d) {
+				return d
+			}
+		case <-timeout:
+			t.Fatal("no message from the session")
+		}
+	}
+}
+
+// openSession opens a session on a camera, which offered its peer
+// connection.
+func openSession(t *testing.T, camera *tplinktest.Server, h *hub.Hub, relay *fakeRelay, enableTalk bool) *Session {
+	t.Helper()
+
+	s := NewSession(relay, h, nil)
+	relay.onData(fmt.Sprintf(`{"open": {"address": %q, "username": %q, "password": %q, "enableTalk": %v}}`, camera.Addr, camera.Username, camera.Password, enableTalk))
+
+	offer := relay.next(t, func(d *RelayData) bool { return d.SessionDescription != nil || d.Success != nil })
+	if offer.SessionDescription == nil {
+		t.Fatalf("open failed: %+v", offer.Error)
+	}
+	if reply := relay.next(t, func(d *RelayData) bool { return d.Success != nil }); !*reply.Success {
+		t.Fatalf("open failed: %+v", reply.Error)
+	}
+	return s
+}
+
+func TestSessionClosesOnce(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	h := hub.New()
+	defer h.Close()
+
+	relay := newFakeRelay()
+	openSession(t, camera, h, relay, false)
+
+	stream := h.Stream(hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password})
+	if n := stream.Subscribers(); n != 1 {
+		t.Fatalf("got %d subscribers", n)
+	}
+
+	// the relay, the hub and the peer connection may all close the session
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			relay.onClose()
+		}()
+	}
+	wg.Wait()
+
+	if n := stream.Subscribers(); n != 0 {
+		t.Errorf("got %d subscribers once closed", n)
+	}
+}
+
+func TestSessionStartsTalkOnce(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	h := hub.New()
+	defer h.Close()
+
+	relay := newFakeRelay()
+	s := openSession(t, camera, h, relay, true)
+
+	// the peer connection may be connected again after a disconnection
+	for i := 0; i < 3; i++ {
+		go s.startTalk()
+	}
+	select {
+	case <-s.talkReady:
+	case <-time.After(5 * time.Second):
+		t.Fatal("talk not started")
+	}
+	relay.Close()
+
+	if n := camera.Talks(); n != 1 {
+		t.Errorf("%d talks started, want 1", n)
+	}
+}
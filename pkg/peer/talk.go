@@ -0,0 +1,181 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sbipc/pkg/g711"
+	"sbipc/pkg/tplink"
+	"strings"
+
+	"github.com/pion/opus"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+const (
+	// talkSampleRate is the rate of the G.711 audio cameras play.
+	talkSampleRate = 8000
+	// talkFrameSamples is how many samples are sent per talk packet, 20 ms
+	// like the official clients.
+	talkFrameSamples = 160
+	// talkMaxLate is how many packets the jitter buffer waits for a late
+	// one before giving up on it.
+	talkMaxLate = 25
+	// maxOpusFrameSamples is the longest opus packet, 120 ms, at 8 kHz.
+	maxOpusFrameSamples = 960
+)
+
+// talkDecoder turns the samples of a remote audio track into 8 kHz mono
+// linear PCM.
+type talkDecoder interface {
+	decode(sample []byte) ([]int16, error)
+}
+
+type alawDecoder struct{}
+
+func (alawDecoder) decode(sample []byte) ([]int16, error) {
+	return g711.DecodeALaw(sample), nil
+}
+
+type ulawDecoder struct{}
+
+func (ulawDecoder) decode(sample []byte) ([]int16, error) {
+	return g711.DecodeULaw(sample), nil
+}
+
+type opusDecoder struct {
+	decoder opus.Decoder
+	pcm     []int16
+}
+
+func newOpusDecoder() (*opusDecoder, error) {
+	// the decoder resamples to 8 kHz and downmixes to mono itself
+	decoder, err := opus.NewDecoderWithOutput(talkSampleRate, 1)
+	if err != nil {
+		return nil, fmt.Errorf("create opus decoder: %w", err)
+	}
+
+	return &opusDecoder{
+		decoder: decoder,
+		pcm:     make([]int16, maxOpusFrameSamples),
+	}, nil
+}
+
+func (d *opusDecoder) decode(sample []byte) ([]int16, error) {
+	n, err := d.decoder.DecodeToInt16(sample, d.pcm)
+	if err != nil {
+		return nil, fmt.Errorf("decode opus: %w", err)
+	}
+
+	return d.pcm[:n], nil
+}
+
+// g711Depacketizer makes every G.711 packet a sample of its own.
+type g711Depacketizer struct{}
+
+func (g711Depacketizer) Unmarshal(packet []byte) ([]byte, error) {
+	return packet, nil
+}
+
+func (g711Depacketizer) IsPartitionHead(payload []byte) bool {
+	return true
+}
+
+func (g711Depacketizer) IsPartitionTail(marker bool, payload []byte) bool {
+	return true
+}
+
+// newTalkDecoder returns the decoder and the RTP depacketizer of a track
+// codec.
+func newTalkDecoder(codec webrtc.RTPCodecParameters) (talkDecoder, rtp.Depacketizer, error) {
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypePCMA):
+		return alawDecoder{}, g711Depacketizer{}, nil
+	case strings.ToLower(webrtc.MimeTypePCMU):
+		return ulawDecoder{}, g711Depacketizer{}, nil
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		d, err := newOpusDecoder()
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, &codecs.OpusPacket{}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported talk codec: %s", codec.MimeType)
+}
+
+// talkWriter encodes PCM to the G.711 law of the camera, and writes it in
+// frames of talkFrameSamples whatever the size of the decoded samples.
+type talkWriter struct {
+	conn    *tplink.Conn
+	ulaw    bool
+	pending []byte
+}
+
+func (w *talkWriter) write(pcm []int16) error {
+	if w.ulaw {
+		w.pending = append(w.pending, g711.EncodeULaw(pcm)...)
+	} else {
+		w.pending = append(w.pending, g711.EncodeALaw(pcm)...)
+	}
+
+	for len(w.pending) >= talkFrameSamples {
+		if err := w.conn.WriteTalk(w.pending[:talkFrameSamples]); err != nil {
+			return err
+		}
+		w.pending = w.pending[talkFrameSamples:]
+	}
+
+	// keep the leftover from pinning the whole buffer
+	w.pending = append([]byte{}, w.pending...)
+
+	return nil
+}
+
+// forwardTalk plays a remote audio track through the camera speaker, until
+// the track ends. The camera is fed µ-law when ulaw is set, A-law otherwise.
+func forwardTalk(track *webrtc.TrackRemote, conn *tplink.Conn, ulaw bool) error {
+	codec := track.Codec()
+	if codec.MimeType == "" && track.PayloadType() == 0 {
+		// the static payload type of PCMU is not always resolved
+		codec.MimeType = webrtc.MimeTypePCMU
+		codec.ClockRate = talkSampleRate
+	}
+
+	decoder, depacketizer, err := newTalkDecoder(codec)
+	if err != nil {
+		return err
+	}
+
+	writer := &talkWriter{conn: conn, ulaw: ulaw}
+
+	// the sample builder reorders packets and drops the ones too late
+	builder := samplebuilder.New(talkMaxLate, depacketizer, codec.ClockRate)
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read rtp: %w", err)
+		}
+
+		builder.Push(packet)
+
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			pcm, err := decoder.decode(sample.Data)
+			if err != nil {
+				// a corrupted packet only costs a frame
+				continue
+			}
+
+			if err := writer.write(pcm); err != nil {
+				return fmt.Errorf("write talk: %w", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package peer
+
+import (
+	"bytes"
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// opusSilence is a 20 ms opus frame decoding to silence.
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+func TestTalkDecoders(t *testing.T) {
+	for _, test := range []struct {
+		mimeType string
+		sample   []byte
+		want     []int16
+	}{
+		{webrtc.MimeTypePCMA, []byte{0xd5, 0x55}, []int16{8, -8}},
+		{webrtc.MimeTypePCMU, []byte{0xff, 0x7f}, []int16{0, 0}},
+		// decoded at 8 kHz, 20 ms are 160 samples
+		{webrtc.MimeTypeOpus, opusSilence, make([]int16, 160)},
+	} {
+		decoder, _, err := newTalkDecoder(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: test.mimeType}})
+		if err != nil {
+			t.Fatalf("%s: %s", test.mimeType, err)
+		}
+
+		pcm, err := decoder.decode(test.sample)
+		if err != nil {
+			t.Fatalf("%s: %s", test.mimeType, err)
+		}
+		if len(pcm) != len(test.want) {
+			t.Fatalf("%s: got %d samples, want %d", test.mimeType, len(pcm), len(test.want))
+		}
+		for i := range pcm {
+			if pcm[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.mimeType, pcm[:min(len(pcm), 4)], test.want[:min(len(test.want), 4)])
+				break
+			}
+		}
+	}
+}
+
+func TestTalkDecoderUnsupported(t *testing.T) {
+	if _, _, err := newTalkDecoder(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722}}); err == nil {
+		t.Error("got a decoder for G.722")
+	}
+}
+
+// talkingCamera returns a connection talking to a fake camera.
+func talkingCamera(t *testing.T) (*tplinktest.Server, *tplink.Conn) {
+	t.Helper()
+
+	camera := tplinktest.NewServer()
+	t.Cleanup(camera.Close)
+
+	c, err := dialCamera(camera.Addr, camera.Username, camera.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if _, err := c.StartTalk(); err != nil {
+		t.Fatal(err)
+	}
+
+	return camera, c
+}
+
+// waitTalkFrames waits for n talk frames and returns their payloads.
+func waitTalkFrames(t *testing.T, camera *tplinktest.Server, n int) [][]byte {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(camera.TalkFrames()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("camera got %d talk frames, want %d", len(camera.TalkFrames()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var payloads [][]byte
+	for _, frame := range camera.TalkFrames() {
+		payloads = append(payloads, frame[12:])
+	}
+	return payloads
+}
+
+func TestTalkWriterFrames(t *testing.T) {
+	for _, test := range []struct {
+		ulaw    bool
+		silence byte
+	}{{false, 0xd5}, {true, 0xff}} {
+		camera, c := talkingCamera(t)
+		w := &talkWriter{conn: c, ulaw: test.ulaw}
+
+		// 120 ms opus frames and 10 ms G.711 ones are both sent by 20 ms
+		for _, samples := range []int{960, 80, 80} {
+			if err := w.write(make([]int16, samples)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		payloads := waitTalkFrames(t, camera, 7)
+		for i, payload := range payloads {
+			if !bytes.Equal(payload, bytes.Repeat([]byte{test.silence}, talkFrameSamples)) {
+				t.Errorf("ulaw %v: frame %d has %d bytes %x", test.ulaw, i, len(payload), payload[:min(len(payload), 4)])
+			}
+		}
+		if len(payloads) != 7 || len(w.pending) != 0 {
+			t.Errorf("ulaw %v: got %d frames and %d pending bytes, want 7 and 0", test.ulaw, len(payloads), len(w.pending))
+		}
+	}
+}
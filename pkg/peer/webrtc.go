@@ -20,8 +20,26 @@ var webrtcApi = lazy.Of[*webrtc.API]{
 			log.Fatalf("failed to register default interceptors: %s", err)
 		}
 
-		api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry))
+		// later ICE configurations would not apply
+		iceLock.Lock()
+		iceConfigured = true
+		engine := settingEngine
+		iceLock.Unlock()
+
+		api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry), webrtc.WithSettingEngine(engine))
 
 		return api
 	},
 }
+
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	api := webrtcApi.Value()
+
+	iceLock.Lock()
+	servers := iceServers
+	iceLock.Unlock()
+
+	return api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: servers,
+	})
+}
@@ -0,0 +1,388 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// gatherTimeout bounds ICE gathering before answering an offer, the answer
+// is sent with the candidates gathered so far.
+const gatherTimeout = 5 * time.Second
+
+const maxOfferSize = 64 * 1024
+
+// WHEPServer implements the WebRTC-HTTP Egress Protocol, so standard players
+// can pull a camera with POST /{camera}, then trickle ICE candidates with
+// PATCH /{camera}/{session} and stop with DELETE /{camera}/{session}.
+type WHEPServer struct {
+	hub      *hub.Hub
+	lock     *sync.Mutex
+	cameras  map[string]hub.Camera
+	sessions map[string]*whepSession
+}
+
+func NewWHEPServer(h *hub.Hub) *WHEPServer {
+	return &WHEPServer{
+		hub:      h,
+		lock:     &sync.Mutex{},
+		cameras:  map[string]hub.Camera{},
+		sessions: map[string]*whepSession{},
+	}
+}
+
+// AddCamera publishes a camera at /name.
+func (s *WHEPServer) AddCamera(name string, camera hub.Camera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cameras[name] = camera
+}
+
+// Close ends every session.
+func (s *WHEPServer) Close() {
+	s.lock.Lock()
+	sessions := make([]*whepSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.lock.Unlock()
+
+	for _, session := range sessions {
+		session.close()
+	}
+}
+
+func (s *WHEPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Accept-Patch")
+
+	name, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && id == "":
+		s.handleOffer(w, r, name)
+	case r.Method == http.MethodPatch && id != "":
+		s.handleTrickle(w, r, name, id)
+	case r.Method == http.MethodDelete && id != "":
+		session := s.session(name, id)
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		session.close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *WHEPServer) session(name, id string) *whepSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.name != name {
+		return nil
+	}
+	return session
+}
+
+func (s *WHEPServer) handleOffer(w http.ResponseWriter, r *http.Request, name string) {
+	s.lock.Lock()
+	camera, ok := s.cameras[name]
+	s.lock.Unlock()
+	if !ok {
+		http.Error(w, "camera not found", http.StatusNotFound)
+		return
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	session, answer, err := s.newSession(name, camera, offer)
+	if err != nil {
+		log.Printf("whep %s: %s", name, err)
+		http.Error(w, err.Error(), offerStatus(err))
+		return
+	}
+
+	writeAnswer(w, name, session.id, answer)
+}
+
+func (s *WHEPServer) handleTrickle(w http.ResponseWriter, r *http.Request, name, id string) {
+	session := s.session(name, id)
+	if session == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	trickle(w, r, session.peerConnection)
+}
+
+// trickle adds the ICE candidates of a PATCH request to a peer connection.
+func trickle(w http.ResponseWriter, r *http.Request, peerConnection *webrtc.PeerConnection) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/trickle-ice-sdpfrag") {
+		http.Error(w, "expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	fragment, err := io.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "failed to read candidates", http.StatusBadRequest)
+		return
+	}
+
+	candidates, restart := parseSdpFragment(string(fragment))
+	if restart {
+		// ICE restarts would need a new answer, players fall back to a new
+		// session
+		http.Error(w, "ice restart is not supported", http.StatusUnprocessableEntity)
+		return
+	}
+
+	for _, candidate := range candidates {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			http.Error(w, fmt.Sprintf("add ice candidate: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readOffer reads the SDP offer of a POST request.
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return "", false
+	}
+
+	return string(offer), true
+}
+
+// errBadOffer is the error of offers the peer connection refused.
+var errBadOffer = errors.New("invalid offer")
+
+// offerStatus returns the HTTP status of a failed offer, which fails because
+// of the offer itself or, most often, because of the camera.
+func offerStatus(err error) int {
+	switch {
+	case errors.Is(err, errBadOffer):
+		return http.StatusBadRequest
+	case errors.Is(err, tplink.ErrBusy):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeAnswer answers a POST request with the SDP answer of a new session.
+func writeAnswer(w http.ResponseWriter, name, id, answer string) {
+	// relative to the POST URL, so it works behind any prefix
+	w.Header().Set("Location", name+"/"+id)
+	w.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(answer))
+}
+
+// answer returns the local answer with the candidates gathered within
+// gatherTimeout, as WHEP and WHIP clients expect them in the answer.
+func answer(peerConnection *webrtc.PeerConnection) (string, error) {
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+	}
+
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// parseSdpFragment returns the candidates of a trickle ICE SDP fragment
+// (RFC 8840), and whether it asks for an ICE restart.
+func parseSdpFragment(fragment string) ([]webrtc.ICECandidateInit, bool) {
+	var candidates []webrtc.ICECandidateInit
+	var mid *string
+	var lineIndex *uint16
+	var index uint16
+	restart := false
+
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(line, "m="):
+			i := index
+			lineIndex = &i
+			index++
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			// a new ufrag is how an ICE restart is asked
+			restart = true
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: lineIndex,
+			})
+		}
+	}
+
+	return candidates, restart
+}
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type whepSession struct {
+	id             string
+	name           string
+	server         *WHEPServer
+	peerConnection *webrtc.PeerConnection
+	preview        *hub.Subscription
+	videoTrack     *webrtc.TrackLocalStaticRTP
+	audioTrack     *webrtc.TrackLocalStaticRTP
+	closeOnce      *sync.Once
+}
+
+func (s *WHEPServer) newSession(name string, camera hub.Camera, offer string) (*whepSession, string, error) {
+	session := &whepSession{
+		id:        newSessionId(),
+		name:      name,
+		server:    s,
+		closeOnce: &sync.Once{},
+	}
+
+	answer, err := session.open(camera, offer)
+	if err != nil {
+		session.close()
+		return nil, "", err
+	}
+
+	s.lock.Lock()
+	s.sessions[session.id] = session
+	s.lock.Unlock()
+
+	log.Printf("whep %s: session %s started", name, session.id)
+
+	return session, answer, nil
+}
+
+func (session *whepSession) open(camera hub.Camera, offer string) (string, error) {
+	peerConnection, err := newPeerConnection()
+	if err != nil {
+		return "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	session.peerConnection = peerConnection
+
+	session.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "preview-video")
+	if err != nil {
+		return "", fmt.Errorf("failed to create video track: %w", err)
+	}
+
+	session.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA}, "audio", "preview-audio")
+	if err != nil {
+		return "", fmt.Errorf("failed to create audio track: %w", err)
+	}
+
+	observe := observePeer(peerWHEP)
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		observe(state)
+
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			session.close()
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("%w: %w", errBadOffer, err)
+	}
+
+	// the tracks take the transceivers the player offered to receive on
+	if _, err := peerConnection.AddTrack(session.videoTrack); err != nil {
+		return "", fmt.Errorf("failed to add video track: %w", err)
+	}
+	if _, err := peerConnection.AddTrack(session.audioTrack); err != nil {
+		return "", fmt.Errorf("failed to add audio track: %w", err)
+	}
+
+	preview, err := session.server.hub.Subscribe(camera, session.onPreviewPacket, func() {
+		go session.close()
+	})
+	if err != nil {
+		return "", fmt.Errorf("subscribe preview: %w", err)
+	}
+	session.preview = preview
+
+	return answer(peerConnection)
+}
+
+func (session *whepSession) onPreviewPacket(p *mtsp.Packet) {
+	// write errors only happen once the peer connection is closed
+	if p.Channel == 0 {
+		session.videoTrack.Write(p.Body)
+	}
+
+	if p.Channel == 1 {
+		session.audioTrack.Write(p.Body)
+	}
+}
+
+func (session *whepSession) close() {
+	session.closeOnce.Do(func() {
+		session.server.lock.Lock()
+		delete(session.server.sessions, session.id)
+		session.server.lock.Unlock()
+
+		if session.preview != nil {
+			session.preview.Close()
+		}
+		if session.peerConnection != nil {
+			session.peerConnection.Close()
+		}
+
+		log.Printf("whep %s: session %s closed", session.name, session.id)
+	})
+}
@@ -0,0 +1,202 @@
+package peer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink/tplinktest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestMain(m *testing.M) {
+	// host candidates only, there is no STUN server to reach
+	if err := ConfigureICE(&ICEConfig{}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestParseSdpFragment(t *testing.T) {
+	candidates, restart := parseSdpFragment("a=ice-options:trickle\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\na=candidate:2 1 udp 2130706431 192.0.2.1 50002 typ host\r\n")
+
+	if restart {
+		t.Error("got an ice restart")
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("got %d candidates, want 2", len(candidates))
+	}
+	if c := candidates[1]; *c.SDPMid != "1" || *c.SDPMLineIndex != 1 || !strings.HasPrefix(c.Candidate, "candidate:2 ") {
+		t.Errorf("got candidate %s of mid %s, line %d", c.Candidate, *c.SDPMid, *c.SDPMLineIndex)
+	}
+
+	if _, restart := parseSdpFragment("a=ice-ufrag:abcd\r\na=ice-pwd:efgh\r\n"); !restart {
+		t.Error("ice restart not detected")
+	}
+}
+
+func newWHEPTestServer(t *testing.T, camera *tplinktest.Server, password string) *httptest.Server {
+	t.Helper()
+
+	h := hub.New()
+	t.Cleanup(h.Close)
+
+	s := NewWHEPServer(h)
+	s.AddCamera("door", hub.Camera{Address: camera.Addr, Username: camera.Username, Password: password})
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newPlayer returns a peer connection receiving video and audio, and its
+// offer with every candidate. It only gathers host candidates, as there is
+// no STUN server to reach.
+func newPlayer(t *testing.T) (*webrtc.PeerConnection, string) {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	return pc, pc.LocalDescription().SDP
+}
+
+func post(t *testing.T, url, contentType, body string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := http.Post(url, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestWHEP(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	server := newWHEPTestServer(t, camera, camera.Password)
+	pc, offer := newPlayer(t)
+
+	received := make(chan webrtc.RTPCodecType, 2)
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			received <- track.Kind()
+		}
+	})
+
+	resp, answer := post(t, server.URL+"/door", "application/sdp", offer)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d: %s", resp.StatusCode, answer)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "door/") {
+		t.Errorf("got location %q", location)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := map[webrtc.RTPCodecType]bool{}
+	for len(kinds) < 2 {
+		select {
+		case kind := <-received:
+			kinds[kind] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got media of %v only", kinds)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/"+location, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d deleting the session", resp.StatusCode)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %d deleting the session twice", resp.StatusCode)
+	}
+}
+
+func TestWHEPErrors(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	server := newWHEPTestServer(t, camera, camera.Password)
+	_, offer := newPlayer(t)
+
+	for _, test := range []struct {
+		url, contentType, body string
+		status                 int
+	}{
+		{server.URL + "/garden", "application/sdp", offer, http.StatusNotFound},
+		{server.URL + "/door", "text/plain", offer, http.StatusUnsupportedMediaType},
+		{server.URL + "/door", "application/sdp", "not an offer", http.StatusBadRequest},
+	} {
+		if resp, body := post(t, test.url, test.contentType, test.body); resp.StatusCode != test.status {
+			t.Errorf("%s as %s: got %d, want %d: %s", test.url, test.contentType, resp.StatusCode, test.status, body)
+		}
+	}
+	if n := camera.Previews(); n != 0 {
+		t.Errorf("%d previews started for refused offers", n)
+	}
+}
+
+func TestWHEPCameraErrors(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	_, offer := newPlayer(t)
+
+	// a camera refusing the credentials fails the gateway
+	server := newWHEPTestServer(t, camera, "wrong")
+	if resp, body := post(t, server.URL+"/door", "application/sdp", offer); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("wrong password: got %d, want %d: %s", resp.StatusCode, http.StatusBadGateway, body)
+	}
+
+	// a camera busy with other previews is unavailable for now
+	camera.PreviewParams.ErrorCode = -64303
+	server = newWHEPTestServer(t, camera, camera.Password)
+	if resp, body := post(t, server.URL+"/door", "application/sdp", offer); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("busy camera: got %d, want %d: %s", resp.StatusCode, http.StatusServiceUnavailable, body)
+	}
+}
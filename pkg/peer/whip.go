@@ -0,0 +1,242 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// WHIPServer implements the WebRTC-HTTP Ingestion Protocol for talk, so
+// browsers and OBS can publish an Opus or G.711 audio track to POST
+// /{camera}, played through the camera speaker until DELETE
+// /{camera}/{session}.
+type WHIPServer struct {
+	lock     *sync.Mutex
+	cameras  map[string]hub.Camera
+	sessions map[string]*whipSession
+}
+
+func NewWHIPServer() *WHIPServer {
+	return &WHIPServer{
+		lock:     &sync.Mutex{},
+		cameras:  map[string]hub.Camera{},
+		sessions: map[string]*whipSession{},
+	}
+}
+
+// AddCamera publishes the speaker of a camera at /name.
+func (s *WHIPServer) AddCamera(name string, camera hub.Camera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cameras[name] = camera
+}
+
+// Close ends every session.
+func (s *WHIPServer) Close() {
+	s.lock.Lock()
+	sessions := make([]*whipSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.lock.Unlock()
+
+	for _, session := range sessions {
+		session.close()
+	}
+}
+
+func (s *WHIPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Accept-Patch")
+
+	name, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && id == "":
+		s.handleOffer(w, r, name)
+	case r.Method == http.MethodPatch && id != "":
+		session := s.session(name, id)
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		trickle(w, r, session.peerConnection)
+	case r.Method == http.MethodDelete && id != "":
+		session := s.session(name, id)
+		if session == nil {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		session.close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *WHIPServer) session(name, id string) *whipSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.name != name {
+		return nil
+	}
+	return session
+}
+
+func (s *WHIPServer) handleOffer(w http.ResponseWriter, r *http.Request, name string) {
+	s.lock.Lock()
+	camera, ok := s.cameras[name]
+	s.lock.Unlock()
+	if !ok {
+		http.Error(w, "camera not found", http.StatusNotFound)
+		return
+	}
+
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+
+	session := &whipSession{
+		id:        newSessionId(),
+		name:      name,
+		server:    s,
+		closeOnce: &sync.Once{},
+	}
+
+	answer, err := session.open(camera, offer)
+	if err != nil {
+		session.close()
+		log.Printf("whip %s: %s", name, err)
+		http.Error(w, err.Error(), offerStatus(err))
+		return
+	}
+
+	s.lock.Lock()
+	s.sessions[session.id] = session
+	s.lock.Unlock()
+
+	log.Printf("whip %s: session %s started", name, session.id)
+
+	writeAnswer(w, name, session.id, answer)
+}
+
+type whipSession struct {
+	id             string
+	name           string
+	server         *WHIPServer
+	peerConnection *webrtc.PeerConnection
+	tpConn         *tplink.Conn
+	tpTalkSession  string
+	// ulaw is the law of the camera audio, which the speaker expects too
+	ulaw      bool
+	closeOnce *sync.Once
+}
+
+func (session *whipSession) open(camera hub.Camera, offer string) (string, error) {
+	c, err := dialCamera(camera.Address, camera.Username, camera.Password)
+	if err != nil {
+		return "", err
+	}
+	session.tpConn = c
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	session.ulaw, err = audioULaw(ctx, c)
+	if err != nil {
+		return "", err
+	}
+
+	session.tpTalkSession, err = c.StartTalkContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("start talk: %w", err)
+	}
+
+	peerConnection, err := newPeerConnection()
+	if err != nil {
+		return "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	session.peerConnection = peerConnection
+
+	observe := observePeer(peerWHIP)
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		observe(state)
+
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			session.close()
+		}
+	})
+
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			log.Printf("whip %s: ignoring %s track", session.name, track.Kind())
+			return
+		}
+
+		log.Printf("whip %s: talking with %s", session.name, track.Codec().MimeType)
+		if err := forwardTalk(track, session.tpConn, session.ulaw); err != nil {
+			log.Printf("whip %s: %s", session.name, err)
+			session.close()
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("%w: %w", errBadOffer, err)
+	}
+
+	return answer(peerConnection)
+}
+
+// audioULaw reports whether the camera audio is µ-law, from the parameters
+// of a preview stopped right away, as talk requests do not tell.
+func audioULaw(ctx context.Context, c *tplink.Conn) (bool, error) {
+	params, err := c.StartPreviewContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("start preview: %w", err)
+	}
+	if err := c.StopPreviewContext(ctx, params.SessionID); err != nil {
+		return false, fmt.Errorf("stop preview: %w", err)
+	}
+	return params.AudioULaw(), nil
+}
+
+func (session *whipSession) close() {
+	session.closeOnce.Do(func() {
+		session.server.lock.Lock()
+		delete(session.server.sessions, session.id)
+		session.server.lock.Unlock()
+
+		if session.peerConnection != nil {
+			session.peerConnection.Close()
+		}
+
+		if session.tpConn != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			defer cancel()
+
+			if session.tpTalkSession != "" {
+				session.tpConn.StopTalkContext(ctx, session.tpTalkSession)
+			}
+			session.tpConn.Close()
+		}
+
+		log.Printf("whip %s: session %s closed", session.name, session.id)
+	})
+}
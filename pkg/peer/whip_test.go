@@ -0,0 +1,114 @@
+package peer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+func newWHIPTestServer(t *testing.T, camera *tplinktest.Server) *httptest.Server {
+	t.Helper()
+
+	s := NewWHIPServer()
+	s.AddCamera("door", hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password})
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newPublisher returns a peer connection sending an opus track, and its
+// offer with every candidate.
+func newPublisher(t *testing.T) (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample, string) {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "talk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	return pc, track, pc.LocalDescription().SDP
+}
+
+// publish talks Opus silence through a camera until it got a few frames,
+// and returns the first one.
+func publish(t *testing.T, camera *tplinktest.Server) []byte {
+	t.Helper()
+
+	server := newWHIPTestServer(t, camera)
+	pc, track, offer := newPublisher(t)
+
+	resp, answer := post(t, server.URL+"/door", "application/sdp", offer)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d: %s", resp.StatusCode, answer)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(camera.TalkFrames()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("camera got %d talk frames", len(camera.TalkFrames()))
+		}
+		if err := track.WriteSample(media.Sample{Data: opusSilence, Duration: 20 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return camera.TalkFrames()[0]
+}
+
+func TestWHIPTranscodesOpus(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	// 20 ms of A-law silence behind the RTP header
+	frame := publish(t, camera)
+	if payload := frame[12:]; !bytes.Equal(payload, bytes.Repeat([]byte{0xd5}, 160)) {
+		t.Errorf("camera got %d bytes %x, want 160 bytes of A-law silence", len(payload), payload[:min(len(payload), 4)])
+	}
+	if n := camera.Talks(); n != 1 {
+		t.Errorf("%d talks started, want 1", n)
+	}
+}
+
+func TestWHIPTalksInCameraLaw(t *testing.T) {
+	camera := tplinktest.NewUnstartedServer()
+	camera.PreviewParams.AvConfig[0].AudioCodec = "PCMU"
+	camera.Start()
+	defer camera.Close()
+
+	// 20 ms of µ-law silence behind the RTP header
+	frame := publish(t, camera)
+	if payload := frame[12:]; !bytes.Equal(payload, bytes.Repeat([]byte{0xff}, 160)) {
+		t.Errorf("camera got %d bytes %x, want 160 bytes of µ-law silence", len(payload), payload[:min(len(payload), 4)])
+	}
+}
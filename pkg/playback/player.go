@@ -0,0 +1,372 @@
+// Package playback streams the SD card recordings of cameras as the same
+// interleaved packets as previews, with seeking, pausing and speed changes.
+package playback
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink"
+	"sync"
+	"time"
+)
+
+// requestTimeout bounds dialing the camera and each request sent to it.
+const requestTimeout = 10 * time.Second
+
+// readTimeout is how long the camera may stay silent before the playback is
+// taken for over, cameras stop sending at the end of the recordings.
+const readTimeout = 10 * time.Second
+
+var errClosed = errors.New("playback closed")
+
+// Search returns the recordings of a camera overlapping start to end.
+func Search(camera hub.Camera, start, end time.Time) ([]tplink.Recording, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	c, err := dial(ctx, camera)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	recordings, err := c.SearchRecordingsContext(ctx, camera.Channel, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("search recordings: %w", err)
+	}
+
+	return recordings, nil
+}
+
+func dial(ctx context.Context, camera hub.Camera) (*tplink.Conn, error) {
+	c, err := tplink.DialContext(ctx, camera.Address)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if err := c.HandshakeContext(ctx, camera.Username, camera.Password); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	return c, nil
+}
+
+// Player plays the recordings of a camera. Seeking, pausing and changing
+// speed restart the playback on the camera, and the RTP sequence numbers and
+// timestamps are rewritten so receivers see a single continuous stream.
+type Player struct {
+	camera   hub.Camera
+	end      time.Time
+	onPacket func(p *mtsp.Packet)
+	onClose  func()
+
+	lock       *sync.Mutex
+	params     *tplink.PreviewParams
+	sequencers map[int]*hub.Sequencer
+	speed      float64
+	paused     bool
+	closed     bool
+	closeOnce  *sync.Once
+	// stopping tracks the upstreams being stopped in the background
+	stopping *sync.WaitGroup
+	// conn, sessionId and stopped are the current upstream, stopped is nil
+	// while paused
+	conn      *tplink.Conn
+	sessionId string
+	stopped   chan struct{}
+	// position is the recording time at the video timestamp baseTs
+	position time.Time
+	baseTs   uint32
+	lastTs   uint32
+	hasBase  bool
+}
+
+// Open starts playing the recordings of a camera from start to end.
+// onPacket is called like for hub subscriptions, and must not block.
+// onClose is called when the playback stops by itself, at the end of the
+// recordings, when the camera fails or when seeking, resuming or changing
+// speed cannot restart it.
+func Open(camera hub.Camera, start, end time.Time, onPacket func(p *mtsp.Packet), onClose func()) (*Player, error) {
+	p := &Player{
+		camera:    camera,
+		end:       end,
+		onPacket:  onPacket,
+		onClose:   onClose,
+		lock:      &sync.Mutex{},
+		speed:     1,
+		closeOnce: &sync.Once{},
+		stopping:  &sync.WaitGroup{},
+		position:  start,
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+
+	p.sequencers = map[int]*hub.Sequencer{
+		0: hub.NewSequencer(90000),
+		1: hub.NewSequencer(p.params.AudioClockRate()),
+	}
+
+	return p, nil
+}
+
+// Params returns the parameters the camera answered the playback with.
+func (p *Player) Params() *tplink.PreviewParams {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.params
+}
+
+// Position returns the recording time being played.
+func (p *Player) Position() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.currentPosition()
+}
+
+// Seek continues the playback from t.
+func (p *Player) Seek(t time.Time) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errClosed
+	}
+	if !t.Before(p.end) {
+		return fmt.Errorf("seek past the end of the playback")
+	}
+
+	p.stop()
+	p.position = t
+	p.hasBase = false
+	if p.paused {
+		return nil
+	}
+	if err := p.start(); err != nil {
+		p.fail()
+		return err
+	}
+	return nil
+}
+
+// Pause stops the playback on the camera, until Resume.
+func (p *Player) Pause() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errClosed
+	}
+
+	p.stop()
+	p.paused = true
+	return nil
+}
+
+// Resume continues a paused playback.
+func (p *Player) Resume() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errClosed
+	}
+	if !p.paused {
+		return nil
+	}
+
+	p.paused = false
+	if err := p.start(); err != nil {
+		p.fail()
+		return err
+	}
+	return nil
+}
+
+// SetSpeed changes the playback speed, see tplink.PlaybackOptions.
+func (p *Player) SetSpeed(speed float64) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return errClosed
+	}
+	if speed == p.speed {
+		return nil
+	}
+
+	previous := p.speed
+	p.speed = speed
+	if p.paused {
+		return nil
+	}
+
+	p.stop()
+	if err := p.start(); err != nil {
+		// carry on at the previous speed
+		p.speed = previous
+		if restartErr := p.start(); restartErr != nil {
+			p.fail()
+			return errors.Join(err, restartErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Close stops the playback, waiting for the camera to be told.
+func (p *Player) Close() {
+	p.closeOnce.Do(func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		p.stop()
+		p.closed = true
+	})
+
+	p.stopping.Wait()
+}
+
+// fail closes a playback which could not be restarted, like when the camera
+// fails. The lock must be held.
+func (p *Player) fail() {
+	p.closed = true
+	if p.onClose != nil {
+		go p.onClose()
+	}
+}
+
+func (p *Player) currentPosition() time.Time {
+	if !p.hasBase {
+		return p.position
+	}
+	return p.position.Add(time.Duration(p.lastTs-p.baseTs) * time.Second / 90000)
+}
+
+// start starts the playback on the camera from the current position. The
+// lock must be held.
+func (p *Player) start() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	c, err := dial(ctx, p.camera)
+	if err != nil {
+		return err
+	}
+
+	params, err := c.StartPlaybackContext(ctx, &tplink.PlaybackOptions{
+		Channel: p.camera.Channel,
+		Start:   p.position,
+		End:     p.end,
+		Speed:   p.speed,
+	})
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("start playback: %w", err)
+	}
+
+	log.Printf("started playback of %s at %s", p.camera.Address, p.position.Format(time.RFC3339))
+
+	if p.params == nil {
+		p.params = params
+	}
+	p.conn = c
+	p.sessionId = params.SessionID
+	p.stopped = make(chan struct{})
+
+	go p.pump(c, p.stopped)
+
+	return nil
+}
+
+// stop stops the playback on the camera, keeping the position. The lock
+// must be held. The camera is told in the background, as pump needs the
+// lock to read on until the answer comes.
+func (p *Player) stop() {
+	if p.stopped == nil {
+		return
+	}
+
+	p.position = p.currentPosition()
+	p.hasBase = false
+
+	close(p.stopped)
+	p.stopped = nil
+
+	c, sessionId := p.conn, p.sessionId
+	p.conn = nil
+
+	p.stopping.Add(1)
+	go func() {
+		defer p.stopping.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+
+		c.StopPreviewContext(ctx, sessionId)
+		c.Close()
+	}()
+
+	for _, q := range p.sequencers {
+		q.Reset()
+	}
+}
+
+// pump forwards the packets of an upstream, until it is stopped or ends.
+func (p *Player) pump(c *tplink.Conn, stopped chan struct{}) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+		packet, err := c.ReadContext(ctx)
+		cancel()
+
+		select {
+		case <-stopped:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("playback of %s ended: %s", p.camera.Address, err)
+			p.Close()
+			if p.onClose != nil {
+				p.onClose()
+			}
+			return
+		}
+
+		if !packet.IsInterleaved || p.camera.NoAudio && packet.Channel == 1 {
+			continue
+		}
+
+		p.lock.Lock()
+		if p.stopped != stopped {
+			p.lock.Unlock()
+			return
+		}
+
+		if packet.Channel == 0 && len(packet.Body) >= 12 {
+			p.lastTs = binary.BigEndian.Uint32(packet.Body[4:])
+			if !p.hasBase {
+				p.baseTs = p.lastTs
+				p.hasBase = true
+			}
+		}
+		if q, ok := p.sequencers[packet.Channel]; ok {
+			q.Rewrite(packet.Body)
+		}
+		p.onPacket(packet)
+		p.lock.Unlock()
+	}
+}
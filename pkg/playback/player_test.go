@@ -0,0 +1,217 @@
+package playback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/metrics"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder collects the video sequence numbers a player delivers.
+type recorder struct {
+	lock      *sync.Mutex
+	sequences []uint16
+	closed    chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{lock: &sync.Mutex{}, closed: make(chan struct{})}
+}
+
+func (r *recorder) onPacket(p *mtsp.Packet) {
+	if p.Channel != 0 {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.sequences = append(r.sequences, binary.BigEndian.Uint16(p.Body[2:]))
+}
+
+func (r *recorder) onClose() {
+	close(r.closed)
+}
+
+func (r *recorder) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sequences)
+}
+
+func (r *recorder) waitFor(t *testing.T, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d packets, want %d", r.count(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func openPlayer(t *testing.T) (*tplinktest.Server, *Player, *recorder) {
+	t.Helper()
+
+	camera := tplinktest.NewServer()
+	t.Cleanup(camera.Close)
+
+	r := newRecorder()
+	start := time.Now().Add(-time.Hour)
+	p, err := Open(hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password}, start, start.Add(30*time.Minute), r.onPacket, r.onClose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	return camera, p, r
+}
+
+func TestSeekKeepsSequenceNumbers(t *testing.T) {
+	camera, p, r := openPlayer(t)
+	r.waitFor(t, 5)
+
+	target := p.Position().Add(10 * time.Minute)
+	if err := p.Seek(target); err != nil {
+		t.Fatal(err)
+	}
+	if camera.Playbacks() != 2 {
+		t.Errorf("got %d playbacks, want a restart", camera.Playbacks())
+	}
+	if position := p.Position(); !position.Equal(target) {
+		t.Errorf("got position %s, want %s", position, target)
+	}
+
+	r.waitFor(t, r.count()+5)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := 1; i < len(r.sequences); i++ {
+		if r.sequences[i] != r.sequences[i-1]+1 {
+			t.Fatalf("sequence %d follows %d", r.sequences[i], r.sequences[i-1])
+		}
+	}
+
+	if err := p.Seek(target.Add(time.Hour)); err == nil {
+		t.Error("seeked past the end")
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	camera, p, r := openPlayer(t)
+	r.waitFor(t, 1)
+
+	if err := p.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	paused := r.count()
+	time.Sleep(200 * time.Millisecond)
+	if r.count() != paused {
+		t.Errorf("got %d packets while paused", r.count()-paused)
+	}
+
+	// the speed applies once resumed
+	if err := p.SetSpeed(2); err != nil {
+		t.Fatal(err)
+	}
+	if camera.Playbacks() != 1 {
+		t.Errorf("restarted while paused")
+	}
+
+	if err := p.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	r.waitFor(t, paused+1)
+	if camera.Playbacks() != 2 {
+		t.Errorf("got %d playbacks, want a restart", camera.Playbacks())
+	}
+
+	if err := p.SetSpeed(3); err == nil {
+		t.Error("speed 3 accepted")
+	}
+
+	p.Close()
+	if err := p.Resume(); err != errClosed {
+		t.Errorf("got %v once closed", err)
+	}
+}
+
+func TestCloseWaitsForCamera(t *testing.T) {
+	camera, p, r := openPlayer(t)
+	r.waitFor(t, 1)
+
+	p.Close()
+
+	var buf bytes.Buffer
+	metrics.WriteText(&buf)
+	for _, line := range []string{
+		fmt.Sprintf(`sbipc_camera_sessions{camera=%q,kind="playback"} 0`, camera.Addr),
+		fmt.Sprintf(`sbipc_camera_connections{camera=%q} 0`, camera.Addr),
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte("\n"+line+"\n")) {
+			t.Errorf("no %s once closed", line)
+		}
+	}
+}
+
+func TestPlayerClosedByCamera(t *testing.T) {
+	camera, _, r := openPlayer(t)
+	r.waitFor(t, 1)
+
+	camera.CloseClientConnections()
+
+	select {
+	case <-r.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("player not closed")
+	}
+}
+
+func TestPlayerClosedByFailedRestart(t *testing.T) {
+	_, p, r := openPlayer(t)
+	r.waitFor(t, 1)
+
+	// the camera refuses the playback once stopped
+	p.lock.Lock()
+	p.camera.Password = "wrong"
+	p.lock.Unlock()
+
+	if err := p.Seek(p.Position().Add(time.Minute)); err == nil {
+		t.Fatal("seek restarted with a wrong password")
+	}
+	select {
+	case <-r.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("player not closed")
+	}
+	if err := p.Resume(); err != errClosed {
+		t.Errorf("got %v once closed, want %v", err, errClosed)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	camera.Recordings = []tplink.Recording{{Start: start, End: start.Add(10 * time.Minute), Type: tplink.RecordingMotion}}
+
+	recordings, err := Search(hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password}, start.Add(-time.Minute), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordings) != 1 || !recordings[0].Start.Equal(start) {
+		t.Errorf("got %+v", recordings)
+	}
+
+	if _, err := Search(hub.Camera{Address: camera.Addr, Username: camera.Username, Password: "wrong"}, start, time.Now()); err == nil {
+		t.Error("searched with a wrong password")
+	}
+}
@@ -0,0 +1,138 @@
+// Package ptz drives the pan and tilt motor of cameras, for the control data
+// channel of WebRTC sessions and over HTTP.
+package ptz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+	"sync"
+	"time"
+)
+
+// requestTimeout bounds dialing the camera and each command sent to it.
+const requestTimeout = 10 * time.Second
+
+// ErrInvalidCommand is returned for commands with none of their fields set.
+var ErrInvalidCommand = errors.New("invalid ptz command")
+
+// Command is a single motion or preset request, only one of its fields is
+// expected to be set.
+type Command struct {
+	// Direction moves a step towards it, in degrees counterclockwise from
+	// the right, see tplink.DirectionUp.
+	Direction *int `json:"direction,omitempty"`
+	// X and Y move by steps, negative to the left and down.
+	X int `json:"x,omitempty"`
+	Y int `json:"y,omitempty"`
+	// Stop stops the motor.
+	Stop bool `json:"stop,omitempty"`
+	// GotoPreset moves to the preset of this id.
+	GotoPreset string `json:"gotoPreset,omitempty"`
+	// SavePreset saves the current position as a preset of this name.
+	SavePreset string `json:"savePreset,omitempty"`
+	// Presets lists the presets.
+	Presets bool `json:"presets,omitempty"`
+}
+
+// apply sends the command to the camera, and returns the presets when they
+// were listed or saved.
+func (cmd *Command) apply(ctx context.Context, c *tplink.Conn) ([]tplink.Preset, error) {
+	switch {
+	case cmd.Direction != nil:
+		return nil, c.MoveStepContext(ctx, *cmd.Direction)
+	case cmd.X != 0 || cmd.Y != 0:
+		return nil, c.MoveContext(ctx, cmd.X, cmd.Y)
+	case cmd.Stop:
+		return nil, c.StopMotionContext(ctx)
+	case cmd.GotoPreset != "":
+		return nil, c.GotoPresetContext(ctx, cmd.GotoPreset)
+	case cmd.SavePreset != "":
+		if err := c.SavePresetContext(ctx, cmd.SavePreset); err != nil {
+			return nil, err
+		}
+		return c.PresetsContext(ctx)
+	case cmd.Presets:
+		return c.PresetsContext(ctx)
+	default:
+		return nil, ErrInvalidCommand
+	}
+}
+
+// Controller sends commands to a camera over a connection kept open between
+// them.
+type Controller struct {
+	camera hub.Camera
+	lock   *sync.Mutex
+	conn   *tplink.Conn
+}
+
+func NewController(camera hub.Camera) *Controller {
+	return &Controller{
+		camera: camera,
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Do sends a command, and returns the presets when they were listed or
+// saved. Connections the camera dropped while idle are dialed again.
+func (c *Controller) Do(cmd *Command) ([]tplink.Preset, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	for retry := c.conn != nil; ; retry = false {
+		if c.conn == nil {
+			conn, err := dial(ctx, c.camera)
+			if err != nil {
+				return nil, err
+			}
+			c.conn = conn
+		}
+
+		presets, err := cmd.apply(ctx, c.conn)
+
+		// refusals of the camera leave the connection usable
+		var tpErr *tplink.Error
+		if err == nil || errors.Is(err, ErrInvalidCommand) || errors.As(err, &tpErr) {
+			return presets, err
+		}
+
+		c.conn.Close()
+		c.conn = nil
+		if !retry {
+			return nil, err
+		}
+		log.Printf("ptz %s: %s, dialing again", c.camera.Address, err)
+	}
+}
+
+// Close closes the connection to the camera, a later command dials again.
+func (c *Controller) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func dial(ctx context.Context, camera hub.Camera) (*tplink.Conn, error) {
+	c, err := tplink.DialContext(ctx, camera.Address)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	if err := c.HandshakeContext(ctx, camera.Username, camera.Password); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("handshake: %w", err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,34 @@
+package ptz
+
+import (
+	"errors"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+)
+
+func TestControllerDialsAgain(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	c := NewController(hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password})
+	defer c.Close()
+
+	if _, err := c.Do(&Command{Stop: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the camera dropped the idle connection
+	camera.CloseClientConnections()
+
+	if _, err := c.Do(&Command{X: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if motions := camera.Motions(); len(motions) != 2 || motions[1] != "move 1 0" {
+		t.Errorf("got motions %q", motions)
+	}
+
+	if _, err := c.Do(&Command{}); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("got %v, want an invalid command", err)
+	}
+}
@@ -0,0 +1,135 @@
+package ptz
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+	"strings"
+	"sync"
+)
+
+// Server drives cameras over HTTP:
+//
+//	POST /{camera}/move          {"direction": 90} or {"x": 10, "y": 0}
+//	POST /{camera}/stop
+//	GET  /{camera}/presets
+//	POST /{camera}/presets       {"name": "door"}
+//	POST /{camera}/presets/{id}  moves to the preset
+//
+// Presets are answered as a JSON list, other commands with 204 No Content.
+type Server struct {
+	lock        *sync.Mutex
+	controllers map[string]*Controller
+}
+
+func NewServer() *Server {
+	return &Server{
+		lock:        &sync.Mutex{},
+		controllers: map[string]*Controller{},
+	}
+}
+
+// AddCamera publishes the motor of a camera at /name.
+func (s *Server) AddCamera(name string, camera hub.Camera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.controllers[name] = NewController(camera)
+}
+
+// Close hangs up the cameras, they are dialed again on the next command.
+func (s *Server) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, controller := range s.controllers {
+		controller.Close()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	name, path, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.lock.Lock()
+	controller, ok := s.controllers[name]
+	s.lock.Unlock()
+	if !ok {
+		http.Error(w, "camera not found", http.StatusNotFound)
+		return
+	}
+
+	cmd := &Command{}
+	switch {
+	case r.Method == http.MethodPost && path == "move":
+		if err := json.NewDecoder(r.Body).Decode(cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cmd.Direction == nil && cmd.X == 0 && cmd.Y == 0 {
+			http.Error(w, "direction or x and y expected", http.StatusBadRequest)
+			return
+		}
+		cmd = &Command{Direction: cmd.Direction, X: cmd.X, Y: cmd.Y}
+	case r.Method == http.MethodPost && path == "stop":
+		cmd.Stop = true
+	case r.Method == http.MethodGet && path == "presets":
+		cmd.Presets = true
+	case r.Method == http.MethodPost && path == "presets":
+		var preset tplink.Preset
+		if err := json.NewDecoder(r.Body).Decode(&preset); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if preset.Name == "" {
+			http.Error(w, "name expected", http.StatusBadRequest)
+			return
+		}
+		cmd.SavePreset = preset.Name
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "presets/"):
+		cmd.GotoPreset = strings.TrimPrefix(path, "presets/")
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	presets, err := controller.Do(cmd)
+	if err != nil {
+		log.Printf("ptz %s: %s", name, err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	if !cmd.Presets && cmd.SavePreset == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if presets == nil {
+		presets = []tplink.Preset{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presets)
+}
+
+// errorStatus returns the HTTP status of a failed command.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, tplink.ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, tplink.ErrPrivacyMode), errors.Is(err, tplink.ErrBusy):
+		return http.StatusConflict
+	default:
+		return http.StatusBadGateway
+	}
+}
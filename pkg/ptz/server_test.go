@@ -0,0 +1,126 @@
+package ptz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*tplinktest.Server, *httptest.Server) {
+	t.Helper()
+
+	camera := tplinktest.NewServer()
+	t.Cleanup(camera.Close)
+
+	s := NewServer()
+	s.AddCamera("front", hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password})
+
+	hs := httptest.NewServer(s)
+	t.Cleanup(hs.Close)
+
+	return camera, hs
+}
+
+func request(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestServerMoves(t *testing.T) {
+	camera, hs := newTestServer(t)
+
+	for _, test := range []struct {
+		path, body string
+	}{
+		{"/front/move", `{"direction": 90}`},
+		{"/front/move", `{"x": 10, "y": -10}`},
+		{"/front/stop", ""},
+	} {
+		if resp := request(t, http.MethodPost, hs.URL+test.path, test.body); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("%s %s: got %s", test.path, test.body, resp.Status)
+		}
+	}
+
+	want := []string{"movestep 90", "move 10 -10", "stop"}
+	if motions := camera.Motions(); !reflect.DeepEqual(motions, want) {
+		t.Errorf("got motions %q, want %q", motions, want)
+	}
+}
+
+func TestServerPresets(t *testing.T) {
+	camera, hs := newTestServer(t)
+
+	resp := request(t, http.MethodPost, hs.URL+"/front/presets", `{"name": "door"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("save: got %s", resp.Status)
+	}
+	var presets []tplink.Preset
+	if err := json.NewDecoder(resp.Body).Decode(&presets); err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 1 || presets[0].Name != "door" {
+		t.Fatalf("got presets %+v", presets)
+	}
+
+	resp = request(t, http.MethodGet, hs.URL+"/front/presets", "")
+	presets = nil
+	if err := json.NewDecoder(resp.Body).Decode(&presets); err != nil {
+		t.Fatal(err)
+	}
+	if len(presets) != 1 {
+		t.Errorf("listed %+v", presets)
+	}
+
+	if resp := request(t, http.MethodPost, hs.URL+"/front/presets/"+presets[0].ID, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("goto: got %s", resp.Status)
+	}
+	if motions := camera.Motions(); len(motions) != 1 || motions[0] != "goto "+presets[0].ID {
+		t.Errorf("got motions %q", motions)
+	}
+
+	// the camera refuses unknown presets
+	if resp := request(t, http.MethodPost, hs.URL+"/front/presets/99", ""); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("unknown preset: got %s", resp.Status)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	camera, hs := newTestServer(t)
+
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/back/stop", "", http.StatusNotFound},
+		{http.MethodPost, "/front/jump", "", http.StatusNotFound},
+		{http.MethodGet, "/front/move", "", http.StatusNotFound},
+		{http.MethodPost, "/front/move", `{"direction":`, http.StatusBadRequest},
+		{http.MethodPost, "/front/move", `{}`, http.StatusBadRequest},
+		{http.MethodPost, "/front/presets", `{}`, http.StatusBadRequest},
+		{http.MethodOptions, "/front/move", "", http.StatusNoContent},
+	} {
+		if resp := request(t, test.method, hs.URL+test.path, test.body); resp.StatusCode != test.status {
+			t.Errorf("%s %s %s: got %s, want %d", test.method, test.path, test.body, resp.Status, test.status)
+		}
+	}
+
+	if motions := camera.Motions(); len(motions) != 0 {
+		t.Errorf("got motions %q", motions)
+	}
+}
@@ -0,0 +1,232 @@
+// Package recorder continuously records camera previews to rotating
+// fragmented MP4 files.
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sbipc/pkg/fmp4"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentDuration = 10 * time.Minute
+	retentionInterval      = time.Minute
+	fileTimeLayout         = "20060102-150405"
+)
+
+type Config struct {
+	// Dir is the root directory of the recordings, each camera is recorded
+	// in its own sub directory.
+	Dir string
+	// Name is the camera name used in directory and file names.
+	Name string
+	// SegmentDuration is the duration after which a new file is started, at
+	// the next key frame.
+	SegmentDuration time.Duration
+	// MaxAge removes the files older than this, when not zero.
+	MaxAge time.Duration
+	// MaxTotalSize removes the oldest files when the recordings of the
+	// camera take more bytes than this, when not zero.
+	MaxTotalSize int64
+	// NoAudio records the video only.
+	NoAudio bool
+}
+
+type Recorder struct {
+	hub    *hub.Hub
+	camera hub.Camera
+	config Config
+
+	lock         *sync.Mutex
+	subscription *hub.Subscription
+	packets      chan *mtsp.Packet
+	done         chan struct{}
+	closeOnce    *sync.Once
+	wg           *sync.WaitGroup
+	// current is the path of the file being written, spared by the
+	// retention
+	current string
+
+	// the following are only used by the worker goroutine
+	muxer        *fmp4.Muxer
+	file         *os.File
+	fileInit     []byte
+	segmentStart time.Duration
+}
+
+func New(h *hub.Hub, camera hub.Camera, config Config) *Recorder {
+	if config.SegmentDuration <= 0 {
+		config.SegmentDuration = DefaultSegmentDuration
+	}
+	if config.Name == "" {
+		config.Name = camera.Address
+	}
+
+	return &Recorder{
+		hub:       h,
+		camera:    camera,
+		config:    config,
+		lock:      &sync.Mutex{},
+		packets:   make(chan *mtsp.Packet, 1024),
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+		wg:        &sync.WaitGroup{},
+	}
+}
+
+// Dir returns the directory the camera is recorded in.
+func (r *Recorder) Dir() string {
+	return filepath.Join(r.config.Dir, r.config.Name)
+}
+
+// Start subscribes to the camera and starts recording.
+func (r *Recorder) Start() error {
+	if err := os.MkdirAll(r.Dir(), 0755); err != nil {
+		return fmt.Errorf("create recording dir: %w", err)
+	}
+
+	sub, err := r.hub.Subscribe(r.camera, r.onPacket, r.Close)
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+
+	r.lock.Lock()
+	r.subscription = sub
+	r.lock.Unlock()
+
+	r.muxer = fmp4.NewMuxer(fmp4.ConfigFromPreview(sub.Params, !r.config.NoAudio))
+
+	r.wg.Add(2)
+	go r.work()
+	go r.retain()
+
+	return nil
+}
+
+// Close stops recording and closes the current file.
+func (r *Recorder) Close() {
+	r.closeOnce.Do(func() {
+		r.lock.Lock()
+		sub := r.subscription
+		r.subscription = nil
+		r.lock.Unlock()
+
+		if sub != nil {
+			sub.Close()
+		}
+
+		close(r.done)
+	})
+	r.wg.Wait()
+}
+
+func (r *Recorder) onPacket(p *mtsp.Packet) {
+	body := make([]byte, len(p.Body))
+	copy(body, p.Body)
+
+	select {
+	case r.packets <- &mtsp.Packet{IsInterleaved: true, Channel: p.Channel, Body: body}:
+	default:
+		// the disk is too slow, a gap is better than blocking the stream
+		hub.DroppedPackets.Inc("recorder")
+	}
+}
+
+func (r *Recorder) work() {
+	defer r.wg.Done()
+	defer r.closeFile()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case p := <-r.packets:
+			fragment, err := r.muxer.WritePacket(p.Channel, p.Body)
+			if err != nil {
+				log.Printf("recorder %s: %s", r.config.Name, err)
+				continue
+			}
+			if fragment == nil {
+				continue
+			}
+			if err := r.writeFragment(fragment); err != nil {
+				log.Printf("recorder %s: %s", r.config.Name, err)
+				r.closeFile()
+			}
+		}
+	}
+}
+
+func (r *Recorder) writeFragment(fragment *fmp4.Fragment) error {
+	// files are only rotated on key frames, so each one plays on its own
+	if r.file != nil && fragment.Independent {
+		if fragment.Time-r.segmentStart >= r.config.SegmentDuration || !bytes.Equal(fragment.Init, r.fileInit) {
+			r.closeFile()
+		}
+	}
+
+	if r.file == nil {
+		if !fragment.Independent {
+			return nil
+		}
+		if err := r.openFile(fragment); err != nil {
+			return err
+		}
+	}
+
+	if _, err := r.file.Write(fragment.Data); err != nil {
+		return fmt.Errorf("write fragment: %w", err)
+	}
+
+	return nil
+}
+
+func (r *Recorder) openFile(fragment *fmp4.Fragment) error {
+	name := fmt.Sprintf("%s_%s.mp4", r.config.Name, time.Now().Format(fileTimeLayout))
+	path := filepath.Join(r.Dir(), name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("create segment: %w", err)
+	}
+
+	if _, err := f.Write(fragment.Init); err != nil {
+		f.Close()
+		return fmt.Errorf("write init: %w", err)
+	}
+
+	log.Printf("recorder %s: recording to %s", r.config.Name, path)
+
+	r.lock.Lock()
+	r.current = path
+	r.lock.Unlock()
+
+	r.file = f
+	r.fileInit = fragment.Init
+	r.segmentStart = fragment.Time
+
+	return nil
+}
+
+func (r *Recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+
+	if err := r.file.Close(); err != nil {
+		log.Printf("recorder %s: close segment: %s", r.config.Name, err)
+	}
+	r.file = nil
+	r.fileInit = nil
+
+	r.lock.Lock()
+	r.current = ""
+	r.lock.Unlock()
+}
@@ -0,0 +1,167 @@
+package recorder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink/tplinktest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// segments returns the paths of the recorded files, oldest first.
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestRecorderRotatesSegments(t *testing.T) {
+	server := tplinktest.NewUnstartedServer()
+	server.FrameInterval = 20 * time.Millisecond
+	server.GopSize = 10
+	server.Start()
+	defer server.Close()
+
+	h := hub.New()
+	defer h.Close()
+
+	// file names have a one second resolution, so segments must be longer
+	r := New(h, hub.Camera{Address: server.Addr, Username: server.Username, Password: server.Password}, Config{
+		Dir:             t.TempDir(),
+		Name:            "front",
+		SegmentDuration: 1500 * time.Millisecond,
+	})
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(segments(t, r.Dir())) < 2 {
+		if time.Now().After(deadline) {
+			r.Close()
+			t.Fatalf("got %d segments, want a rotation", len(segments(t, r.Dir())))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	r.Close()
+
+	for _, path := range segments(t, r.Dir()) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(filepath.Base(path), "front_") {
+			t.Errorf("segment %s not named after the camera", path)
+		}
+		if len(data) < 8 || string(data[4:8]) != "ftyp" {
+			t.Errorf("segment %s does not start with an init segment", path)
+		}
+	}
+
+	// the first segment is cut at the first key frame after 1.5s
+	first, err := os.ReadFile(segments(t, r.Dir())[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(first, []byte("moof")); n != 8 {
+		t.Errorf("first segment has %d fragments, want 8", n)
+	}
+}
+
+func TestHubCloseStopsRecorder(t *testing.T) {
+	server := tplinktest.NewServer()
+	defer server.Close()
+
+	h := hub.New()
+	r := New(h, hub.Camera{Address: server.Addr, Username: server.Username, Password: server.Password}, Config{
+		Dir:  t.TempDir(),
+		Name: "front",
+	})
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recorder closes its subscription from onClose
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		r.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub and recorder not closed")
+	}
+}
+
+// writeSegment creates a segment of size bytes modified age ago.
+func writeSegment(t *testing.T, dir, name string, size int, age time.Duration) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRetentionRemovesOldSegments(t *testing.T) {
+	r := New(hub.New(), hub.Camera{}, Config{Dir: t.TempDir(), Name: "front", MaxAge: time.Hour})
+	if err := os.MkdirAll(r.Dir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := writeSegment(t, r.Dir(), "old.mp4", 10, 2*time.Hour)
+	recent := writeSegment(t, r.Dir(), "recent.mp4", 10, time.Minute)
+	other := writeSegment(t, r.Dir(), "notes.txt", 10, 2*time.Hour)
+
+	r.applyRetention()
+
+	if exists(old) {
+		t.Error("old segment kept")
+	}
+	if !exists(recent) || !exists(other) {
+		t.Error("recent segment or other file removed")
+	}
+}
+
+func TestRetentionLimitsTotalSize(t *testing.T) {
+	r := New(hub.New(), hub.Camera{}, Config{Dir: t.TempDir(), Name: "front", MaxTotalSize: 250})
+	if err := os.MkdirAll(r.Dir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldest := writeSegment(t, r.Dir(), "a.mp4", 100, 3*time.Hour)
+	older := writeSegment(t, r.Dir(), "b.mp4", 100, 2*time.Hour)
+	newest := writeSegment(t, r.Dir(), "c.mp4", 100, time.Hour)
+	// the file being written is spared even if it is the oldest
+	current := writeSegment(t, r.Dir(), "d.mp4", 100, 4*time.Hour)
+	r.current = current
+
+	r.applyRetention()
+
+	if exists(oldest) || exists(older) {
+		t.Error("oldest segments kept above the size limit")
+	}
+	if !exists(newest) || !exists(current) {
+		t.Error("newest or current segment removed")
+	}
+}
@@ -0,0 +1,90 @@
+package recorder
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type segmentFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func (r *Recorder) retain() {
+	defer r.wg.Done()
+
+	if r.config.MaxAge <= 0 && r.config.MaxTotalSize <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		r.applyRetention()
+
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyRetention removes the segments older than MaxAge, then the oldest
+// ones until the total size is below MaxTotalSize.
+func (r *Recorder) applyRetention() {
+	entries, err := os.ReadDir(r.Dir())
+	if err != nil {
+		log.Printf("recorder %s: list segments: %s", r.config.Name, err)
+		return
+	}
+
+	r.lock.Lock()
+	current := r.current
+	r.lock.Unlock()
+
+	files := make([]*segmentFile, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".mp4") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(r.Dir(), entry.Name())
+		total += info.Size()
+		if path == current {
+			continue
+		}
+		files = append(files, &segmentFile{path: path, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	now := time.Now()
+	for _, f := range files {
+		expired := r.config.MaxAge > 0 && now.Sub(f.modTime) > r.config.MaxAge
+		oversized := r.config.MaxTotalSize > 0 && total > r.config.MaxTotalSize
+		if !expired && !oversized {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("recorder %s: remove segment: %s", r.config.Name, err)
+			continue
+		}
+		log.Printf("recorder %s: removed %s", r.config.Name, f.path)
+		total -= f.size
+	}
+}
@@ -0,0 +1,161 @@
+// Package registry keeps the cameras served by ID, so their credentials stay
+// on the server and clients only ever send the ID.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/tplink"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the camera configuration file, in YAML or JSON:
+//
+//	cameras:
+//	  door:
+//	    address: 192.168.1.10
+//	    username: admin
+//	    password: secret
+//	    resolution: VGA
+type File struct {
+	Cameras map[string]CameraConfig `yaml:"cameras" json:"cameras"`
+}
+
+type CameraConfig struct {
+	// Address is host:port, the port defaults to 554.
+	Address  string `yaml:"address" json:"address"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	Channel  int    `yaml:"channel" json:"channel"`
+	// Resolution is HD for the main stream, VGA or QVGA for the sub
+	// streams.
+	Resolution tplink.Resolution `yaml:"resolution" json:"resolution"`
+	// Audio defaults to true.
+	Audio *bool `yaml:"audio" json:"audio"`
+}
+
+// Camera returns the camera stream of a configuration.
+func (c *CameraConfig) Camera() (hub.Camera, error) {
+	if c.Address == "" {
+		return hub.Camera{}, fmt.Errorf("no address")
+	}
+
+	address := c.Address
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "554")
+	}
+
+	return hub.Camera{
+		Address:    address,
+		Username:   c.Username,
+		Password:   c.Password,
+		Channel:    c.Channel,
+		Resolution: tplink.Resolution(strings.ToUpper(string(c.Resolution))),
+		NoAudio:    c.Audio != nil && !*c.Audio,
+	}, nil
+}
+
+// Registry is the cameras known to the server, by ID.
+type Registry struct {
+	lock    *sync.Mutex
+	cameras map[string]hub.Camera
+}
+
+func New() *Registry {
+	return &Registry{
+		lock:    &sync.Mutex{},
+		cameras: map[string]hub.Camera{},
+	}
+}
+
+// Load adds the cameras of a configuration file, JSON when its extension is
+// .json and YAML otherwise.
+func (r *Registry) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read cameras: %w", err)
+	}
+
+	var file File
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	return r.AddConfig(file.Cameras)
+}
+
+// AddConfig adds cameras from their configuration.
+func (r *Registry) AddConfig(cameras map[string]CameraConfig) error {
+	for id, config := range cameras {
+		camera, err := config.Camera()
+		if err != nil {
+			return fmt.Errorf("camera %s: %w", id, err)
+		}
+		r.Add(id, camera)
+	}
+	return nil
+}
+
+// Add adds a camera, replacing the one of the same ID.
+func (r *Registry) Add(id string, camera hub.Camera) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cameras[id] = camera
+}
+
+// Camera returns the camera of an ID.
+func (r *Registry) Camera(id string) (hub.Camera, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	camera, ok := r.cameras[id]
+	return camera, ok
+}
+
+// IDs returns the IDs of every camera, sorted.
+func (r *Registry) IDs() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ids := make([]string, 0, len(r.cameras))
+	for id := range r.cameras {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Cameras returns every camera by ID.
+func (r *Registry) Cameras() map[string]hub.Camera {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cameras := make(map[string]hub.Camera, len(r.cameras))
+	for id, camera := range r.cameras {
+		cameras[id] = camera
+	}
+	return cameras
+}
+
+// ServeHTTP lists the IDs of the cameras as JSON, without their
+// credentials.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.IDs())
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "cameras.yaml")
+	os.WriteFile(yamlPath, []byte(`cameras:
+  door:
+    address: 192.168.1.10
+    username: admin
+    password: secret
+    resolution: vga
+  garden:
+    address: 192.168.1.11:8554
+    channel: 1
+    audio: false
+`), 0o600)
+	jsonPath := filepath.Join(dir, "cameras.json")
+	os.WriteFile(jsonPath, []byte(`{"cameras": {"attic": {"address": "192.168.1.12"}}}`), 0o600)
+
+	r := New()
+	if err := r.Load(yamlPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Load(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+
+	door, ok := r.Camera("door")
+	if !ok {
+		t.Fatal("no door")
+	}
+	if door.Address != "192.168.1.10:554" || door.Username != "admin" || door.Resolution != "VGA" || door.NoAudio {
+		t.Errorf("got door %+v", door)
+	}
+
+	garden, _ := r.Camera("garden")
+	if garden.Address != "192.168.1.11:8554" || garden.Channel != 1 || !garden.NoAudio {
+		t.Errorf("got garden %+v", garden)
+	}
+
+	if _, ok := r.Camera("attic"); !ok {
+		t.Error("no camera from json")
+	}
+	if _, ok := r.Camera("cellar"); ok {
+		t.Error("got an unknown camera")
+	}
+}
+
+func TestAddConfigRequiresAddress(t *testing.T) {
+	if err := New().AddConfig(map[string]CameraConfig{"door": {Username: "admin"}}); err == nil {
+		t.Error("added a camera without address")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := New()
+	r.AddConfig(map[string]CameraConfig{
+		"garden": {Address: "192.168.1.11", Password: "secret"},
+		"door":   {Address: "192.168.1.10", Password: "secret"},
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	var ids []string
+	if err := json.Unmarshal(w.Body.Bytes(), &ids); err != nil {
+		t.Fatalf("%s: %q", err, w.Body)
+	}
+	if len(ids) != 2 || ids[0] != "door" || ids[1] != "garden" {
+		t.Errorf("got ids %v, want door and garden", ids)
+	}
+}
@@ -0,0 +1,95 @@
+package rtspserver
+
+import (
+	"fmt"
+	"log"
+	"sbipc/pkg/tplink"
+	"strings"
+)
+
+const (
+	videoPayloadType = 96
+	// videoChannel and audioChannel are the interleaved channels the camera
+	// sends video and audio on, which are also our track IDs.
+	videoChannel = 0
+	audioChannel = 1
+)
+
+// track is a media description announced to RTSP clients.
+type track struct {
+	channel     int
+	payloadType uint8
+	media       string
+	rtpmap      string
+	fmtp        string
+}
+
+// tracksFromParams builds the tracks of a preview from its av_config, leaving
+// out audio in an unsupported codec.
+func tracksFromParams(params *tplink.PreviewParams) ([]*track, error) {
+	if params == nil || len(params.AvConfig) == 0 {
+		return nil, fmt.Errorf("no av_config in preview params")
+	}
+	av := params.AvConfig[0]
+
+	tracks := make([]*track, 0, 2)
+
+	rtpmap := av.ExtraData.VideoRtpmap
+	if rtpmap == "" {
+		rtpmap = fmt.Sprintf("%s/90000", strings.ToUpper(av.VideoCodec))
+	}
+	tracks = append(tracks, &track{
+		channel:     videoChannel,
+		payloadType: videoPayloadType,
+		media:       "video",
+		rtpmap:      rtpmap,
+		fmtp:        av.ExtraData.VideoFmtp,
+	})
+
+	if av.AudioCodec != "" {
+		codec := strings.ToUpper(av.AudioCodec)
+		var pt uint8
+		switch codec {
+		case "PCMA", "G711A":
+			codec, pt = "PCMA", 8
+		case "PCMU", "G711U":
+			codec, pt = "PCMU", 0
+		default:
+			log.Printf("rtsp describe: unsupported audio codec %s, streaming video only", av.AudioCodec)
+			return tracks, nil
+		}
+
+		tracks = append(tracks, &track{
+			channel:     audioChannel,
+			payloadType: pt,
+			media:       "audio",
+			rtpmap:      fmt.Sprintf("%s/%d", codec, params.AudioClockRate()),
+		})
+	}
+
+	return tracks, nil
+}
+
+func buildSdp(name string, tracks []*track) []byte {
+	lines := []string{
+		"v=0",
+		"o=- 0 0 IN IP4 127.0.0.1",
+		fmt.Sprintf("s=%s", name),
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=control:*",
+	}
+
+	for _, t := range tracks {
+		lines = append(lines,
+			fmt.Sprintf("m=%s 0 RTP/AVP %d", t.media, t.payloadType),
+			fmt.Sprintf("a=rtpmap:%d %s", t.payloadType, t.rtpmap),
+		)
+		if t.fmtp != "" {
+			lines = append(lines, fmt.Sprintf("a=fmtp:%d %s", t.payloadType, t.fmtp))
+		}
+		lines = append(lines, fmt.Sprintf("a=control:trackID=%d", t.channel))
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
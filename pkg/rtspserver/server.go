@@ -0,0 +1,176 @@
+// Package rtspserver re-exports camera previews as a standard RTSP server,
+// so NVRs and players which do not speak MULTITRANS can pull them.
+package rtspserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/hub"
+	"sync"
+)
+
+type Server struct {
+	// Auth, when set, requires the view permission on cameras.
+	Auth *auth.Auth
+
+	hub       *hub.Hub
+	lock      *sync.Mutex
+	cameras   map[string]hub.Camera
+	rtpConn   *net.UDPConn
+	rtcpConn  *net.UDPConn
+	rtpPort   int
+	listeners map[net.Listener]struct{}
+	sessions  map[*session]struct{}
+	wg        *sync.WaitGroup
+	closed    bool
+}
+
+func New(h *hub.Hub) *Server {
+	return &Server{
+		hub:       h,
+		lock:      &sync.Mutex{},
+		cameras:   map[string]hub.Camera{},
+		listeners: map[net.Listener]struct{}{},
+		sessions:  map[*session]struct{}{},
+		wg:        &sync.WaitGroup{},
+	}
+}
+
+// AddCamera publishes a camera at rtsp://host:port/name, and its SD card
+// recordings at rtsp://host:port/name?start=time&end=time, with times as
+// unix timestamps or RFC 3339. Recordings can be paused, seeked with PLAY
+// ranges, and sped up with the Scale header.
+func (s *Server) AddCamera(name string, camera hub.Camera) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cameras[name] = camera
+}
+
+func (s *Server) camera(name string) (hub.Camera, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	camera, ok := s.cameras[name]
+	return camera, ok
+}
+
+// ListenUDP enables the UDP transport, sending RTP from rtpPort and RTCP
+// from rtpPort+1.
+func (s *Server) ListenUDP(rtpPort int) error {
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: rtpPort})
+	if err != nil {
+		return fmt.Errorf("listen rtp: %w", err)
+	}
+
+	rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: rtpPort + 1})
+	if err != nil {
+		rtpConn.Close()
+		return fmt.Errorf("listen rtcp: %w", err)
+	}
+
+	s.rtpConn = rtpConn
+	s.rtcpConn = rtcpConn
+	s.rtpPort = rtpPort
+
+	// receiver reports are not used, but must be drained
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := rtcpConn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("rtsp server closed")
+
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		log.Printf("rtsp connection from %s", nc.RemoteAddr())
+
+		session := newSession(s, nc)
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.sessions[session] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			session.serve()
+
+			s.lock.Lock()
+			delete(s.sessions, session)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// Close stops listening and ends every session, stopping their previews
+// and playbacks.
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for session := range s.sessions {
+		session.close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+
+	if s.rtpConn != nil {
+		s.rtpConn.Close()
+		s.rtcpConn.Close()
+	}
+}
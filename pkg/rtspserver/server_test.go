@@ -0,0 +1,205 @@
+package rtspserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink/tplinktest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+// client is a minimal RTSP client, writing requests by hand and reading
+// responses and frames with mtsp.
+type client struct {
+	nc   net.Conn
+	conn *mtsp.Conn
+	cseq int
+}
+
+func newClient(t *testing.T, address string) *client {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{nc: nc, conn: mtsp.NewConn(nc)}
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func (c *client) do(t *testing.T, method, url string, headers ...string) *mtsp.Packet {
+	t.Helper()
+
+	c.cseq++
+	request := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for _, h := range headers {
+		request += h + "\r\n"
+	}
+	if _, err := c.nc.Write([]byte(request + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		p, err := c.conn.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.IsInterleaved {
+			return p
+		}
+	}
+}
+
+// startServer serves a single camera named front and returns the address
+// of the server.
+func startServer(t *testing.T, camera *tplinktest.Server) string {
+	t.Helper()
+
+	return serve(t, camera, nil)
+}
+
+// serve is like startServer, with a as the Auth of the server.
+func serve(t *testing.T, camera *tplinktest.Server, a *auth.Auth) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := New(hub.New())
+	s.Auth = a
+	s.AddCamera("front", hub.Camera{Address: camera.Addr, Username: camera.Username, Password: camera.Password})
+	go s.Serve(l)
+
+	return l.Addr().String()
+}
+
+func TestPlayRewritesPayloadTypes(t *testing.T) {
+	camera := tplinktest.NewUnstartedServer()
+	// announced as PCMU while the camera keeps sending payload type 8
+	camera.PreviewParams.AvConfig[0].AudioCodec = "PCMU"
+	camera.Start()
+	defer camera.Close()
+
+	address := startServer(t, camera)
+	url := "rtsp://" + address + "/front"
+	c := newClient(t, address)
+
+	resp := c.do(t, "DESCRIBE", url)
+	if resp.StatusCode != 200 {
+		t.Fatalf("describe: %s", resp.Status)
+	}
+	if sdp := string(resp.Body); !strings.Contains(sdp, "m=video 0 RTP/AVP 96") || !strings.Contains(sdp, "m=audio 0 RTP/AVP 0") {
+		t.Fatalf("unexpected sdp:\n%s", sdp)
+	}
+
+	for i, channel := range []int{0, 2} {
+		resp := c.do(t, "SETUP", fmt.Sprintf("%s/trackID=%d", url, i), fmt.Sprintf("Transport: RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1))
+		if resp.StatusCode != 200 {
+			t.Fatalf("setup track %d: %s", i, resp.Status)
+		}
+	}
+	if resp := c.do(t, "PLAY", url); resp.StatusCode != 200 {
+		t.Fatalf("play: %s", resp.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	payloadTypes := map[int]uint8{}
+	for len(payloadTypes) < 2 {
+		p, err := c.conn.ReadContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.IsInterleaved {
+			continue
+		}
+
+		var packet rtp.Packet
+		if err := packet.Unmarshal(p.Body); err != nil {
+			t.Fatalf("channel %d: %s", p.Channel, err)
+		}
+		payloadTypes[p.Channel] = packet.PayloadType
+	}
+
+	if payloadTypes[0] != 96 || payloadTypes[2] != 0 {
+		t.Errorf("got payload types %v, want 96 on 0 and 0 on 2", payloadTypes)
+	}
+}
+
+func TestDescribeUnknownCamera(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	address := startServer(t, camera)
+
+	if resp := newClient(t, address).do(t, "DESCRIBE", "rtsp://"+address+"/back"); resp.StatusCode != 404 {
+		t.Errorf("got %s, want 404", resp.Status)
+	}
+	if camera.Previews() != 0 {
+		t.Errorf("started %d previews", camera.Previews())
+	}
+}
+
+func TestDescribeRequiresView(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	a, err := auth.New(&auth.File{Users: map[string]auth.UserConfig{
+		"alice": {Tokens: []string{"alice-token"}, Cameras: map[string][]auth.Permission{"front": {auth.View}}},
+		"bob":   {Tokens: []string{"bob-token"}, Cameras: map[string][]auth.Permission{"front": {auth.Talk}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := serve(t, camera, a)
+	url := "rtsp://" + address + "/front"
+	c := newClient(t, address)
+
+	resp := c.do(t, "DESCRIBE", url)
+	if resp.StatusCode != 401 || resp.Headers.Get("WWW-Authenticate") == "" {
+		t.Errorf("without credentials: got %s", resp.Status)
+	}
+	if resp := c.do(t, "DESCRIBE", url, "Authorization: Bearer bob-token"); resp.StatusCode != 403 {
+		t.Errorf("without the view permission: got %s", resp.Status)
+	}
+	if camera.Previews() != 0 {
+		t.Errorf("started %d previews", camera.Previews())
+	}
+
+	if resp := c.do(t, "DESCRIBE", url+"?access_token=alice-token"); resp.StatusCode != 200 {
+		t.Errorf("with a token: got %s", resp.Status)
+	}
+	if resp := c.do(t, "DESCRIBE", url, "Authorization: Bearer alice-token"); resp.StatusCode != 200 {
+		t.Errorf("with a bearer token: got %s", resp.Status)
+	}
+}
+
+func TestDescribeVideoOnly(t *testing.T) {
+	camera := tplinktest.NewUnstartedServer()
+	camera.PreviewParams.AvConfig[0].AudioCodec = "G722"
+	camera.Start()
+	defer camera.Close()
+
+	address := startServer(t, camera)
+
+	resp := newClient(t, address).do(t, "DESCRIBE", "rtsp://"+address+"/front")
+	if resp.StatusCode != 200 {
+		t.Fatalf("describe: %s", resp.Status)
+	}
+	if sdp := string(resp.Body); !strings.Contains(sdp, "m=video") || strings.Contains(sdp, "m=audio") {
+		t.Errorf("unexpected sdp:\n%s", sdp)
+	}
+}
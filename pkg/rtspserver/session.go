@@ -0,0 +1,555 @@
+package rtspserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/playback"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionTimeout = 60
+
+// queueSize is the number of packets buffered for a slow client before
+// packets are dropped.
+const queueSize = 512
+
+type outgoing struct {
+	channel int
+	body    []byte
+}
+
+// transport is how the packets of a track reach a client.
+type transport struct {
+	interleaved int
+	udpAddr     *net.UDPAddr
+}
+
+// session is a single RTSP client connection.
+type session struct {
+	server     *Server
+	nc         net.Conn
+	conn       *mtsp.Conn
+	id         string
+	camera     string
+	sub        *hub.Subscription
+	tracks     []*track
+	transports map[int]*transport
+	playing    bool
+	lock       *sync.Mutex
+	queue      chan outgoing
+	done       chan struct{}
+	closeOnce  *sync.Once
+	// player replaces sub when playing recordings, from playbackStart
+	player        *playback.Player
+	playbackStart time.Time
+}
+
+func newSession(server *Server, nc net.Conn) *session {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &session{
+		server:     server,
+		nc:         nc,
+		conn:       mtsp.NewConn(nc),
+		id:         hex.EncodeToString(id),
+		transports: map[int]*transport{},
+		lock:       &sync.Mutex{},
+		queue:      make(chan outgoing, queueSize),
+		done:       make(chan struct{}),
+		closeOnce:  &sync.Once{},
+	}
+}
+
+func (s *session) serve() {
+	defer func() {
+		s.close()
+		if s.sub != nil {
+			s.sub.Close()
+		}
+		if s.player != nil {
+			s.player.Close()
+		}
+		log.Printf("rtsp connection from %s closed", s.nc.RemoteAddr())
+	}()
+
+	go s.writeLoop()
+
+	for {
+		p, err := s.conn.Read()
+		if err != nil {
+			return
+		}
+
+		// RTCP from clients using the TCP transport
+		if p.IsInterleaved {
+			continue
+		}
+
+		if err := s.handleRequest(p); err != nil {
+			log.Printf("rtsp %s error: %s", p.Method, err)
+			return
+		}
+
+		if p.Method == "TEARDOWN" {
+			return
+		}
+	}
+}
+
+func (s *session) handleRequest(req *mtsp.Packet) error {
+	headers := textproto.MIMEHeader{}
+
+	switch req.Method {
+	case "OPTIONS":
+		headers.Set("Public", "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER")
+		return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+	case "DESCRIBE":
+		return s.handleDescribe(req)
+	case "SETUP":
+		return s.handleSetup(req)
+	case "PLAY":
+		if len(s.transports) == 0 {
+			return s.conn.WriteResponse(req, 455, "Method Not Valid in This State", nil, nil)
+		}
+		if s.player != nil {
+			return s.handlePlaybackPlay(req)
+		}
+		s.lock.Lock()
+		s.playing = true
+		s.lock.Unlock()
+
+		headers.Set("Session", s.id)
+		headers.Set("Range", "npt=0.000-")
+		return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+	case "PAUSE":
+		if s.player == nil {
+			// live previews cannot be paused
+			return s.conn.WriteResponse(req, 455, "Method Not Valid in This State", nil, nil)
+		}
+		if err := s.player.Pause(); err != nil {
+			log.Printf("rtsp pause: %s", err)
+			return s.conn.WriteResponse(req, 500, "Internal Server Error", nil, nil)
+		}
+		headers.Set("Session", s.id)
+		return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+	case "GET_PARAMETER":
+		headers.Set("Session", s.id)
+		return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+	case "TEARDOWN":
+		headers.Set("Session", s.id)
+		return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+	default:
+		return s.conn.WriteResponse(req, 501, "Not Implemented", nil, nil)
+	}
+}
+
+// parseURL returns the camera name, track ID and query addressed by a
+// request URL.
+func parseURL(rawURL string) (string, int, url.Values, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	name := parts[0]
+	trackId := -1
+	if len(parts) > 1 {
+		id, ok := strings.CutPrefix(parts[len(parts)-1], "trackID=")
+		if !ok {
+			return "", 0, nil, fmt.Errorf("invalid track: %s", parts[len(parts)-1])
+		}
+		if trackId, err = strconv.Atoi(id); err != nil {
+			return "", 0, nil, fmt.Errorf("invalid track: %s", parts[len(parts)-1])
+		}
+	}
+
+	return name, trackId, u.Query(), nil
+}
+
+// attach starts watching the camera named by a request URL, or playing its
+// recordings when the URL has a start time.
+func (s *session) attach(name string, query url.Values) (int, string, error) {
+	if s.sub != nil || s.player != nil {
+		if s.camera != name {
+			return 400, "Bad Request", fmt.Errorf("already attached to %s", s.camera)
+		}
+		return 0, "", nil
+	}
+
+	camera, ok := s.server.camera(name)
+	if !ok {
+		return 404, "Not Found", fmt.Errorf("camera %s not found", name)
+	}
+
+	if query.Has("start") {
+		return s.attachPlayback(name, camera, query)
+	}
+
+	sub, err := s.server.hub.Subscribe(camera, s.writePacket, s.close)
+	if err != nil {
+		return 503, "Service Unavailable", err
+	}
+
+	tracks, err := tracksFromParams(sub.Params)
+	if err != nil {
+		sub.Close()
+		return 415, "Unsupported Media Type", err
+	}
+
+	s.camera = name
+	s.sub = sub
+	s.tracks = tracks
+
+	return 0, "", nil
+}
+
+// attachPlayback starts playing the recordings of a camera, from the start
+// of the query to its end, or to now.
+func (s *session) attachPlayback(name string, camera hub.Camera, query url.Values) (int, string, error) {
+	start, err := parseTime(query.Get("start"))
+	if err != nil {
+		return 400, "Bad Request", fmt.Errorf("invalid start: %w", err)
+	}
+	end := time.Now()
+	if query.Has("end") {
+		if end, err = parseTime(query.Get("end")); err != nil {
+			return 400, "Bad Request", fmt.Errorf("invalid end: %w", err)
+		}
+	}
+
+	player, err := playback.Open(camera, start, end, s.writePacket, s.close)
+	if err != nil {
+		return 503, "Service Unavailable", err
+	}
+
+	tracks, err := tracksFromParams(player.Params())
+	if err != nil {
+		player.Close()
+		return 415, "Unsupported Media Type", err
+	}
+
+	s.camera = name
+	s.player = player
+	s.playbackStart = start
+	s.tracks = tracks
+
+	return 0, "", nil
+}
+
+// handlePlaybackPlay starts or resumes playing recordings, seeking to the
+// Range and changing the speed to the Scale of the request.
+func (s *session) handlePlaybackPlay(req *mtsp.Packet) error {
+	if scale := req.Headers.Get("Scale"); scale != "" {
+		speed, err := strconv.ParseFloat(scale, 64)
+		if err != nil {
+			return s.conn.WriteResponse(req, 400, "Bad Request", nil, nil)
+		}
+		if err := s.player.SetSpeed(speed); err != nil {
+			log.Printf("rtsp play: %s", err)
+			return s.conn.WriteResponse(req, 456, "Header Field Not Valid for Resource", nil, nil)
+		}
+	}
+
+	seek, err := parseRange(req.Headers.Get("Range"), s.playbackStart)
+	if err != nil {
+		return s.conn.WriteResponse(req, 457, "Invalid Range", nil, nil)
+	}
+	if !seek.IsZero() {
+		if err := s.player.Seek(seek); err != nil {
+			log.Printf("rtsp play: %s", err)
+			return s.conn.WriteResponse(req, 457, "Invalid Range", nil, nil)
+		}
+	}
+
+	if err := s.player.Resume(); err != nil {
+		log.Printf("rtsp play: %s", err)
+		return s.conn.WriteResponse(req, 500, "Internal Server Error", nil, nil)
+	}
+
+	s.lock.Lock()
+	s.playing = true
+	s.lock.Unlock()
+
+	headers := textproto.MIMEHeader{}
+	headers.Set("Session", s.id)
+	headers.Set("Range", fmt.Sprintf("npt=%.3f-", s.player.Position().Sub(s.playbackStart).Seconds()))
+	return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+}
+
+// parseRange returns the time to seek to of a Range header, or the zero
+// time to play on. npt ranges are relative to start.
+func parseRange(header string, start time.Time) (time.Time, error) {
+	from, _, _ := strings.Cut(header, "-")
+
+	switch {
+	case header == "":
+		return time.Time{}, nil
+	case strings.HasPrefix(from, "npt="):
+		from = strings.TrimPrefix(from, "npt=")
+		if from == "" || from == "now" {
+			return time.Time{}, nil
+		}
+		seconds, err := strconv.ParseFloat(from, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if seconds == 0 {
+			// players ask for 0 when they mean to play on
+			return time.Time{}, nil
+		}
+		return start.Add(time.Duration(seconds * float64(time.Second))), nil
+	case strings.HasPrefix(from, "clock="):
+		return time.Parse("20060102T150405.999999999Z", strings.TrimPrefix(from, "clock="))
+	}
+
+	return time.Time{}, fmt.Errorf("unsupported range: %s", header)
+}
+
+// authorize checks a request may view a camera, when the server has Auth.
+// Clients authenticate with Basic credentials, or with the access_token or
+// signed link in the URL query.
+func (s *session) authorize(req *mtsp.Packet, name string) error {
+	if s.server.Auth == nil {
+		return nil
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return err
+	}
+	r := &http.Request{URL: u, Header: http.Header{}}
+	if req.Headers != nil {
+		r.Header = http.Header(*req.Headers)
+	}
+
+	identity, err := s.server.Auth.Authenticate(r)
+	if err != nil {
+		return err
+	}
+	return identity.Check(name, auth.View)
+}
+
+func (s *session) writeUnauthorized(req *mtsp.Packet, err error) error {
+	if errors.Is(err, auth.ErrForbidden) {
+		return s.conn.WriteResponse(req, 403, "Forbidden", nil, nil)
+	}
+
+	headers := textproto.MIMEHeader{}
+	headers.Set("WWW-Authenticate", `Basic realm="sbipc"`)
+	return s.conn.WriteResponse(req, 401, "Unauthorized", &headers, nil)
+}
+
+// parseTime parses RFC 3339 times or unix timestamps.
+func parseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (s *session) handleDescribe(req *mtsp.Packet) error {
+	name, _, query, err := parseURL(req.URL)
+	if err != nil {
+		return s.conn.WriteResponse(req, 400, "Bad Request", nil, nil)
+	}
+
+	if err := s.authorize(req, name); err != nil {
+		log.Printf("rtsp describe %s: %s", name, err)
+		return s.writeUnauthorized(req, err)
+	}
+
+	if code, reason, err := s.attach(name, query); err != nil {
+		log.Printf("rtsp describe %s: %s", name, err)
+		return s.conn.WriteResponse(req, code, reason, nil, nil)
+	}
+
+	headers := textproto.MIMEHeader{}
+	headers.Set("Content-Type", "application/sdp")
+	// the query only matters to attach, track URLs are built without it
+	base, _, _ := strings.Cut(req.URL, "?")
+	headers.Set("Content-Base", strings.TrimSuffix(base, "/")+"/")
+
+	return s.conn.WriteResponse(req, 200, "OK", &headers, buildSdp(name, s.tracks))
+}
+
+func (s *session) handleSetup(req *mtsp.Packet) error {
+	name, trackId, query, err := parseURL(req.URL)
+	if err != nil {
+		return s.conn.WriteResponse(req, 400, "Bad Request", nil, nil)
+	}
+
+	if err := s.authorize(req, name); err != nil {
+		log.Printf("rtsp setup %s: %s", name, err)
+		return s.writeUnauthorized(req, err)
+	}
+
+	if code, reason, err := s.attach(name, query); err != nil {
+		log.Printf("rtsp setup %s: %s", name, err)
+		return s.conn.WriteResponse(req, code, reason, nil, nil)
+	}
+
+	// a single track stream may be set up on the aggregate URL
+	if trackId < 0 && len(s.tracks) > 0 {
+		trackId = s.tracks[0].channel
+	}
+
+	found := false
+	for _, t := range s.tracks {
+		if t.channel == trackId {
+			found = true
+		}
+	}
+	if !found {
+		return s.conn.WriteResponse(req, 404, "Not Found", nil, nil)
+	}
+
+	tr, reply, err := s.parseTransport(req.Headers.Get("Transport"))
+	if err != nil {
+		log.Printf("rtsp setup %s: %s", name, err)
+		return s.conn.WriteResponse(req, 461, "Unsupported Transport", nil, nil)
+	}
+
+	s.lock.Lock()
+	s.transports[trackId] = tr
+	s.lock.Unlock()
+
+	headers := textproto.MIMEHeader{}
+	headers.Set("Transport", reply)
+	headers.Set("Session", fmt.Sprintf("%s;timeout=%d", s.id, sessionTimeout))
+
+	return s.conn.WriteResponse(req, 200, "OK", &headers, nil)
+}
+
+// parseTransport picks the first transport we support from a Transport
+// header, and returns the header to reply with.
+func (s *session) parseTransport(header string) (*transport, string, error) {
+	for _, spec := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(spec), ";")
+		params := map[string]string{}
+		for _, f := range fields[1:] {
+			k, v, _ := strings.Cut(f, "=")
+			params[k] = v
+		}
+
+		switch fields[0] {
+		case "RTP/AVP/TCP":
+			channel := 2 * len(s.transports)
+			if interleaved, ok := params["interleaved"]; ok {
+				first, _, _ := strings.Cut(interleaved, "-")
+				c, err := strconv.Atoi(first)
+				if err != nil {
+					continue
+				}
+				channel = c
+			}
+
+			return &transport{interleaved: channel}, fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1), nil
+		case "RTP/AVP", "RTP/AVP/UDP":
+			if s.server.rtpConn == nil {
+				continue
+			}
+			if _, ok := params["multicast"]; ok {
+				continue
+			}
+
+			first, _, _ := strings.Cut(params["client_port"], "-")
+			port, err := strconv.Atoi(first)
+			if err != nil {
+				continue
+			}
+
+			host, _, _ := net.SplitHostPort(s.nc.RemoteAddr().String())
+			addr := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+
+			reply := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", port, port+1, s.server.rtpPort, s.server.rtpPort+1)
+			return &transport{interleaved: -1, udpAddr: addr}, reply, nil
+		}
+	}
+
+	return nil, "", fmt.Errorf("unsupported transport: %s", header)
+}
+
+func (s *session) writePacket(p *mtsp.Packet) {
+	s.lock.Lock()
+	playing := s.playing
+	s.lock.Unlock()
+
+	if !playing || len(p.Body) < 2 {
+		return
+	}
+
+	var t *track
+	for _, tt := range s.tracks {
+		if tt.channel == p.Channel {
+			t = tt
+		}
+	}
+	if t == nil {
+		return
+	}
+
+	// the camera's payload types may not match what we announced, and the
+	// packet is shared with other subscribers
+	body := make([]byte, len(p.Body))
+	copy(body, p.Body)
+	body[1] = body[1]&0x80 | t.payloadType
+
+	select {
+	case s.queue <- outgoing{channel: p.Channel, body: body}:
+	default:
+		// drop packets for slow clients instead of stalling the others
+		hub.DroppedPackets.Inc("rtsp")
+	}
+}
+
+func (s *session) writeLoop() {
+	for {
+		var out outgoing
+		select {
+		case out = <-s.queue:
+		case <-s.done:
+			return
+		}
+
+		s.lock.Lock()
+		tr := s.transports[out.channel]
+		s.lock.Unlock()
+
+		if tr == nil {
+			continue
+		}
+
+		var err error
+		if tr.udpAddr != nil {
+			_, err = s.server.rtpConn.WriteToUDP(out.body, tr.udpAddr)
+		} else {
+			err = s.conn.WriteInterleavedChannel(tr.interleaved, out.body)
+		}
+		if err != nil {
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
@@ -1,44 +1,91 @@
 package talkserver
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/hub"
+	"sbipc/pkg/registry"
 	"sbipc/pkg/tplink"
+	"sync"
+	"time"
 
 	"github.com/olahol/melody"
 )
 
+// requestTimeout bounds dialing the camera and each request sent to it.
+const requestTimeout = 10 * time.Second
+
 type Server struct {
-	melody *melody.Melody
+	// AllowDirect accepts cameras sent with their credentials by clients,
+	// besides the IDs of the registry.
+	AllowDirect bool
+	// Auth authenticates clients, which then need the talk permission on
+	// the camera. Everyone may talk without it.
+	Auth *auth.Auth
+
+	melody  *melody.Melody
+	cameras *registry.Registry
 }
 
 type Session struct {
 	tpConn    *tplink.Conn
 	sessionId string
+	closeOnce *sync.Once
+}
+
+// close stops talking and hangs up the camera.
+func (session *Session) close() {
+	session.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		session.tpConn.StopTalkContext(ctx, session.sessionId)
+		session.tpConn.Close()
+	})
 }
 
 func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling websocket request from %s", r.RemoteAddr)
 
-	address := r.URL.Query().Get("address")
-	username := r.URL.Query().Get("username")
-	password := r.URL.Query().Get("password")
+	if s.Auth != nil {
+		identity, err := s.Auth.Authenticate(r)
+		if err == nil {
+			err = identity.Check(r.URL.Query().Get("camera"), auth.Talk)
+		}
+		if err != nil {
+			log.Printf("refused talk from %s: %s", r.RemoteAddr, err)
+			s.Auth.Unauthorized(w, err)
+			return
+		}
+	}
+
+	camera, status, message := s.camera(r)
+	if status != http.StatusOK {
+		http.Error(w, message, status)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
 
-	conn, err := tplink.Dial(address)
+	conn, err := tplink.DialContext(ctx, camera.Address)
 	if err != nil {
 		log.Printf("dial tplink error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := conn.Handshake(username, password); err != nil {
+	if err := conn.HandshakeContext(ctx, camera.Username, camera.Password); err != nil {
+		conn.Close()
 		log.Printf("handshake tplink error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	sessionId, err := conn.StartTalk()
+	sessionId, err := conn.StartTalkContext(ctx)
 	if err != nil {
+		conn.Close()
 		log.Printf("start talk error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -47,16 +94,54 @@ func (s *Server) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	session := &Session{
 		tpConn:    conn,
 		sessionId: sessionId,
+		closeOnce: &sync.Once{},
 	}
 
 	if err = s.melody.HandleRequestWithKeys(w, r, map[string]interface{}{"session": session}); err != nil {
+		session.close()
 		log.Printf("upgrade error: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func New() *Server {
+// camera returns the camera of the camera ID of the query, or of its address,
+// username and password when the server allows direct cameras.
+func (s *Server) camera(r *http.Request) (hub.Camera, int, string) {
+	query := r.URL.Query()
+
+	if id := query.Get("camera"); id != "" {
+		if s.cameras != nil {
+			if camera, ok := s.cameras.Camera(id); ok {
+				return camera, http.StatusOK, ""
+			}
+		}
+		return hub.Camera{}, http.StatusNotFound, "camera not found"
+	}
+
+	if !s.AllowDirect {
+		return hub.Camera{}, http.StatusForbidden, "cameras must be opened by id"
+	}
+
+	return hub.Camera{
+		Address:  query.Get("address"),
+		Username: query.Get("username"),
+		Password: query.Get("password"),
+	}, http.StatusOK, ""
+}
+
+// Close stops every talk session and disconnects their clients.
+func (s *Server) Close() {
+	sessions, _ := s.melody.Sessions()
+	for _, ms := range sessions {
+		if session, ok := ms.Keys["session"].(*Session); ok {
+			session.close()
+		}
+	}
+	s.melody.Close()
+}
+
+func New(cameras *registry.Registry) *Server {
 	m := melody.New()
 
 	m.HandleMessageBinary(func(s *melody.Session, msg []byte) {
@@ -67,13 +152,12 @@ func New() *Server {
 	})
 
 	m.HandleDisconnect(func(s *melody.Session) {
-		session := s.Keys["session"].(*Session)
-		session.tpConn.StopTalk(session.sessionId)
-		session.tpConn.Close()
+		s.Keys["session"].(*Session).close()
 	})
 
 	s := &Server{
-		melody: m,
+		melody:  m,
+		cameras: cameras,
 	}
 
 	return s
@@ -0,0 +1,179 @@
+package talkserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sbipc/pkg/auth"
+	"sbipc/pkg/metrics"
+	"sbipc/pkg/registry"
+	"sbipc/pkg/tplink/tplinktest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp/v2"
+)
+
+func newTestServer(t *testing.T, camera *tplinktest.Server) (*Server, *httptest.Server) {
+	t.Helper()
+
+	cameras := registry.New()
+	err := cameras.AddConfig(map[string]registry.CameraConfig{
+		"door": {Address: camera.Addr, Username: camera.Username, Password: camera.Password},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := New(cameras)
+
+	server := httptest.NewServer(http.HandlerFunc(s.HandleRequest))
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func dial(server *httptest.Server, query url.Values, header http.Header) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?"+query.Encode(), header)
+}
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTalk(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	_, server := newTestServer(t, camera)
+
+	ws, _, err := dial(server, url.Values{"camera": {"door"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if n := camera.Talks(); n != 1 {
+		t.Errorf("%d talks started, want 1", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := ws.WriteMessage(websocket.BinaryMessage, make([]byte, 160)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "talk frames", func() bool { return len(camera.TalkFrames()) == 3 })
+
+	var packet rtp.Packet
+	if err := packet.Unmarshal(camera.TalkFrames()[2]); err != nil {
+		t.Fatal(err)
+	}
+	if packet.SequenceNumber != 2 || len(packet.Payload) != 160 {
+		t.Errorf("got packet %+v with %d bytes", packet.Header, len(packet.Payload))
+	}
+}
+
+func TestTalkDirect(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	s, server := newTestServer(t, camera)
+	query := url.Values{"address": {camera.Addr}, "username": {camera.Username}, "password": {camera.Password}}
+
+	if _, resp, err := dial(server, query, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %v, want direct cameras refused", err)
+	}
+
+	s.AllowDirect = true
+	ws, _, err := dial(server, query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+}
+
+func TestTalkRefused(t *testing.T) {
+	camera := tplinktest.NewUnstartedServer()
+	camera.TalkErrorCode = -64303
+	camera.Start()
+	defer camera.Close()
+
+	_, server := newTestServer(t, camera)
+
+	if _, resp, err := dial(server, url.Values{"camera": {"garden"}}, nil); err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v, want an unknown camera", err)
+	}
+	if _, resp, err := dial(server, url.Values{"camera": {"door"}}, nil); err == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got %v, want the talk refused", err)
+	}
+}
+
+func TestTalkUpgradeFailure(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	_, server := newTestServer(t, camera)
+
+	// a plain request is not upgraded to a websocket
+	resp, err := http.Get(server.URL + "/?camera=door")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Fatal("plain request upgraded")
+	}
+
+	if n := camera.Talks(); n != 1 {
+		t.Errorf("%d talks started, want 1", n)
+	}
+	connection := fmt.Sprintf("sbipc_camera_connections{camera=%q} 0", camera.Addr)
+	waitFor(t, "the camera connection to close", func() bool {
+		var buf bytes.Buffer
+		metrics.WriteText(&buf)
+		return strings.Contains(buf.String(), "\n"+connection+"\n")
+	})
+}
+
+func TestTalkAuth(t *testing.T) {
+	camera := tplinktest.NewServer()
+	defer camera.Close()
+
+	s, server := newTestServer(t, camera)
+	a, err := auth.New(&auth.File{Users: map[string]auth.UserConfig{
+		"alice": {Tokens: []string{"alice-token"}, Cameras: map[string][]auth.Permission{"door": {auth.View}}},
+		"bob":   {Tokens: []string{"bob-token"}, Cameras: map[string][]auth.Permission{"door": {auth.Talk}}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Auth = a
+
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "alice-token": http.StatusForbidden} {
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		if _, resp, err := dial(server, url.Values{"camera": {"door"}}, header); err == nil || resp.StatusCode != status {
+			t.Errorf("token %q: got %v, want %d", token, err, status)
+		}
+	}
+
+	ws, _, err := dial(server, url.Values{"camera": {"door"}, "access_token": {"bob-token"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+}
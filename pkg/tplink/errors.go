@@ -0,0 +1,93 @@
+package tplink
+
+import (
+	"errors"
+	"fmt"
+	"sbipc/pkg/mtsp"
+)
+
+// Sentinel errors for the refusals cameras are known to answer with, to be
+// tested with errors.Is on the errors of Conn.
+var (
+	// ErrUnauthorized is a wrong username or password.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is a user without the permission for the request.
+	ErrForbidden = errors.New("forbidden")
+	// ErrSessionNotFound is a session id the camera does not know, usually
+	// because the session already stopped.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionLimit is a camera already serving as many streams as it can.
+	ErrSessionLimit = errors.New("too many sessions")
+	// ErrPrivacyMode is a camera with its lens covered by the privacy mode.
+	ErrPrivacyMode = errors.New("privacy mode is on")
+	// ErrUnsupported is a request the camera does not implement.
+	ErrUnsupported = errors.New("unsupported request")
+	// ErrBusy is a camera unable to serve the request right now.
+	ErrBusy = errors.New("camera busy")
+)
+
+// statusErrors maps the RTSP statuses of MULTITRANS responses.
+var statusErrors = map[int]error{
+	401: ErrUnauthorized,
+	403: ErrForbidden,
+	405: ErrUnsupported,
+	453: ErrSessionLimit,
+	454: ErrSessionNotFound,
+	501: ErrUnsupported,
+	503: ErrBusy,
+}
+
+// codeErrors maps the error_code of JSON responses.
+var codeErrors = map[int]error{
+	-40101: ErrUnsupported,
+	-40105: ErrUnsupported,
+	-40106: ErrUnsupported,
+	-40210: ErrUnsupported,
+	-40209: ErrUnauthorized,
+	-40401: ErrUnauthorized,
+	-71103: ErrForbidden,
+	-64324: ErrPrivacyMode,
+	-64303: ErrBusy,
+}
+
+// Error is a request refused by the camera, with either an RTSP status or a
+// JSON error_code. It unwraps to the matching sentinel error, if known.
+type Error struct {
+	// StatusCode and Status are the RTSP status, when not 200.
+	StatusCode int
+	Status     string
+	// Code is the error_code of the JSON response, when the status is 200.
+	Code int
+
+	err error
+}
+
+func (e *Error) Error() string {
+	if e.Code != 0 {
+		if e.err != nil {
+			return fmt.Sprintf("error code %d: %s", e.Code, e.err)
+		}
+		return fmt.Sprintf("error code %d", e.Code)
+	}
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Status)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// checkStatus returns an *Error when a response is not a success.
+func checkStatus(r *mtsp.Packet) error {
+	if r.StatusCode == 200 {
+		return nil
+	}
+	return &Error{StatusCode: r.StatusCode, Status: r.Status, err: statusErrors[r.StatusCode]}
+}
+
+// checkCode returns an *Error when a JSON response has an error_code.
+func checkCode(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return &Error{StatusCode: 200, Status: "OK", Code: code, err: codeErrors[code]}
+}
@@ -0,0 +1,42 @@
+package tplink_test
+
+import (
+	"errors"
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+)
+
+func TestCameraRefusals(t *testing.T) {
+	s := tplinktest.NewUnstartedServer()
+	s.PreviewParams.ErrorCode = -64324
+	s.TalkErrorCode = -64303
+	s.Start()
+	defer s.Close()
+
+	c, err := tplink.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Handshake(s.Username, "wrong"); !errors.Is(err, tplink.ErrUnauthorized) {
+		t.Errorf("handshake: got %v, want unauthorized", err)
+	}
+	if err := c.Handshake(s.Username, s.Password); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.StartPreview()
+	if !errors.Is(err, tplink.ErrPrivacyMode) {
+		t.Errorf("preview: got %v, want privacy mode", err)
+	}
+	var tpErr *tplink.Error
+	if !errors.As(err, &tpErr) || tpErr.Code != -64324 {
+		t.Errorf("preview: got %#v, want error code -64324", err)
+	}
+
+	if _, err := c.StartTalk(); !errors.Is(err, tplink.ErrBusy) {
+		t.Errorf("talk: got %v, want busy", err)
+	}
+}
@@ -1,45 +1,72 @@
 package tplink
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/textproto"
 	"sbipc/pkg/mtsp"
+	"strconv"
+	"strings"
 	"sync"
-
-	"github.com/pion/rtp/v2"
+	"sync/atomic"
+	"time"
 )
 
+// teardownTimeout bounds the teardown written when closing.
+const teardownTimeout = time.Second
+
 type Conn struct {
-	tcp       net.Conn
 	conn      *mtsp.Conn
+	address   string
 	seq       int
 	writeLock *sync.Mutex
+	talk      *TalkWriter
+	// noAudio drops the audio packets of the preview, it is set by
+	// StartPreviewWithOptions while another goroutine may be reading
+	noAudio atomic.Bool
+
+	lock *sync.Mutex
+	// sessions are the kinds of the sessions running, by id
+	sessions map[string]string
+	closed   bool
 }
 
 func (c *Conn) Handshake(username, password string) error {
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
+	return c.HandshakeContext(context.Background(), username, password)
+}
 
+func (c *Conn) HandshakeContext(ctx context.Context, username, password string) error {
 	headers := textproto.MIMEHeader{}
 	headers.Add("Authorization", fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))))
 	headers.Add("X-Handshake", "unused debug")
 
-	c.conn.WriteMultiTrans(&headers, []byte{})
-
-	r, err := c.conn.Read()
+	r, err := c.conn.MultiTransContext(ctx, &headers, []byte{})
 	if err != nil {
-		return fmt.Errorf("conn write: %w", err)
+		handshakeFailures.Inc(c.address)
+		return fmt.Errorf("multitrans: %w", err)
 	}
-	if r.StatusCode != 200 {
-		return fmt.Errorf("status %d: %s", r.StatusCode, r.Status)
+	if err := checkStatus(r); err != nil {
+		handshakeFailures.Inc(c.address)
+		return err
 	}
 
 	return nil
 }
 
+// nextSeq returns the "seq" of the next JSON request.
+func (c *Conn) nextSeq() int {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	seq := c.seq
+	c.seq++
+	return seq
+}
+
 type talkResult struct {
 	Type   string `json:"type"`
 	Seq    int    `json:"seq"`
@@ -50,73 +77,66 @@ type talkResult struct {
 }
 
 func (c *Conn) StartTalk() (string, error) {
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
+	return c.StartTalkContext(context.Background())
+}
 
+func (c *Conn) StartTalkContext(ctx context.Context) (string, error) {
 	headers := textproto.MIMEHeader{}
 	headers.Add("Content-Type", "application/json")
 
-	c.conn.WriteMultiTrans(&headers, []byte(fmt.Sprintf(`{"type":"request","seq":%d,"params":{"method":"get","talk":{"mode":"aec"}}}`, c.seq)))
-
-	r, err := c.conn.Read()
+	r, err := c.conn.MultiTransContext(ctx, &headers, []byte(fmt.Sprintf(`{"type":"request","seq":%d,"params":{"method":"get","talk":{"mode":"aec"}}}`, c.nextSeq())))
 	if err != nil {
-		return "", fmt.Errorf("conn write: %w", err)
+		return "", fmt.Errorf("multitrans: %w", err)
 	}
-	if r.StatusCode != 200 {
-		return "", fmt.Errorf("status %d: %s", r.StatusCode, r.Status)
+	if err := checkStatus(r); err != nil {
+		return "", err
 	}
 
-	c.seq++
-
 	var resp talkResult
 	if err = json.Unmarshal(r.Body, &resp); err != nil {
 		return "", fmt.Errorf("unmarshal: %w", err)
 	}
+	if err := checkCode(resp.Params.ErrorCode); err != nil {
+		return "", err
+	}
+	if resp.Params.SessionID == "" {
+		return "", errors.New("no session id in response")
+	}
+	c.startSession(resp.Params.SessionID, sessionTalk)
 
 	return resp.Params.SessionID, nil
 }
 
+// WriteTalk sends a talk packet on the default talk stream of the
+// connection. Use NewTalkWriter to configure the stream.
 func (c *Conn) WriteTalk(rtpBody []byte) error {
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
-
-	rtpHeader := rtp.Header{
-		Version:        2,
-		PayloadType:    65,
-		SequenceNumber: 0,
-		Timestamp:      0x15f90,
-		SSRC:           0x78,
-	}
-	rtpHeaderBytes, _ := rtpHeader.Marshal()
-
-	packetBody := make([]byte, len(rtpBody)+len(rtpHeaderBytes))
-	copy(packetBody, rtpHeaderBytes)
-	copy(packetBody[len(rtpHeaderBytes):], rtpBody)
-
-	c.conn.WriteInterleaved(packetBody)
-
-	return nil
+	_, err := c.talk.Write(rtpBody)
+	return err
 }
 
 func (c *Conn) StopTalk(sessionId string) error {
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
+	return c.StopTalkContext(context.Background(), sessionId)
+}
 
+func (c *Conn) StopTalkContext(ctx context.Context, sessionId string) error {
 	headers := textproto.MIMEHeader{}
 	headers.Add("Content-Type", "application/json")
 	headers.Add("X-Session-Id", sessionId)
 
-	c.conn.WriteMultiTrans(&headers, []byte(fmt.Sprintf(`{"type":"request","seq":%d,"params":{"method":"do","stop":"null"}}`, c.seq)))
-
-	r, err := c.conn.Read()
+	r, err := c.conn.MultiTransContext(ctx, &headers, []byte(fmt.Sprintf(`{"type":"request","seq":%d,"params":{"method":"do","stop":"null"}}`, c.nextSeq())))
 	if err != nil {
-		return fmt.Errorf("conn write: %w", err)
+		return fmt.Errorf("multitrans: %w", err)
 	}
-	if r.StatusCode != 200 {
-		return fmt.Errorf("status %d: %s", r.StatusCode, r.Status)
+	c.stopSession(sessionId)
+	if err := checkStatus(r); err != nil {
+		return err
 	}
 
-	c.seq++
+	// some cameras answer stops with an empty body
+	var resp talkResult
+	if json.Unmarshal(r.Body, &resp) == nil {
+		return checkCode(resp.Params.ErrorCode)
+	}
 
 	return nil
 }
@@ -125,6 +145,10 @@ func (c *Conn) StopPreview(sessionId string) error {
 	return c.StopTalk(sessionId)
 }
 
+func (c *Conn) StopPreviewContext(ctx context.Context, sessionId string) error {
+	return c.StopTalkContext(ctx, sessionId)
+}
+
 type PreviewParams struct {
 	ErrorCode   int    `json:"error_code"`
 	SessionID   string `json:"session_id"`
@@ -146,62 +170,206 @@ type PreviewParams struct {
 	} `json:"av_config"`
 }
 
+// AudioClockRate returns the audio sampling rate in Hz. The camera may give
+// it in Hz or kHz, and every known camera uses 8 kHz when it is missing.
+func (p *PreviewParams) AudioClockRate() int {
+	if p == nil || len(p.AvConfig) == 0 {
+		return 8000
+	}
+
+	rate, err := strconv.Atoi(p.AvConfig[0].AudioSamplingRate)
+	if err != nil || rate <= 0 {
+		return 8000
+	}
+	if rate < 1000 {
+		rate *= 1000
+	}
+	return rate
+}
+
+// AudioULaw reports whether the audio is µ-law, rather than A-law.
+func (p *PreviewParams) AudioULaw() bool {
+	if p == nil || len(p.AvConfig) == 0 {
+		return false
+	}
+
+	switch strings.ToUpper(p.AvConfig[0].AudioCodec) {
+	case "PCMU", "G711U":
+		return true
+	}
+	return false
+}
+
 type previewResult struct {
 	Type   string         `json:"type"`
 	Seq    int            `json:"seq"`
 	Params *PreviewParams `json:"params"`
 }
 
+// Resolution is the stream of a camera channel, the main stream is HD and
+// the sub streams are VGA and QVGA.
+type Resolution string
+
+const (
+	ResolutionHD   Resolution = "HD"
+	ResolutionVGA  Resolution = "VGA"
+	ResolutionQVGA Resolution = "QVGA"
+)
+
+// PreviewOptions selects what a preview streams. The zero value is the HD
+// stream of channel 0 with audio.
+type PreviewOptions struct {
+	// Channels are the camera channels to stream, for cameras with several
+	// lenses. Defaults to channel 0.
+	Channels []int
+	// Resolution defaults to ResolutionHD.
+	Resolution Resolution
+	// NoAudio drops the audio channel, so reads only return video. The
+	// preview request has no audio option, so the camera still sends the
+	// audio and it is dropped when reading.
+	NoAudio bool
+}
+
+type previewRequest struct {
+	Channels []int `json:"channels"`
+	// sic, one per channel
+	PrivaryAuth []int        `json:"privary_auth"`
+	Resolutions []Resolution `json:"resolutions"`
+}
+
+func (o *PreviewOptions) request() (*previewRequest, error) {
+	req := &previewRequest{
+		Channels:    []int{0},
+		Resolutions: []Resolution{ResolutionHD},
+	}
+	if o == nil {
+		req.PrivaryAuth = []int{0}
+		return req, nil
+	}
+
+	if len(o.Channels) > 0 {
+		req.Channels = o.Channels
+	}
+	switch o.Resolution {
+	case "":
+	case ResolutionHD, ResolutionVGA, ResolutionQVGA:
+		req.Resolutions = []Resolution{o.Resolution}
+	default:
+		return nil, fmt.Errorf("unknown resolution: %s", o.Resolution)
+	}
+	req.PrivaryAuth = make([]int, len(req.Channels))
+
+	return req, nil
+}
+
 func (c *Conn) StartPreview() (*PreviewParams, error) {
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
+	return c.StartPreviewContext(context.Background())
+}
 
-	headers := textproto.MIMEHeader{}
-	headers.Add("Content-Type", "application/json")
+func (c *Conn) StartPreviewContext(ctx context.Context) (*PreviewParams, error) {
+	return c.StartPreviewWithOptionsContext(ctx, nil)
+}
 
-	c.conn.WriteMultiTrans(&headers, []byte(fmt.Sprintf(`{"type":"request","seq":%d,"params":{"method":"get","preview":{"channels":[0],"privary_auth":[0],"resolutions":["HD"]}}}`, c.seq)))
+// StartPreviewWithOptions starts streaming, with the default options when
+// options is nil.
+func (c *Conn) StartPreviewWithOptions(options *PreviewOptions) (*PreviewParams, error) {
+	return c.StartPreviewWithOptionsContext(context.Background(), options)
+}
 
-	r, err := c.conn.Read()
+func (c *Conn) StartPreviewWithOptionsContext(ctx context.Context, options *PreviewOptions) (*PreviewParams, error) {
+	preview, err := options.request()
 	if err != nil {
-		return nil, fmt.Errorf("conn write: %w", err)
+		return nil, err
 	}
-	if r.StatusCode != 200 {
-		return nil, fmt.Errorf("status %d: %s", r.StatusCode, r.Status)
+	c.noAudio.Store(options != nil && options.NoAudio)
+	body, err := json.Marshal(preview)
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
 	}
 
-	c.seq++
+	headers := textproto.MIMEHeader{}
+	headers.Add("Content-Type", "application/json")
+
+	r, err := c.conn.MultiTransContext(ctx, &headers, []byte(fmt.Sprintf(`{"type":"request","seq":%d,"params":{"method":"get","preview":%s}}`, c.nextSeq(), body)))
+	if err != nil {
+		return nil, fmt.Errorf("multitrans: %w", err)
+	}
+	if err := checkStatus(r); err != nil {
+		return nil, err
+	}
 
 	var resp previewResult
 	if err = json.Unmarshal(r.Body, &resp); err != nil {
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
+	if resp.Params == nil {
+		return nil, errors.New("no params in response")
+	}
+	if err := checkCode(resp.Params.ErrorCode); err != nil {
+		return nil, err
+	}
+	c.startSession(resp.Params.SessionID, sessionPreview)
 
 	return resp.Params, nil
 }
 
 func (c *Conn) Read() (*mtsp.Packet, error) {
-	return c.conn.Read()
+	return c.ReadContext(context.Background())
+}
+
+// ReadContext is like Read but gives up when ctx is done, so a camera that
+// stops sending does not block the caller forever.
+func (c *Conn) ReadContext(ctx context.Context) (*mtsp.Packet, error) {
+	for {
+		p, err := c.conn.ReadContext(ctx)
+		// interleaved channel 1 carries the audio, whatever the lens of
+		// PreviewOptions.Channels
+		if err != nil || !c.noAudio.Load() || p.Channel != 1 {
+			return p, err
+		}
+	}
 }
 
 func (c *Conn) Close() {
-	c.writeLock.Lock()
-	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		for id, kind := range c.sessions {
+			delete(c.sessions, id)
+			cameraSessions.Dec(c.address, kind)
+		}
+		cameraConnections.Dec(c.address)
+	}
+	c.lock.Unlock()
+
+	// a camera which stopped reading must not block closing
+	ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+	defer cancel()
 
-	c.conn.WriteTeardown()
-	c.tcp.Close()
+	c.conn.WriteTeardownContext(ctx)
+	c.conn.Close()
 }
 
 func Dial(address string) (*Conn, error) {
-	tcp, err := net.Dial("tcp", address)
+	return DialContext(context.Background(), address)
+}
+
+func DialContext(ctx context.Context, address string) (*Conn, error) {
+	var d net.Dialer
+	tcp, err := d.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
 
 	conn := &Conn{
-		tcp:       tcp,
 		conn:      mtsp.NewConn(tcp),
+		address:   address,
 		writeLock: &sync.Mutex{},
+		lock:      &sync.Mutex{},
+		sessions:  map[string]string{},
 	}
+	conn.talk = conn.NewTalkWriter()
+	cameraConnections.Inc(address)
 
 	return conn, nil
 }
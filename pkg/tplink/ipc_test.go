@@ -0,0 +1,80 @@
+package tplink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// silentCamera accepts connections and reads them without ever answering,
+// like a camera which hung.
+func silentCamera(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestContextsBoundRequests(t *testing.T) {
+	c, err := Dial(silentCamera(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for name, request := range map[string]func(ctx context.Context) error{
+		"handshake": func(ctx context.Context) error { return c.HandshakeContext(ctx, "admin", "secret") },
+		"preview": func(ctx context.Context) error {
+			_, err := c.StartPreviewContext(ctx)
+			return err
+		},
+		"talk": func(ctx context.Context) error {
+			_, err := c.StartTalkContext(ctx)
+			return err
+		},
+		"read": func(ctx context.Context) error {
+			_, err := c.ReadContext(ctx)
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := request(ctx)
+		cancel()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: got %v, want the deadline exceeded", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: gave up after %s", name, elapsed)
+		}
+	}
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := DialContext(ctx, silentCamera(t)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the dial cancelled", err)
+	}
+}
@@ -0,0 +1,40 @@
+package tplink
+
+import "sbipc/pkg/metrics"
+
+var (
+	cameraConnections = metrics.NewGauge("sbipc_camera_connections", "Open connections to cameras.", "camera")
+	handshakeFailures = metrics.NewCounter("sbipc_camera_handshake_failures_total", "Handshakes which failed or were refused by cameras.", "camera")
+	cameraSessions    = metrics.NewGauge("sbipc_camera_sessions", "Preview, playback and talk sessions running on cameras.", "camera", "kind")
+	talkBytes         = metrics.NewCounter("sbipc_talk_bytes_total", "Talk audio bytes forwarded to cameras.", "camera")
+)
+
+// The kinds of sessions of sbipc_camera_sessions.
+const (
+	sessionPreview  = "preview"
+	sessionPlayback = "playback"
+	sessionTalk     = "talk"
+)
+
+// startSession counts a session, until it is stopped or the connection
+// closed.
+func (c *Conn) startSession(id, kind string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.sessions[id]; ok || c.closed {
+		return
+	}
+	c.sessions[id] = kind
+	cameraSessions.Inc(c.address, kind)
+}
+
+func (c *Conn) stopSession(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if kind, ok := c.sessions[id]; ok {
+		delete(c.sessions, id)
+		cameraSessions.Dec(c.address, kind)
+	}
+}
@@ -0,0 +1,50 @@
+package tplink_test
+
+import (
+	"bytes"
+	"fmt"
+	"sbipc/pkg/metrics"
+	"strings"
+	"testing"
+)
+
+func metric(t *testing.T, line string) bool {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := metrics.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Contains(buf.String(), "\n"+line+"\n")
+}
+
+func TestSessionMetrics(t *testing.T) {
+	s, c := dialPreview(t)
+
+	connections := fmt.Sprintf(`sbipc_camera_connections{camera=%q} 1`, s.Addr)
+	previews := fmt.Sprintf(`sbipc_camera_sessions{camera=%q,kind="preview"}`, s.Addr)
+
+	if !metric(t, connections) {
+		t.Error("connection not counted")
+	}
+
+	params, err := c.StartPreview()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metric(t, previews+" 1") {
+		t.Error("preview not counted")
+	}
+
+	if err := c.StopPreview(params.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if !metric(t, previews+" 0") {
+		t.Error("stopped preview still counted")
+	}
+
+	c.Close()
+	if !metric(t, fmt.Sprintf(`sbipc_camera_connections{camera=%q} 0`, s.Addr)) {
+		t.Error("closed connection still counted")
+	}
+}
@@ -0,0 +1,34 @@
+package tplink_test
+
+import (
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+)
+
+func TestAudioULaw(t *testing.T) {
+	for codec, want := range map[string]bool{"PCMA": false, "G711A": false, "pcmu": true, "G711U": true} {
+		params := tplinktest.DefaultPreviewParams()
+		params.AvConfig[0].AudioCodec = codec
+		if got := params.AudioULaw(); got != want {
+			t.Errorf("%s: got µ-law %v, want %v", codec, got, want)
+		}
+	}
+}
+
+func TestAudioClockRate(t *testing.T) {
+	for rate, want := range map[string]int{"8": 8000, "16000": 16000, "": 8000, "bogus": 8000} {
+		params := tplinktest.DefaultPreviewParams()
+		params.AvConfig[0].AudioSamplingRate = rate
+		if got := params.AudioClockRate(); got != want {
+			t.Errorf("%q: got %d, want %d", rate, got, want)
+		}
+	}
+}
+
+func TestNilParams(t *testing.T) {
+	var params *tplink.PreviewParams
+	if params.AudioULaw() || params.AudioClockRate() != 8000 {
+		t.Error("nil params not taken for 8 kHz A-law")
+	}
+}
@@ -0,0 +1,80 @@
+package tplink_test
+
+import (
+	"context"
+	"sbipc/pkg/tplink"
+	"testing"
+	"time"
+)
+
+func TestSearchRecordings(t *testing.T) {
+	s, c := dialPreview(t)
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)
+	// more than a page on the first day
+	for i := 0; i < 150; i++ {
+		start := day.Add(time.Duration(i) * 5 * time.Minute)
+		s.Recordings = append(s.Recordings, tplink.Recording{Start: start, End: start.Add(4 * time.Minute), Type: tplink.RecordingMotion})
+	}
+	next := day.AddDate(0, 0, 1).Add(time.Hour)
+	s.Recordings = append(s.Recordings, tplink.Recording{Start: next, End: next.Add(time.Hour), Type: tplink.RecordingContinuous})
+
+	recordings, err := c.SearchRecordings(0, day.Add(time.Hour), day.AddDate(0, 0, 1).Add(90*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the recordings of the first hour are left out
+	if len(recordings) != 150-12+1 {
+		t.Fatalf("got %d recordings, want %d", len(recordings), 150-12+1)
+	}
+	if first := recordings[0]; !first.Start.Equal(day.Add(time.Hour)) || first.Type != tplink.RecordingMotion {
+		t.Errorf("got first recording %+v", first)
+	}
+	if last := recordings[len(recordings)-1]; !last.Start.Equal(next) || last.Type != tplink.RecordingContinuous {
+		t.Errorf("got last recording %+v", last)
+	}
+	for i := 1; i < len(recordings); i++ {
+		if recordings[i].Start.Before(recordings[i-1].Start) {
+			t.Fatalf("recording %d out of order", i)
+		}
+	}
+
+	if _, err := c.SearchRecordings(0, day, day); err == nil {
+		t.Error("searched an empty span")
+	}
+}
+
+func TestStartPlayback(t *testing.T) {
+	s, c := dialPreview(t)
+
+	start := time.Now().Add(-time.Hour)
+	for _, speed := range []float64{3, 32, 1.0 / 32} {
+		if _, err := c.StartPlayback(&tplink.PlaybackOptions{Start: start, End: start.Add(time.Minute), Speed: speed}); err == nil {
+			t.Errorf("playback started at speed %g", speed)
+		}
+	}
+	if _, err := c.StartPlayback(&tplink.PlaybackOptions{Start: start, End: start}); err == nil {
+		t.Error("playback of an empty span started")
+	}
+	if _, err := c.StartPlayback(nil); err == nil {
+		t.Error("playback started without options")
+	}
+	if s.Playbacks() != 0 {
+		t.Fatalf("started %d playbacks", s.Playbacks())
+	}
+
+	params, err := c.StartPlayback(&tplink.PlaybackOptions{Start: start, End: start.Add(time.Minute), Speed: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.SessionID == "" || s.Playbacks() != 1 {
+		t.Errorf("got session %q and %d playbacks", params.SessionID, s.Playbacks())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.ReadContext(ctx); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,59 @@
+package tplink_test
+
+import (
+	"context"
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+)
+
+func dialPreview(t *testing.T) (*tplinktest.Server, *tplink.Conn) {
+	t.Helper()
+
+	s := tplinktest.NewServer()
+	t.Cleanup(s.Close)
+
+	c, err := tplink.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	if err := c.Handshake(s.Username, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func TestPreviewNoAudio(t *testing.T) {
+	_, c := dialPreview(t)
+
+	if _, err := c.StartPreviewWithOptions(&tplink.PreviewOptions{Resolution: tplink.ResolutionVGA, NoAudio: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the fake camera sends an audio packet after every video frame
+	for i := 0; i < 20; i++ {
+		p, err := c.ReadContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.IsInterleaved && p.Channel != 0 {
+			t.Fatalf("got a packet on channel %d", p.Channel)
+		}
+	}
+}
+
+func TestPreviewUnknownResolution(t *testing.T) {
+	s, c := dialPreview(t)
+
+	if _, err := c.StartPreviewWithOptions(&tplink.PreviewOptions{Resolution: "4K"}); err == nil {
+		t.Error("preview started with an unknown resolution")
+	}
+	if s.Previews() != 0 {
+		t.Errorf("started %d previews", s.Previews())
+	}
+}
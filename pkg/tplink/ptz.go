@@ -0,0 +1,179 @@
+package tplink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"strconv"
+)
+
+// Directions of MoveStep, in degrees counterclockwise from the right.
+const (
+	DirectionRight = 0
+	DirectionUp    = 90
+	DirectionLeft  = 180
+	DirectionDown  = 270
+)
+
+// Preset is a saved position of a pan and tilt camera.
+type Preset struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type controlResult struct {
+	Type   string          `json:"type"`
+	Seq    int             `json:"seq"`
+	Params json.RawMessage `json:"params"`
+}
+
+// control sends a JSON request of a method with params, and returns the
+// params of the response.
+func (c *Conn) control(ctx context.Context, method string, params map[string]interface{}) (json.RawMessage, error) {
+	params["method"] = method
+	body, err := json.Marshal(map[string]interface{}{
+		"type":   "request",
+		"seq":    c.nextSeq(),
+		"params": params,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+
+	headers := textproto.MIMEHeader{}
+	headers.Add("Content-Type", "application/json")
+
+	r, err := c.conn.MultiTransContext(ctx, &headers, body)
+	if err != nil {
+		return nil, fmt.Errorf("multitrans: %w", err)
+	}
+	if err := checkStatus(r); err != nil {
+		return nil, err
+	}
+
+	var resp controlResult
+	if err = json.Unmarshal(r.Body, &resp); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	var result struct {
+		ErrorCode int `json:"error_code"`
+	}
+	if err = json.Unmarshal(resp.Params, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	if err := checkCode(result.ErrorCode); err != nil {
+		return nil, err
+	}
+
+	return resp.Params, nil
+}
+
+func (c *Conn) MoveStep(direction int) error {
+	return c.MoveStepContext(context.Background(), direction)
+}
+
+// MoveStepContext moves the camera a step towards direction, in degrees.
+func (c *Conn) MoveStepContext(ctx context.Context, direction int) error {
+	_, err := c.control(ctx, "do", map[string]interface{}{
+		"motor": map[string]interface{}{
+			"movestep": map[string]string{"direction": strconv.Itoa(direction)},
+		},
+	})
+	return err
+}
+
+func (c *Conn) Move(x, y int) error {
+	return c.MoveContext(context.Background(), x, y)
+}
+
+// MoveContext moves the camera by x and y steps, negative to the left and
+// down.
+func (c *Conn) MoveContext(ctx context.Context, x, y int) error {
+	_, err := c.control(ctx, "do", map[string]interface{}{
+		"motor": map[string]interface{}{
+			"move": map[string]string{"x_coord": strconv.Itoa(x), "y_coord": strconv.Itoa(y)},
+		},
+	})
+	return err
+}
+
+func (c *Conn) StopMotion() error {
+	return c.StopMotionContext(context.Background())
+}
+
+// StopMotionContext stops the camera motor.
+func (c *Conn) StopMotionContext(ctx context.Context) error {
+	_, err := c.control(ctx, "do", map[string]interface{}{
+		"motor": map[string]interface{}{"stop": "null"},
+	})
+	return err
+}
+
+func (c *Conn) GotoPreset(id string) error {
+	return c.GotoPresetContext(context.Background(), id)
+}
+
+// GotoPresetContext moves the camera to a saved preset.
+func (c *Conn) GotoPresetContext(ctx context.Context, id string) error {
+	_, err := c.control(ctx, "do", map[string]interface{}{
+		"preset": map[string]interface{}{
+			"goto_preset": map[string]string{"id": id},
+		},
+	})
+	return err
+}
+
+func (c *Conn) SavePreset(name string) error {
+	return c.SavePresetContext(context.Background(), name)
+}
+
+// SavePresetContext saves the current position as a preset.
+func (c *Conn) SavePresetContext(ctx context.Context, name string) error {
+	_, err := c.control(ctx, "do", map[string]interface{}{
+		"preset": map[string]interface{}{
+			"set_preset": map[string]string{"name": name, "save_ptz": "1"},
+		},
+	})
+	return err
+}
+
+func (c *Conn) Presets() ([]Preset, error) {
+	return c.PresetsContext(context.Background())
+}
+
+// PresetsContext returns the saved presets.
+func (c *Conn) PresetsContext(ctx context.Context) ([]Preset, error) {
+	params, err := c.control(ctx, "get", map[string]interface{}{
+		"preset": map[string]interface{}{"name": []string{"preset"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ids and names are parallel lists
+	var resp struct {
+		Preset struct {
+			Preset struct {
+				ID   []string `json:"id"`
+				Name []string `json:"name"`
+			} `json:"preset"`
+		} `json:"preset"`
+	}
+	if err := json.Unmarshal(params, &resp); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	ids, names := resp.Preset.Preset.ID, resp.Preset.Preset.Name
+	presets := make([]Preset, 0, len(ids))
+	for i, id := range ids {
+		preset := Preset{ID: id}
+		if i < len(names) {
+			preset.Name = names[i]
+		}
+		presets = append(presets, preset)
+	}
+
+	return presets, nil
+}
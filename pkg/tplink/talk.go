@@ -0,0 +1,113 @@
+package tplink
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+const (
+	// DefaultTalkPayloadType and DefaultTalkSSRC are what the official
+	// clients send.
+	DefaultTalkPayloadType = 65
+	DefaultTalkSSRC        = 0x78
+	// DefaultTalkClockRate is the rate of the G.711 audio cameras play.
+	DefaultTalkClockRate = 8000
+
+	// maxPacingLag is how late a paced writer may fall before it stops
+	// catching up and restarts its schedule.
+	maxPacingLag = 200 * time.Millisecond
+)
+
+// TalkWriter sends talk audio to the camera as an RTP stream, numbering
+// packets and advancing timestamps by the samples sent. Payloads are G.711,
+// so each byte is a sample.
+type TalkWriter struct {
+	// PayloadType and SSRC are stamped on every packet.
+	PayloadType uint8
+	SSRC        uint32
+	// ClockRate is the audio sampling rate, used for timestamps and pacing.
+	ClockRate int
+	// Pace makes Write wait so packets leave at the rate they play, for
+	// callers producing audio faster than real time, like files.
+	Pace bool
+
+	conn      *Conn
+	lock      *sync.Mutex
+	sequence  uint16
+	timestamp uint32
+	// paceStart and paceSamples schedule paced packets
+	paceStart   time.Time
+	paceSamples int
+}
+
+// NewTalkWriter returns a talk stream on the connection, to be used once
+// StartTalk succeeded.
+func (c *Conn) NewTalkWriter() *TalkWriter {
+	return &TalkWriter{
+		PayloadType: DefaultTalkPayloadType,
+		SSRC:        DefaultTalkSSRC,
+		ClockRate:   DefaultTalkClockRate,
+		conn:        c,
+		lock:        &sync.Mutex{},
+	}
+}
+
+// Write sends payload as a single RTP packet.
+func (w *TalkWriter) Write(payload []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.Pace {
+		w.wait(len(payload))
+	}
+
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    w.PayloadType,
+			SequenceNumber: w.sequence,
+			Timestamp:      w.timestamp,
+			SSRC:           w.SSRC,
+		},
+		Payload: payload,
+	}
+
+	b, err := packet.Marshal()
+	if err != nil {
+		return 0, fmt.Errorf("marshal rtp: %w", err)
+	}
+
+	if err := w.conn.conn.WriteInterleaved(b); err != nil {
+		return 0, err
+	}
+
+	w.sequence++
+	w.timestamp += uint32(len(payload))
+	talkBytes.Add(int64(len(payload)), w.conn.address)
+
+	return len(payload), nil
+}
+
+// wait blocks until a packet of samples is due.
+func (w *TalkWriter) wait(samples int) {
+	now := time.Now()
+	if w.paceStart.IsZero() {
+		w.paceStart = now
+	}
+
+	due := w.paceStart.Add(time.Duration(w.paceSamples) * time.Second / time.Duration(w.ClockRate))
+	if now.Sub(due) > maxPacingLag {
+		// the caller paused, do not burst to catch up
+		w.paceStart = now
+		w.paceSamples = 0
+		due = now
+	}
+
+	if d := due.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+	w.paceSamples += samples
+}
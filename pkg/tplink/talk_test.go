@@ -0,0 +1,113 @@
+package tplink_test
+
+import (
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+// startTalk returns a connection talking to a fake camera.
+func startTalk(t *testing.T) (*tplinktest.Server, *tplink.Conn) {
+	t.Helper()
+
+	s := tplinktest.NewServer()
+	t.Cleanup(s.Close)
+
+	c, err := tplink.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+
+	if err := c.Handshake(s.Username, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StartTalk(); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, c
+}
+
+// talkPackets waits for n talk packets.
+func talkPackets(t *testing.T, s *tplinktest.Server, n int) []*rtp.Packet {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.TalkFrames()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d talk packets, want %d", len(s.TalkFrames()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var packets []*rtp.Packet
+	for _, frame := range s.TalkFrames() {
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(frame); err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+func TestTalkWriterNumbersPackets(t *testing.T) {
+	s, c := startTalk(t)
+
+	w := c.NewTalkWriter()
+	w.PayloadType = 8
+	w.SSRC = 1234
+	for _, size := range []int{160, 80, 160} {
+		if _, err := w.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packets := talkPackets(t, s, 3)
+	for i, want := range []uint32{0, 160, 240} {
+		p := packets[i]
+		if p.SequenceNumber != uint16(i) || p.Timestamp != want {
+			t.Errorf("packet %d has sequence %d and timestamp %d, want %d and %d", i, p.SequenceNumber, p.Timestamp, i, want)
+		}
+		if p.PayloadType != 8 || p.SSRC != 1234 {
+			t.Errorf("packet %d has payload type %d and ssrc %d", i, p.PayloadType, p.SSRC)
+		}
+	}
+}
+
+func TestWriteTalkUsesDefaultStream(t *testing.T) {
+	s, c := startTalk(t)
+
+	for i := 0; i < 2; i++ {
+		if err := c.WriteTalk(make([]byte, 160)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packets := talkPackets(t, s, 2)
+	if p := packets[1]; p.SequenceNumber != 1 || p.Timestamp != 160 || p.PayloadType != tplink.DefaultTalkPayloadType || p.SSRC != tplink.DefaultTalkSSRC {
+		t.Errorf("second packet has sequence %d, timestamp %d, payload type %d and ssrc %#x", p.SequenceNumber, p.Timestamp, p.PayloadType, p.SSRC)
+	}
+}
+
+func TestTalkWriterPaces(t *testing.T) {
+	_, c := startTalk(t)
+
+	w := c.NewTalkWriter()
+	w.Pace = true
+
+	// the first packet leaves right away, the next four 20 ms apart
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write(make([]byte, 160)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Errorf("5 paced packets took %s, want 80ms", elapsed)
+	}
+}
@@ -0,0 +1,116 @@
+package tplinktest
+
+import (
+	"time"
+
+	"github.com/pion/rtp/v2"
+)
+
+var (
+	// SPS and PPS of a 1280x720 constrained baseline stream, matching the
+	// sprop-parameter-sets of DefaultPreviewParams.
+	SPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0x1a, 0x32, 0x35, 0x00, 0xa0, 0x0b, 0x64, 0x03, 0xc2, 0x21, 0x1a, 0x80}
+	PPS = []byte{0x68, 0x1a, 0x34, 0xe3, 0xc8}
+)
+
+const (
+	videoPayloadType = 96
+	audioPayloadType = 8
+	videoClockRate   = 90000
+	audioClockRate   = 8000
+
+	// alawSilence is a zero sample encoded as A-law.
+	alawSilence = 0xd5
+)
+
+// stream generates canned H.264 and PCMA RTP packets with running sequence
+// numbers and timestamps.
+type stream struct {
+	interval   time.Duration
+	gopSize    int
+	frame      int
+	videoSeq   uint16
+	videoTs    uint32
+	audioSeq   uint16
+	audioTs    uint32
+	videoSsrc  uint32
+	audioSsrc  uint32
+	sliceBytes int
+}
+
+func newStream(interval time.Duration, gopSize int) *stream {
+	if gopSize <= 0 {
+		gopSize = 1
+	}
+
+	return &stream{
+		interval:   interval,
+		gopSize:    gopSize,
+		videoSsrc:  0x11223344,
+		audioSsrc:  0x55667788,
+		sliceBytes: 64,
+	}
+}
+
+func (s *stream) packet(payloadType uint8, seq uint16, ts uint32, ssrc uint32, marker bool, payload []byte) []byte {
+	p := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    payloadType,
+			SequenceNumber: seq,
+			Timestamp:      ts,
+			SSRC:           ssrc,
+		},
+		Payload: payload,
+	}
+
+	b, err := p.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// nextVideo returns the RTP packets of the next frame, prefixing key frames
+// with SPS and PPS.
+func (s *stream) nextVideo() [][]byte {
+	nalus := make([][]byte, 0, 3)
+	if s.frame%s.gopSize == 0 {
+		slice := make([]byte, s.sliceBytes)
+		slice[0] = 0x65
+		slice[1] = 0x88
+		nalus = append(nalus, SPS, PPS, slice)
+	} else {
+		slice := make([]byte, s.sliceBytes/4)
+		slice[0] = 0x41
+		slice[1] = 0x9a
+		nalus = append(nalus, slice)
+	}
+
+	packets := make([][]byte, 0, len(nalus))
+	for i, nalu := range nalus {
+		packets = append(packets, s.packet(videoPayloadType, s.videoSeq, s.videoTs, s.videoSsrc, i == len(nalus)-1, nalu))
+		s.videoSeq++
+	}
+
+	s.frame++
+	s.videoTs += uint32(s.interval * videoClockRate / time.Second)
+
+	return packets
+}
+
+// nextAudio returns one packet of A-law silence covering a frame interval.
+func (s *stream) nextAudio() []byte {
+	samples := int(s.interval * audioClockRate / time.Second)
+	payload := make([]byte, samples)
+	for i := range payload {
+		payload[i] = alawSilence
+	}
+
+	packet := s.packet(audioPayloadType, s.audioSeq, s.audioTs, s.audioSsrc, false, payload)
+	s.audioSeq++
+	s.audioTs += uint32(samples)
+
+	return packet
+}
@@ -0,0 +1,564 @@
+// Package tplinktest provides a fake TP-Link camera speaking the MULTITRANS
+// dialect on a local listener, so code built on pkg/tplink can be exercised
+// without a real camera.
+package tplinktest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"sbipc/pkg/mtsp"
+	"sbipc/pkg/tplink"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUsername = "admin"
+	DefaultPassword = "tplinktest"
+)
+
+const defaultPreviewParams = `{
+	"error_code": 0,
+	"session_id": "",
+	"interleaved": [
+		{"channel": 0, "interleaved_id": "0-1"}
+	],
+	"av_config": [
+		{
+			"channel": 0,
+			"video_codec": "H264",
+			"audio_codec": "PCMA",
+			"audio_sampling_rate": "8000",
+			"audio_bitwidth": "16",
+			"audio_channels": "1",
+			"extra_data": {
+				"video_rtpmap": "H264/90000",
+				"video_fmtp": "packetization-mode=1;profile-level-id=42C01F;sprop-parameter-sets=Z0LAHxoyNQCgC2QDwiEagA==,aBo048g="
+			}
+		}
+	]
+}`
+
+// DefaultPreviewParams returns the preview parameters a HD H.264 camera with
+// an 8 kHz PCMA microphone answers with.
+func DefaultPreviewParams() *tplink.PreviewParams {
+	var params tplink.PreviewParams
+	if err := json.Unmarshal([]byte(defaultPreviewParams), &params); err != nil {
+		panic(err)
+	}
+	return &params
+}
+
+type Server struct {
+	// Addr is the host:port the server listens on, available after Start.
+	Addr string
+
+	Username string
+	Password string
+
+	// PreviewParams is answered to preview requests, with session_id filled
+	// in by the server.
+	PreviewParams *tplink.PreviewParams
+
+	// FrameInterval is the delay between two streamed video frames. One
+	// audio packet covering the same duration is sent along every frame.
+	FrameInterval time.Duration
+
+	// GopSize is the number of frames between two key frames.
+	GopSize int
+
+	// TalkErrorCode, when not zero, refuses talk requests with this
+	// error_code. Previews are refused alike by the ErrorCode of
+	// PreviewParams.
+	TalkErrorCode int
+
+	// Recordings are the SD card recordings found by searches, by day of
+	// the local time zone. Playbacks stream the same media as previews.
+	Recordings []tplink.Recording
+
+	// Presets are the saved positions, listed and added to by preset
+	// requests.
+	Presets []tplink.Preset
+
+	listener  net.Listener
+	lock      *sync.Mutex
+	conns     map[*mtsp.Conn]struct{}
+	wg        *sync.WaitGroup
+	sessionId int
+	previews  int
+	talks     int
+	playbacks int
+	talk      [][]byte
+	motions   []string
+	closed    bool
+}
+
+// NewUnstartedServer returns a server which can be configured before Start
+// is called.
+func NewUnstartedServer() *Server {
+	return &Server{
+		Username:      DefaultUsername,
+		Password:      DefaultPassword,
+		PreviewParams: DefaultPreviewParams(),
+		FrameInterval: 40 * time.Millisecond,
+		GopSize:       25,
+		lock:          &sync.Mutex{},
+		conns:         map[*mtsp.Conn]struct{}{},
+		wg:            &sync.WaitGroup{},
+	}
+}
+
+// NewServer starts a server listening on a random local port.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+func (s *Server) Start() {
+	if s.listener != nil {
+		panic("tplinktest: server already started")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("tplinktest: failed to listen: %s", err))
+	}
+
+	s.listener = l
+	s.Addr = l.Addr().String()
+
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close stops the listener and drops every connection.
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.listener.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+
+	s.wg.Wait()
+}
+
+// CloseClientConnections drops every connection while keeping the
+// listener open, emulating a camera reboot or network failure.
+func (s *Server) CloseClientConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// TalkFrames returns the RTP packets received during talk sessions.
+func (s *Server) TalkFrames() [][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	frames := make([][]byte, len(s.talk))
+	copy(frames, s.talk)
+	return frames
+}
+
+// Previews returns how many preview sessions have been started.
+func (s *Server) Previews() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.previews
+}
+
+// Playbacks returns how many playback sessions have been started.
+func (s *Server) Playbacks() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.playbacks
+}
+
+// Motions returns the motor and preset requests received, like
+// "movestep 90", "move 10 -10", "stop" or "goto 1".
+func (s *Server) Motions() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	motions := make([]string, len(s.motions))
+	copy(motions, s.motions)
+	return motions
+}
+
+// Talks returns how many talk sessions have been started.
+func (s *Server) Talks() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.talks
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := mtsp.NewConn(nc)
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.lock.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(c)
+
+			s.lock.Lock()
+			delete(s.conns, c)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+type request struct {
+	Type   string `json:"type"`
+	Seq    int    `json:"seq"`
+	Params struct {
+		Method   string          `json:"method"`
+		Preview  json.RawMessage `json:"preview"`
+		Playback *struct {
+			Search *struct {
+				Date       string `json:"date"`
+				StartIndex int    `json:"start_index"`
+				EndIndex   int    `json:"end_index"`
+			} `json:"search_video_utility"`
+		} `json:"playback"`
+		Talk   json.RawMessage `json:"talk"`
+		Stop   json.RawMessage `json:"stop"`
+		Motor  *motorRequest   `json:"motor"`
+		Preset *presetRequest  `json:"preset"`
+	} `json:"params"`
+}
+
+type motorRequest struct {
+	MoveStep *struct {
+		Direction string `json:"direction"`
+	} `json:"movestep"`
+	Move *struct {
+		X string `json:"x_coord"`
+		Y string `json:"y_coord"`
+	} `json:"move"`
+	Stop json.RawMessage `json:"stop"`
+}
+
+type presetRequest struct {
+	Goto *struct {
+		ID string `json:"id"`
+	} `json:"goto_preset"`
+	Set *struct {
+		Name string `json:"name"`
+	} `json:"set_preset"`
+}
+
+type response struct {
+	Type   string      `json:"type"`
+	Seq    int         `json:"seq"`
+	Params interface{} `json:"params"`
+}
+
+// conn is the state of a single client connection.
+type conn struct {
+	*mtsp.Conn
+	authorized  bool
+	talkSession string
+	preview     string
+	stopPreview chan struct{}
+}
+
+func (s *Server) serveConn(mc *mtsp.Conn) {
+	c := &conn{Conn: mc}
+	defer func() {
+		c.stopStreaming()
+		c.Close()
+	}()
+
+	for {
+		p, err := c.Read()
+		if err != nil {
+			return
+		}
+
+		if p.IsInterleaved {
+			if c.talkSession != "" {
+				s.lock.Lock()
+				s.talk = append(s.talk, p.Body)
+				s.lock.Unlock()
+			}
+			continue
+		}
+
+		switch p.Method {
+		case "TEARDOWN":
+			return
+		case "MULTITRANS":
+			if err := s.handleMultiTrans(c, p); err != nil {
+				log.Printf("tplinktest: %s", err)
+				return
+			}
+		default:
+			c.WriteResponse(p, 405, "Method Not Allowed", nil, nil)
+		}
+	}
+}
+
+func (s *Server) handleMultiTrans(c *conn, p *mtsp.Packet) error {
+	if !c.authorized {
+		if !s.checkAuth(p.Headers.Get("Authorization")) {
+			return c.WriteResponse(p, 401, "Unauthorized", nil, nil)
+		}
+		c.authorized = true
+		return c.WriteResponse(p, 200, "OK", nil, nil)
+	}
+
+	var req request
+	if err := json.Unmarshal(p.Body, &req); err != nil {
+		return c.WriteResponse(p, 400, "Bad Request", nil, nil)
+	}
+
+	var params interface{}
+	switch {
+	case req.Params.Playback != nil && req.Params.Playback.Search != nil:
+		params = s.search(req.Params.Playback.Search.Date, req.Params.Playback.Search.StartIndex, req.Params.Playback.Search.EndIndex)
+	case req.Params.Playback != nil:
+		preview := *s.PreviewParams
+		preview.SessionID = s.nextSessionId()
+		params = &preview
+
+		s.lock.Lock()
+		s.playbacks++
+		s.lock.Unlock()
+
+		c.startStreaming(s, preview.SessionID)
+	case req.Params.Preview != nil && s.PreviewParams.ErrorCode != 0:
+		params = map[string]interface{}{"error_code": s.PreviewParams.ErrorCode}
+	case req.Params.Preview != nil:
+		preview := *s.PreviewParams
+		preview.SessionID = s.nextSessionId()
+		params = &preview
+
+		s.lock.Lock()
+		s.previews++
+		s.lock.Unlock()
+
+		c.startStreaming(s, preview.SessionID)
+	case req.Params.Talk != nil && s.TalkErrorCode != 0:
+		params = map[string]interface{}{"error_code": s.TalkErrorCode}
+	case req.Params.Talk != nil:
+		c.talkSession = s.nextSessionId()
+		params = map[string]interface{}{"error_code": 0, "session_id": c.talkSession}
+
+		s.lock.Lock()
+		s.talks++
+		s.lock.Unlock()
+	case req.Params.Motor != nil:
+		params = s.motor(req.Params.Motor)
+	case req.Params.Preset != nil:
+		params = s.preset(req.Params.Method, req.Params.Preset)
+	case req.Params.Stop != nil:
+		switch p.Headers.Get("X-Session-Id") {
+		case c.talkSession:
+			c.talkSession = ""
+		case c.preview:
+			c.stopStreaming()
+		}
+		params = map[string]interface{}{"error_code": 0}
+	default:
+		params = map[string]interface{}{"error_code": -40106}
+	}
+
+	body, err := json.Marshal(&response{Type: "response", Seq: req.Seq, Params: params})
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	headers := textproto.MIMEHeader{}
+	headers.Add("Content-Type", "application/json")
+
+	return c.WriteResponse(p, 200, "OK", &headers, body)
+}
+
+func (s *Server) checkAuth(authorization string) bool {
+	encoded, ok := strings.CutPrefix(authorization, "Basic ")
+	if !ok {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+
+	return string(decoded) == fmt.Sprintf("%s:%s", s.Username, s.Password)
+}
+
+func (s *Server) nextSessionId() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessionId++
+	return strconv.Itoa(s.sessionId)
+}
+
+// startStreaming streams media for a preview or playback session, replacing
+// the current one.
+func (c *conn) startStreaming(s *Server, sessionId string) {
+	c.stopStreaming()
+	c.preview = sessionId
+	c.stopPreview = make(chan struct{})
+	s.wg.Add(1)
+	go func(stop chan struct{}) {
+		defer s.wg.Done()
+		s.stream(c, stop)
+	}(c.stopPreview)
+}
+
+func (c *conn) stopStreaming() {
+	if c.stopPreview != nil {
+		close(c.stopPreview)
+		c.stopPreview = nil
+		c.preview = ""
+	}
+}
+
+// search answers a search of the recordings of a day.
+func (s *Server) search(date string, startIndex, endIndex int) interface{} {
+	type result struct {
+		StartTime string `json:"start_time"`
+		EndTime   string `json:"end_time"`
+		VideoType int    `json:"video_type"`
+	}
+
+	results := []result{}
+	index := 0
+	for _, r := range s.Recordings {
+		if r.Start.Local().Format("20060102") != date {
+			continue
+		}
+		if index >= startIndex && index <= endIndex {
+			results = append(results, result{
+				StartTime: strconv.FormatInt(r.Start.Unix(), 10),
+				EndTime:   strconv.FormatInt(r.End.Unix(), 10),
+				VideoType: int(r.Type),
+			})
+		}
+		index++
+	}
+
+	return map[string]interface{}{
+		"error_code": 0,
+		"playback":   map[string]interface{}{"search_video_results": results},
+	}
+}
+
+// motor answers a motor request, recording the motion.
+func (s *Server) motor(motor *motorRequest) interface{} {
+	var motion string
+	switch {
+	case motor.MoveStep != nil:
+		motion = "movestep " + motor.MoveStep.Direction
+	case motor.Move != nil:
+		motion = fmt.Sprintf("move %s %s", motor.Move.X, motor.Move.Y)
+	case motor.Stop != nil:
+		motion = "stop"
+	default:
+		return map[string]interface{}{"error_code": -40106}
+	}
+
+	s.lock.Lock()
+	s.motions = append(s.motions, motion)
+	s.lock.Unlock()
+
+	return map[string]interface{}{"error_code": 0}
+}
+
+// preset answers listing, going to and saving presets.
+func (s *Server) preset(method string, preset *presetRequest) interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch {
+	case method == "get":
+		ids, names := []string{}, []string{}
+		for _, p := range s.Presets {
+			ids = append(ids, p.ID)
+			names = append(names, p.Name)
+		}
+		return map[string]interface{}{
+			"error_code": 0,
+			"preset":     map[string]interface{}{"preset": map[string]interface{}{"id": ids, "name": names}},
+		}
+	case preset.Goto != nil:
+		for _, p := range s.Presets {
+			if p.ID == preset.Goto.ID {
+				s.motions = append(s.motions, "goto "+p.ID)
+				return map[string]interface{}{"error_code": 0}
+			}
+		}
+		return map[string]interface{}{"error_code": -64302}
+	case preset.Set != nil:
+		id := 1
+		for _, p := range s.Presets {
+			if n, _ := strconv.Atoi(p.ID); n >= id {
+				id = n + 1
+			}
+		}
+		s.Presets = append(s.Presets, tplink.Preset{ID: strconv.Itoa(id), Name: preset.Set.Name})
+		return map[string]interface{}{"error_code": 0}
+	default:
+		return map[string]interface{}{"error_code": -40106}
+	}
+}
+
+func (s *Server) stream(c *conn, stop chan struct{}) {
+	ticker := time.NewTicker(s.FrameInterval)
+	defer ticker.Stop()
+
+	st := newStream(s.FrameInterval, s.GopSize)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, packet := range st.nextVideo() {
+			if err := c.WriteInterleavedChannel(0, packet); err != nil {
+				return
+			}
+		}
+
+		if err := c.WriteInterleavedChannel(1, st.nextAudio()); err != nil {
+			return
+		}
+	}
+}
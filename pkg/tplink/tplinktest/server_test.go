@@ -0,0 +1,105 @@
+package tplinktest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp/v2"
+
+	"sbipc/pkg/tplink"
+	"sbipc/pkg/tplink/tplinktest"
+)
+
+func dial(t *testing.T, s *tplinktest.Server) *tplink.Conn {
+	t.Helper()
+
+	c, err := tplink.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestHandshakeChecksPassword(t *testing.T) {
+	s := tplinktest.NewServer()
+	defer s.Close()
+
+	if err := dial(t, s).Handshake(s.Username, "wrong"); err == nil {
+		t.Error("handshake with a wrong password succeeded")
+	}
+	if err := dial(t, s).Handshake(s.Username, s.Password); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreviewStreamsVideoAndAudio(t *testing.T) {
+	s := tplinktest.NewServer()
+	defer s.Close()
+
+	c := dial(t, s)
+	if err := c.Handshake(s.Username, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StartPreview(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	payloadTypes := map[int]uint8{}
+	for len(payloadTypes) < 2 {
+		p, err := c.ReadContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.IsInterleaved {
+			continue
+		}
+
+		var packet rtp.Packet
+		if err := packet.Unmarshal(p.Body); err != nil {
+			t.Fatalf("channel %d: %s", p.Channel, err)
+		}
+		payloadTypes[p.Channel] = packet.PayloadType
+	}
+
+	if payloadTypes[0] != 96 || payloadTypes[1] != 8 {
+		t.Errorf("got payload types %v, want H.264 on 0 and PCMA on 1", payloadTypes)
+	}
+	if s.Previews() != 1 {
+		t.Errorf("got %d previews", s.Previews())
+	}
+}
+
+func TestTalkFramesRecorded(t *testing.T) {
+	s := tplinktest.NewServer()
+	defer s.Close()
+
+	c := dial(t, s)
+	if err := c.Handshake(s.Username, s.Password); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StartTalk(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.WriteTalk([]byte{0x80, 0x08, 0, byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.TalkFrames()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d talk frames, want 3", len(s.TalkFrames()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Talks() != 1 {
+		t.Errorf("got %d talks", s.Talks())
+	}
+}
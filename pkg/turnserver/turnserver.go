@@ -0,0 +1,177 @@
+// Package turnserver embeds a TURN server relaying the media of viewers
+// outside the LAN, with short lived credentials minted per session.
+package turnserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// DefaultCredentialTTL is how long minted credentials are valid, sessions
+// keep their allocations past it.
+const DefaultCredentialTTL = 12 * time.Hour
+
+type Config struct {
+	// Listen is the UDP and TCP address of the server, :3478 by default.
+	Listen string `yaml:"listen" json:"listen"`
+	// PublicIP is the address viewers reach the server and its relays at.
+	PublicIP string `yaml:"publicIP" json:"publicIP"`
+	// Host is the host of the URLs handed to viewers, defaults to PublicIP.
+	Host string `yaml:"host" json:"host"`
+	// Realm defaults to sbipc.
+	Realm string `yaml:"realm" json:"realm"`
+	// RelayPortMin and RelayPortMax bound the relayed ports, any port when
+	// zero.
+	RelayPortMin uint16 `yaml:"relayPortMin" json:"relayPortMin"`
+	RelayPortMax uint16 `yaml:"relayPortMax" json:"relayPortMax"`
+	// CredentialTTL defaults to DefaultCredentialTTL.
+	CredentialTTL time.Duration `yaml:"credentialTTL" json:"credentialTTL"`
+}
+
+type Server struct {
+	server *turn.Server
+	secret []byte
+	urls   []string
+	ttl    time.Duration
+}
+
+// Start starts a TURN server.
+func Start(config *Config) (*Server, error) {
+	relayIP := net.ParseIP(config.PublicIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("invalid public ip %q", config.PublicIP)
+	}
+
+	listen := config.Listen
+	if listen == "" {
+		listen = ":3478"
+	}
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+
+	host := config.Host
+	if host == "" {
+		host = config.PublicIP
+	}
+	realm := config.Realm
+	if realm == "" {
+		realm = "sbipc"
+	}
+	ttl := config.CredentialTTL
+	if ttl == 0 {
+		ttl = DefaultCredentialTTL
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generate secret: %w", err)
+	}
+
+	s := &Server{
+		secret: secret,
+		urls: []string{
+			fmt.Sprintf("turn:%s?transport=udp", net.JoinHostPort(host, port)),
+			fmt.Sprintf("turn:%s?transport=tcp", net.JoinHostPort(host, port)),
+		},
+		ttl: ttl,
+	}
+
+	var generator turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: relayIP,
+		Address:      "0.0.0.0",
+	}
+	if config.RelayPortMin != 0 || config.RelayPortMax != 0 {
+		generator = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			MinPort:      config.RelayPortMin,
+			MaxPort:      config.RelayPortMax,
+			Address:      "0.0.0.0",
+		}
+	}
+
+	udpConn, err := net.ListenPacket("udp4", listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen udp: %w", err)
+	}
+	tcpListener, err := net.Listen("tcp4", listen)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("listen tcp: %w", err)
+	}
+
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: s.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpConn, RelayAddressGenerator: generator},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: generator},
+		},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("start turn: %w", err)
+	}
+
+	log.Printf("turn server listening at %s, relaying at %s", listen, config.PublicIP)
+
+	return s, nil
+}
+
+// Credentials mints credentials for a session, as the ICE server to hand
+// to its viewer. Usernames are the expiry and a random session tag.
+func (s *Server) Credentials() webrtc.ICEServer {
+	tag := make([]byte, 8)
+	rand.Read(tag)
+
+	expires := time.Now().Add(s.ttl).Unix()
+	username := fmt.Sprintf("%d:%s", expires, hex.EncodeToString(tag))
+
+	return webrtc.ICEServer{
+		URLs:       s.urls,
+		Username:   username,
+		Credential: s.password(username),
+	}
+}
+
+func (s *Server) password(username string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	expires, _, ok := strings.Cut(username, ":")
+	if !ok {
+		return nil, false
+	}
+
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || t < time.Now().Unix() {
+		log.Printf("turn: refused expired or invalid credentials from %s", srcAddr)
+		return nil, false
+	}
+
+	return turn.GenerateAuthKey(username, realm, s.password(username)), true
+}
+
+// Close stops the server and its relays.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,115 @@
+package turnserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v3"
+)
+
+func TestCredentials(t *testing.T) {
+	s := &Server{secret: []byte("secret"), urls: []string{"turn:203.0.113.7:3478?transport=udp"}, ttl: time.Hour}
+
+	server := s.Credentials()
+	expires, tag, ok := strings.Cut(server.Username, ":")
+	if !ok || len(tag) != 16 {
+		t.Fatalf("got username %q", server.Username)
+	}
+	if t0, _ := strconv.ParseInt(expires, 10, 64); time.Until(time.Unix(t0, 0)) < 59*time.Minute {
+		t.Errorf("credentials expire at %s", expires)
+	}
+
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte(server.Username))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); server.Credential != want {
+		t.Errorf("got credential %v, want %s", server.Credential, want)
+	}
+	if other := s.Credentials(); other.Username == server.Username {
+		t.Error("two sessions got the same username")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := &Server{secret: []byte("secret"), ttl: time.Hour}
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+
+	username := s.Credentials().Username
+	key, ok := s.authenticate(username, "sbipc", addr)
+	if !ok {
+		t.Fatal("valid credentials refused")
+	}
+	if want := turn.GenerateAuthKey(username, "sbipc", s.password(username)); string(key) != string(want) {
+		t.Error("got another key")
+	}
+
+	expired := fmt.Sprintf("%d:0011223344556677", time.Now().Add(-time.Minute).Unix())
+	for _, username := range []string{expired, "alice", "soon:0011223344556677"} {
+		if _, ok := s.authenticate(username, "sbipc", addr); ok {
+			t.Errorf("%s accepted", username)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	// a port free for both UDP and TCP
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+
+	s, err := Start(&Config{Listen: listen, PublicIP: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	server := s.Credentials()
+	if server.URLs[0] != "turn:"+listen+"?transport=udp" {
+		t.Errorf("got urls %v", server.URLs)
+	}
+
+	allocate := func(password string) error {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		client, err := turn.NewClient(&turn.ClientConfig{
+			TURNServerAddr: listen,
+			Conn:           conn,
+			Username:       server.Username,
+			Password:       password,
+			Realm:          "sbipc",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if err := client.Listen(); err != nil {
+			t.Fatal(err)
+		}
+
+		relay, err := client.Allocate()
+		if err != nil {
+			return err
+		}
+		return relay.Close()
+	}
+
+	if err := allocate(server.Credential.(string)); err != nil {
+		t.Error(err)
+	}
+	if err := allocate("wrong"); err == nil {
+		t.Error("allocated with a wrong password")
+	}
+}
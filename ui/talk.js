@@ -1,4 +1,4 @@
-const fields = ['address', 'username', 'password']
+const fields = ['camera', 'address', 'username', 'password']
 for (const field of fields) {
   const el = document.querySelector(`#talkform [name="${field}"]`)
   const key = `sbipc_${field}`
@@ -15,9 +15,14 @@ document.getElementById('talkform').addEventListener('submit', (e) => {
   e.preventDefault()
   const data = new FormData(e.target)
   const search = new URLSearchParams()
-  search.append('address', data.get('address'))
-  search.append('username', data.get('username'))
-  search.append('password', data.get('password'))
+  // cameras of the server are opened by id, their credentials stay there
+  if (data.get('camera')) {
+    search.append('camera', data.get('camera'))
+  } else {
+    search.append('address', data.get('address'))
+    search.append('username', data.get('username'))
+    search.append('password', data.get('password'))
+  }
   const urlBuilder = new URL('/talk', location.href)
   urlBuilder.search = search.toString()
   const wsUrl = urlBuilder.toString().replace(/^http/, 'ws')